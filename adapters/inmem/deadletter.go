@@ -0,0 +1,74 @@
+package inmem
+
+import (
+	"context"
+	"sync"
+
+	"github.com/go-cqrses/cqrses/deadletter"
+)
+
+type (
+	// DeadLetterSink stores the events subscribers failed to handle in memory.
+	DeadLetterSink struct {
+		letters []*deadletter.Letter
+		lock    *sync.Mutex
+	}
+)
+
+// NewDeadLetterSink returns a new in memory dead letter sink.
+func NewDeadLetterSink() *DeadLetterSink {
+	return &DeadLetterSink{
+		letters: []*deadletter.Letter{},
+		lock:    &sync.Mutex{},
+	}
+}
+
+// Record will store the letter, replacing a letter with the same ID.
+func (s *DeadLetterSink) Record(ctx context.Context, l *deadletter.Letter) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for i, existing := range s.letters {
+		if existing.ID == l.ID {
+			s.letters[i] = l
+			return nil
+		}
+	}
+
+	s.letters = append(s.letters, l)
+	return nil
+}
+
+// Letters returns up to limit letters for the subscriber, oldest first.
+func (s *DeadLetterSink) Letters(ctx context.Context, subscriber string, limit uint64) ([]*deadletter.Letter, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	out := []*deadletter.Letter{}
+	for _, l := range s.letters {
+		if limit > 0 && uint64(len(out)) == limit {
+			break
+		}
+
+		if l.Subscriber == subscriber {
+			out = append(out, l)
+		}
+	}
+
+	return out, nil
+}
+
+// Remove will delete the letter.
+func (s *DeadLetterSink) Remove(ctx context.Context, id string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for i, l := range s.letters {
+		if l.ID == id {
+			s.letters = append(s.letters[:i], s.letters[i+1:]...)
+			return nil
+		}
+	}
+
+	return nil
+}
@@ -3,136 +3,192 @@ package inmem
 import (
 	"context"
 	"regexp"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/go-cqrses/cqrses/eventstore"
 	"github.com/go-cqrses/cqrses/messages"
 )
 
+const (
+	// How many events a subscription loads at once.
+	subscriptionBatchSize uint64 = 100
+)
+
 type (
+	// An event in the all stream, with the stream it was appended to.
+	allStreamEvent struct {
+		stream *eventstore.Stream
+		event  *messages.Event
+
+		// The position of the event in its stream.
+		position uint64
+	}
+
 	// EventStore that stores stream in memory.
 	EventStore struct {
-		streams map[string]*eventstore.Stream
-		lock    *sync.Mutex
+		streams  map[string]*eventstore.Stream
+		all      []allStreamEvent
+		lock     *sync.Mutex
+		appended *eventstore.Broadcaster
+
+		// The global position of the last event appended.
+		position uint64
+
+		lazyStreams func(streamName string) bool
+
+		upcasters      *eventstore.Upcasters
+		payloadBuilder messages.PayloadBuilder
 	}
 )
 
 // New returns a new in memory event store.
 func New() *EventStore {
 	return &EventStore{
-		streams: map[string]*eventstore.Stream{},
-		lock:    &sync.Mutex{},
+		streams:  map[string]*eventstore.Stream{},
+		lock:     &sync.Mutex{},
+		appended: eventstore.NewBroadcaster(),
 	}
 }
 
+// SetUpcasters sets the upcasters applied to events as they are loaded. Events
+// that are upcast have their payloads converted to JSON and built again using
+// the payload builder, see SetPayloadBuilder.
+func (s *EventStore) SetUpcasters(upcasters *eventstore.Upcasters) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.upcasters = upcasters
+}
+
+// SetPayloadBuilder sets the payload builder used to build upcast events,
+// without one their payloads are built as maps.
+func (s *EventStore) SetPayloadBuilder(payloadBuilder messages.PayloadBuilder) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.payloadBuilder = payloadBuilder
+}
+
+// CreateStreamsLazily will create the streams with names matching when
+// events are first appended to them, rather than returning
+// eventstore.ErrStreamDoesNotExist. This suits a stream per aggregate.
+func (s *EventStore) CreateStreamsLazily(match func(streamName string) bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.lazyStreams = match
+}
+
 // Load events from the given stream name.
-func (s EventStore) Load(ctx context.Context, streamName string, from, count uint64, matcher eventstore.MetadataMatcher) eventstore.StreamIterator {
-	stream, ok := s.streams[streamName]
+func (s *EventStore) Load(ctx context.Context, streamName string, from, count uint64, matcher eventstore.MetadataMatcher) eventstore.StreamIterator {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	all, ok := s.eventsOf(streamName)
 
 	if !ok {
 		return &StreamIterator{Error: eventstore.ErrStreamDoesNotExist}
 	}
 
-	total := uint64(len(stream.Events))
+	start := sort.Search(len(all), func(i int) bool {
+		return all[i].Position() > from
+	})
 	events := make([]*messages.Event, 0, count)
 	taken := uint64(0)
 
-	if from < total {
-		for _, e := range stream.Events[from:] {
+	if start < len(all) {
+		for _, e := range all[start:] {
 			if count > 0 && taken == count {
 				break
 			}
 
-			if matcher.MatchEventMetadata(e.Metadata()) {
+			if matcher.MatchEvent(e) {
 				events = append(events, e)
 				taken++
 			}
 		}
 	}
 
-	return &StreamIterator{
-		Events:   events,
-		position: -1,
-	}
+	return s.iterator(events)
 }
 
 // LoadReverse Loads events from the given stream name in reverse.
-func (s EventStore) LoadReverse(ctx context.Context, streamName string, from, count uint64, matcher eventstore.MetadataMatcher) eventstore.StreamIterator {
-	stream, ok := s.streams[streamName]
+func (s *EventStore) LoadReverse(ctx context.Context, streamName string, from, count uint64, matcher eventstore.MetadataMatcher) eventstore.StreamIterator {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	all, ok := s.eventsOf(streamName)
 
 	if !ok {
 		return &StreamIterator{Error: eventstore.ErrStreamDoesNotExist}
 	}
 
-	total := uint64(len(stream.Events))
 	events := make([]*messages.Event, 0, count)
 	skipped := uint64(0)
 	taken := uint64(0)
 
-	if from < total {
-
-		for i := total - 1; i >= 0; i-- {
-			if count > 0 && taken == count {
-				break
-			}
-
-			if matcher.MatchEventMetadata(stream.Events[i].Metadata()) {
-				if skipped > from {
-					events = append(events, stream.Events[i])
-					taken++
-				} else {
-					skipped++
-				}
-			}
+	for i := len(all) - 1; i >= 0; i-- {
+		if count > 0 && taken == count {
+			break
 		}
-	}
 
-	return &StreamIterator{
-		Events:   events,
-		position: -1,
-	}
-}
-
-// FetchStreamNames gets  stream names that match the filter.
-func (s EventStore) FetchStreamNames(ctx context.Context, filter string, matcher eventstore.MetadataMatcher, limit, offset uint64) ([]string, error) {
-	sn := make([]string, 0, limit)
-	i := uint64(0)
-	for k, stream := range s.streams {
-		if !strings.Contains(k, filter) {
+		if !matcher.MatchEvent(all[i]) {
 			continue
 		}
 
-		if !matcher.MatchStreamMetadata(stream.Metadata) {
+		// The from number is how many matching events to skip.
+		if skipped < from {
+			skipped++
 			continue
 		}
 
-		i++
+		events = append(events, all[i])
+		taken++
+	}
 
-		if offset >= i {
-			continue
-		}
+	return s.iterator(events)
+}
 
-		sn = append(sn, k)
+// FetchStreamNames gets  stream names that match the filter.
+func (s *EventStore) FetchStreamNames(ctx context.Context, filter string, matcher eventstore.MetadataMatcher, limit, offset uint64) ([]string, error) {
+	return s.fetchStreamNames(func(name string) bool {
+		return strings.Contains(name, filter)
+	}, matcher, limit, offset), nil
+}
 
-		if limit == i {
-			break
-		}
+// FetchStreamNamesRegex gets stream names that match the regex filter.
+func (s *EventStore) FetchStreamNamesRegex(ctx context.Context, filter string, matcher eventstore.MetadataMatcher, limit, offset uint64) ([]string, error) {
+	rx, err := regexp.Compile(filter)
+	if err != nil {
+		return nil, err
 	}
-	return sn, nil
+
+	return s.fetchStreamNames(rx.MatchString, matcher, limit, offset), nil
 }
 
-// FetchStreamNamesRegex gets stream names that match the regex filter.
-func (s EventStore) FetchStreamNamesRegex(ctx context.Context, filter string, matcher eventstore.MetadataMatcher, limit, offset uint64) ([]string, error) {
-	rx := regexp.MustCompile(filter)
+// Get stream names in order, the limit is ignored when 0.
+func (s *EventStore) fetchStreamNames(filter func(string) bool, matcher eventstore.MetadataMatcher, limit, offset uint64) []string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	all := make([]string, 0, len(s.streams))
+	for k := range s.streams {
+		all = append(all, k)
+	}
+	sort.Strings(all)
+
 	sn := make([]string, 0, limit)
 	i := uint64(0)
-	for k, stream := range s.streams {
-		if !rx.MatchString(k) {
+	for _, k := range all {
+		if !filter(k) || eventstore.IsSoftDeleted(s.streams[k].Metadata) {
 			continue
 		}
 
-		if !matcher.MatchStreamMetadata(stream.Metadata) {
+		if !matcher.MatchStreamMetadata(s.streams[k].Metadata) {
 			continue
 		}
 
@@ -144,16 +200,19 @@ func (s EventStore) FetchStreamNamesRegex(ctx context.Context, filter string, ma
 
 		sn = append(sn, k)
 
-		if limit == i {
+		if limit == uint64(len(sn)) {
 			break
 		}
 	}
-	return sn, nil
+	return sn
 }
 
 // FetchStreamMetadata gets the metadata about a stream.
-func (s EventStore) FetchStreamMetadata(ctx context.Context, streamName string) (eventstore.StreamMetadata, error) {
-	stream, ok := s.streams[streamName]
+func (s *EventStore) FetchStreamMetadata(ctx context.Context, streamName string) (eventstore.StreamMetadata, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	stream, ok := s.stream(streamName)
 	if !ok {
 		return eventstore.StreamMetadata{}, eventstore.ErrStreamDoesNotExist
 	}
@@ -161,51 +220,349 @@ func (s EventStore) FetchStreamMetadata(ctx context.Context, streamName string)
 	return stream.Metadata, nil
 }
 
+// Subscribe delivers the events in the stream after the position given
+// followed by events as they are appended.
+func (s *EventStore) Subscribe(ctx context.Context, streamName string, from uint64, matcher eventstore.MetadataMatcher) (eventstore.Subscription, error) {
+	s.lock.Lock()
+	_, ok := s.eventsOf(streamName)
+	s.lock.Unlock()
+
+	if !ok {
+		return nil, eventstore.ErrStreamDoesNotExist
+	}
+
+	load := func(ctx context.Context, from uint64) eventstore.StreamIterator {
+		return s.Load(ctx, streamName, from, subscriptionBatchSize, matcher)
+	}
+
+	return eventstore.NewSubscription(ctx, from, load, s.appended.Wait), nil
+}
+
 // Create will create the stream with the name and metadata provided.
-func (s EventStore) Create(ctx context.Context, stream *eventstore.Stream) error {
+func (s *EventStore) Create(ctx context.Context, stream *eventstore.Stream) error {
 	s.lock.Lock()
 	defer s.lock.Unlock()
 
-	_, ok := s.streams[stream.Name]
-	if ok {
-		return eventstore.ErrStreamAlreadyExists
+	if stream.Name == eventstore.AllStreamName {
+		return eventstore.ErrStreamNameReserved
+	}
+
+	if err := eventstore.ValidateStreamMetadata(stream.Metadata); err != nil {
+		return err
 	}
 
-	s.streams[stream.Name] = stream
+	if existing, ok := s.streams[stream.Name]; ok {
+		if !eventstore.IsSoftDeleted(existing.Metadata) {
+			return eventstore.ErrStreamAlreadyExists
+		}
+
+		// Soft deleted streams carry on from their last position.
+		existing.Metadata = eventstore.WithTruncation(existing.Metadata, stream.Metadata)
+		positioned := withPositions(stream.Events, lastPosition(existing.Events))
+		existing.Events = append(existing.Events, positioned...)
+		s.appendToAll(existing, positioned)
+		s.appended.Broadcast()
+		return nil
+	}
+
+	created := eventstore.NewStreamWithName(
+		stream.Name,
+		stream.Metadata,
+		withPositions(stream.Events, 0),
+	)
+	s.streams[stream.Name] = created
+	s.appendToAll(created, created.Events)
+	s.appended.Broadcast()
 	return nil
 }
 
 // AppendTo will append events to the stream.
-func (s EventStore) AppendTo(ctx context.Context, streamName string, events []*messages.Event) error {
+func (s *EventStore) AppendTo(ctx context.Context, streamName string, events []*messages.Event) error {
+	return s.AppendToExpecting(ctx, streamName, eventstore.AnyVersion, events)
+}
+
+// AppendToExpecting will append events to the stream if the stream, or
+// aggregate the events belong to, is at the expected version.
+func (s *EventStore) AppendToExpecting(ctx context.Context, streamName string, expected eventstore.ExpectedVersion, events []*messages.Event) error {
+	uow := eventstore.NewUnitOfWork()
+	uow.AppendToExpecting(streamName, expected, events)
+
+	return s.Commit(ctx, uow)
+}
+
+// Commit will make every append in the unit of work or none of them.
+func (s *EventStore) Commit(ctx context.Context, uow *eventstore.UnitOfWork) error {
 	s.lock.Lock()
 	defer s.lock.Unlock()
 
-	stream, ok := s.streams[streamName]
+	appends := uow.Appends()
+
+	// Check every append before making any, including the events
+	// of earlier appends to the same stream. Streams are only created
+	// lazily once every append has been checked.
+	staged := map[string][]*messages.Event{}
+	lazy := map[string]bool{}
+	for _, a := range appends {
+		if a.StreamName == eventstore.AllStreamName {
+			return eventstore.ErrStreamNameReserved
+		}
+
+		events, ok := staged[a.StreamName]
+		if !ok {
+			if stream, exists := s.stream(a.StreamName); exists {
+				events = stream.Events
+			} else if s.lazyStreams != nil && s.lazyStreams(a.StreamName) {
+				// A soft deleted stream carries on from its last position.
+				if deleted, exists := s.streams[a.StreamName]; exists {
+					events = deleted.Events
+				}
+				lazy[a.StreamName] = true
+			} else {
+				return eventstore.ErrStreamDoesNotExist
+			}
+		}
+
+		if a.Expected != eventstore.AnyVersion {
+			aID, _ := eventstore.AggregateIDFromEvents(a.Events)
+			if actual := streamVersion(events, aID); !a.Expected.Matches(actual) {
+				return &eventstore.ErrConcurrencyConflict{
+					StreamName:  a.StreamName,
+					AggregateID: aID,
+					Expected:    a.Expected,
+					Actual:      actual,
+				}
+			}
+		}
+
+		staged[a.StreamName] = append(events[:len(events):len(events)], withPositions(a.Events, lastPosition(events))...)
+	}
+
+	for streamName := range lazy {
+		s.createLazily(streamName)
+	}
+
+	for _, a := range appends {
+		stream := s.streams[a.StreamName]
+		positioned := withPositions(a.Events, lastPosition(stream.Events))
+		stream.Events = append(stream.Events, positioned...)
+		s.appendToAll(stream, positioned)
+	}
+	s.appended.Broadcast()
+
+	return nil
+}
+
+// Truncate will remove the events in the stream before the position given.
+func (s *EventStore) Truncate(ctx context.Context, streamName string, before uint64) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	stream, ok := s.stream(streamName)
 	if !ok {
 		return eventstore.ErrStreamDoesNotExist
 	}
 
-	stream.Events = append(stream.Events, events...)
+	s.truncate(stream, before)
+	return nil
+}
 
+// SoftDelete will truncate every event in the stream and hide the stream.
+func (s *EventStore) SoftDelete(ctx context.Context, streamName string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	stream, ok := s.stream(streamName)
+	if !ok {
+		return eventstore.ErrStreamDoesNotExist
+	}
+
+	s.truncate(stream, lastPosition(stream.Events)+1)
+	stream.Metadata[eventstore.StreamMetaDeleted] = "true"
 	return nil
 }
 
 // Delete will remove the stream.
-func (s EventStore) Delete(ctx context.Context, streamName string) error {
+func (s *EventStore) Delete(ctx context.Context, streamName string) error {
 	s.lock.Lock()
 	defer s.lock.Unlock()
 
+	if _, ok := s.streams[streamName]; !ok {
+		return eventstore.ErrStreamDoesNotExist
+	}
+
 	delete(s.streams, streamName)
 	return nil
 }
 
 // UpdateStreamMetadata sets the metadata for the given stream name.
-func (s EventStore) UpdateStreamMetadata(ctx context.Context, streamName string, newMetadata eventstore.StreamMetadata) error {
-	stream, ok := s.streams[streamName]
+func (s *EventStore) UpdateStreamMetadata(ctx context.Context, streamName string, newMetadata eventstore.StreamMetadata) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	stream, ok := s.stream(streamName)
 	if !ok {
 		return eventstore.ErrStreamDoesNotExist
 	}
 
-	stream.Metadata = newMetadata
+	if err := eventstore.ValidateStreamMetadata(newMetadata); err != nil {
+		return err
+	}
+
+	stream.Metadata = eventstore.WithTruncation(stream.Metadata, newMetadata)
 	return nil
 }
+
+// Iterate over the events once they have been upcast.
+func (s *EventStore) iterator(events []*messages.Event) *StreamIterator {
+	read := uint64(0)
+	if len(events) > 0 {
+		read = events[len(events)-1].Position()
+	}
+
+	if s.upcasters == nil {
+		return &StreamIterator{Events: events, position: -1, read: read}
+	}
+
+	upcast := make([]*messages.Event, 0, len(events))
+	for _, e := range events {
+		out, err := s.upcasters.UpcastEvent(e, s.payloadBuilder)
+		if err != nil {
+			return &StreamIterator{Error: err}
+		}
+		upcast = append(upcast, out...)
+	}
+
+	return &StreamIterator{Events: upcast, position: -1, read: read}
+}
+
+// Get the current version of the stream events, or of the aggregate
+// within the stream if an aggregate ID is given.
+func streamVersion(events []*messages.Event, aggregateID string) uint64 {
+	if aggregateID == "" {
+		return lastPosition(events)
+	}
+
+	version := uint64(0)
+	for _, e := range events {
+		if aID, _ := e.Metadata()[string(messages.MetaAggregateID)].(string); aID != aggregateID {
+			continue
+		}
+
+		if e.Version() > version {
+			version = e.Version()
+		}
+	}
+	return version
+}
+
+// Create an empty stream that is being appended to, a soft deleted
+// stream carries on from its last position.
+func (s *EventStore) createLazily(streamName string) *eventstore.Stream {
+	if existing, ok := s.streams[streamName]; ok {
+		existing.Metadata = eventstore.WithTruncation(existing.Metadata, eventstore.StreamMetadata{})
+		return existing
+	}
+
+	stream := eventstore.EmptyStreamWithName(streamName)
+	s.streams[streamName] = stream
+	return stream
+}
+
+// Get the position of the last event.
+func lastPosition(events []*messages.Event) uint64 {
+	if len(events) == 0 {
+		return 0
+	}
+	return events[len(events)-1].Position()
+}
+
+// Get the stream unless it has been soft deleted.
+func (s *EventStore) stream(streamName string) (*eventstore.Stream, bool) {
+	stream, ok := s.streams[streamName]
+	if !ok || eventstore.IsSoftDeleted(stream.Metadata) {
+		return nil, false
+	}
+	return stream, true
+}
+
+// Remove the events before the position, keeping the latest event of each
+// aggregate and of the stream so versions can still be checked.
+func (s *EventStore) truncate(stream *eventstore.Stream, before uint64) {
+	md := eventstore.StreamMetadata{}
+	for k, v := range stream.Metadata {
+		md[k] = v
+	}
+	md[eventstore.StreamMetaTruncateBefore] = strconv.FormatUint(before, 10)
+	stream.Metadata = eventstore.WithTruncation(stream.Metadata, md)
+
+	// The position may have been moved further forward already.
+	before, _ = strconv.ParseUint(stream.Metadata[eventstore.StreamMetaTruncateBefore], 10, 64)
+
+	latest := map[string]int{}
+	for i, e := range stream.Events {
+		if aID, _ := e.Metadata()[string(messages.MetaAggregateID)].(string); aID != "" {
+			latest[aID] = i
+		}
+	}
+
+	kept := make([]*messages.Event, 0, len(stream.Events))
+	for i, e := range stream.Events {
+		aID, _ := e.Metadata()[string(messages.MetaAggregateID)].(string)
+		if e.Position() >= before || (aID != "" && latest[aID] == i) || i == len(stream.Events)-1 {
+			kept = append(kept, e)
+		}
+	}
+	stream.Events = kept
+
+	all := s.all[:0]
+	for _, e := range s.all {
+		if e.stream != stream || e.position >= before {
+			all = append(all, e)
+		}
+	}
+	s.all = all
+}
+
+// Get the events that can be read from the stream, or every stream in the
+// order they were appended for the all stream.
+func (s *EventStore) eventsOf(streamName string) ([]*messages.Event, bool) {
+	if streamName != eventstore.AllStreamName {
+		stream, ok := s.stream(streamName)
+		if !ok {
+			return nil, false
+		}
+
+		retention, _ := eventstore.RetentionFromMetadata(stream.Metadata)
+		return retention.Visible(stream.Events, time.Now()), true
+	}
+
+	events := make([]*messages.Event, 0, len(s.all))
+	for _, e := range s.all {
+		// Skip events from streams that have since been deleted.
+		if s.streams[e.stream.Name] == e.stream {
+			events = append(events, e.event)
+		}
+	}
+	return events, true
+}
+
+// Record events in the all stream with their global positions.
+func (s *EventStore) appendToAll(stream *eventstore.Stream, events []*messages.Event) {
+	for _, e := range events {
+		s.position++
+		s.all = append(s.all, allStreamEvent{
+			stream:   stream,
+			event:    messages.EventWithPosition(e, s.position),
+			position: e.Position(),
+		})
+	}
+}
+
+// Copy the events giving them positions after the position given.
+func withPositions(events []*messages.Event, after uint64) []*messages.Event {
+	out := make([]*messages.Event, len(events))
+	for i, e := range events {
+		out[i] = messages.EventWithPosition(e, after+uint64(i)+1)
+	}
+	return out
+}
@@ -2,15 +2,31 @@ package inmem_test
 
 import (
 	"context"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/go-cqrses/cqrses/adapters/inmem"
 	"github.com/go-cqrses/cqrses/eventstore"
+	"github.com/go-cqrses/cqrses/eventstore/eventstoretest"
 	"github.com/go-cqrses/cqrses/messages"
 	"github.com/stretchr/testify/assert"
 )
 
+func TestStoreSuite(t *testing.T) {
+	eventstoretest.RunSuite(t, func(t *testing.T) eventstore.EventStore {
+		return inmem.New()
+	})
+}
+
+func TestStoreUpcasting(t *testing.T) {
+	eventstoretest.RunUpcastingSuite(t, func(t *testing.T, upcasters *eventstore.Upcasters) eventstore.EventStore {
+		es := inmem.New()
+		es.SetUpcasters(upcasters)
+		return es
+	})
+}
+
 func TestStore(t *testing.T) {
 	ctx := context.Background()
 	store := inmem.New()
@@ -114,7 +130,7 @@ func TestStore(t *testing.T) {
 
 	{ // Load a stream in reverse.
 		stream := store.LoadReverse(ctx, "todo", 2, 5, eventstore.MetadataMatcher{})
-		expecteds := []string{"ev5", "ev4", "ev3", "ev2", "ev1"}
+		expecteds := []string{"ev6", "ev5", "ev4", "ev3", "ev2"}
 		for i := 0; i < len(expecteds); i++ {
 			if err := stream.Next(ctx); err != nil {
 				t.Fatalf("unable to get next item in stream: %s", err)
@@ -130,3 +146,247 @@ func TestStore(t *testing.T) {
 	}
 
 }
+
+func TestStoreExpectedVersion(t *testing.T) {
+	ctx := context.Background()
+	store := inmem.New()
+
+	if err := store.Create(ctx, eventstore.EmptyStreamWithName("todo")); err != nil {
+		t.Fatalf("unable to create stream: %s", err)
+	}
+
+	aggregateEvent := func(id, aID string, version uint64) *messages.Event {
+		return messages.NewEvent(id, "TodoAdded", map[string]interface{}{}, map[string]interface{}{
+			string(messages.MetaAggregateID):      aID,
+			string(messages.MetaAggregateVersion): version,
+		}, version, time.Now())
+	}
+
+	{ // Appending to a new aggregate expecting no stream.
+		err := store.AppendToExpecting(ctx, "todo", eventstore.NoStream, []*messages.Event{
+			aggregateEvent("ev1", "a", 1),
+			aggregateEvent("ev2", "a", 2),
+		})
+		assert.Nil(t, err)
+	}
+
+	{ // Another aggregate in the same stream has its own version.
+		err := store.AppendToExpecting(ctx, "todo", eventstore.NoStream, []*messages.Event{
+			aggregateEvent("ev3", "b", 1),
+		})
+		assert.Nil(t, err)
+	}
+
+	{ // Appending with a stale version returns a conflict with both versions.
+		err := store.AppendToExpecting(ctx, "todo", eventstore.ExactVersion(1), []*messages.Event{
+			aggregateEvent("ev4", "a", 2),
+		})
+		conflict, ok := err.(*eventstore.ErrConcurrencyConflict)
+		if !ok {
+			t.Fatalf("expected *eventstore.ErrConcurrencyConflict but got: %+v", err)
+		}
+		assert.Equal(t, "a", conflict.AggregateID)
+		assert.Equal(t, eventstore.ExactVersion(1), conflict.Expected)
+		assert.Equal(t, uint64(2), conflict.Actual)
+	}
+
+	{ // Appending with the current version succeeds.
+		err := store.AppendToExpecting(ctx, "todo", eventstore.ExactVersion(2), []*messages.Event{
+			aggregateEvent("ev4", "a", 3),
+		})
+		assert.Nil(t, err)
+	}
+
+	{ // Events without an aggregate are checked against the stream length.
+		err := store.AppendToExpecting(ctx, "todo", eventstore.ExactVersion(3), []*messages.Event{
+			messages.NewEvent("ev5", "TodoAdded", map[string]interface{}{}, map[string]interface{}{}, 0, time.Now()),
+		})
+		assert.IsType(t, &eventstore.ErrConcurrencyConflict{}, err)
+
+		err = store.AppendToExpecting(ctx, "todo", eventstore.ExactVersion(4), []*messages.Event{
+			messages.NewEvent("ev5", "TodoAdded", map[string]interface{}{}, map[string]interface{}{}, 0, time.Now()),
+		})
+		assert.Nil(t, err)
+	}
+
+	{ // Any version never conflicts.
+		err := store.AppendToExpecting(ctx, "todo", eventstore.AnyVersion, []*messages.Event{
+			aggregateEvent("ev6", "a", 4),
+		})
+		assert.Nil(t, err)
+	}
+}
+
+func TestStoreCommitCreatesStreamsLazily(t *testing.T) {
+	ctx := context.Background()
+	store := inmem.New()
+	store.CreateStreamsLazily(func(streamName string) bool {
+		return strings.HasPrefix(streamName, "todo-")
+	})
+
+	added := func(aID string) []*messages.Event {
+		return []*messages.Event{messages.NewAggregateEvent(ctx, aID, 1, "TodoAdded", map[string]interface{}{})}
+	}
+	assert.Nil(t, store.AppendToExpecting(ctx, "todo-b", eventstore.NoStream, added("b")))
+	assert.Nil(t, store.AppendToExpecting(ctx, "todo-c", eventstore.NoStream, added("x")))
+	assert.Nil(t, store.SoftDelete(ctx, "todo-c"))
+
+	// Nothing is created when a later append fails.
+	uow := eventstore.NewUnitOfWork()
+	uow.AppendToExpecting("todo-a", eventstore.NoStream, added("a"))
+	uow.AppendToExpecting("todo-c", eventstore.NoStream, added("c"))
+	uow.AppendToExpecting("todo-b", eventstore.NoStream, added("b"))
+	assert.IsType(t, &eventstore.ErrConcurrencyConflict{}, store.Commit(ctx, uow))
+
+	_, err := store.FetchStreamMetadata(ctx, "todo-a")
+	assert.Equal(t, eventstore.ErrStreamDoesNotExist, err)
+	_, err = store.FetchStreamMetadata(ctx, "todo-c")
+	assert.Equal(t, eventstore.ErrStreamDoesNotExist, err)
+
+	// They are once every append succeeds.
+	uow = eventstore.NewUnitOfWork()
+	uow.AppendToExpecting("todo-a", eventstore.NoStream, added("a"))
+	uow.AppendToExpecting("todo-c", eventstore.NoStream, added("c"))
+	assert.Nil(t, store.Commit(ctx, uow))
+
+	_, err = store.FetchStreamMetadata(ctx, "todo-a")
+	assert.Nil(t, err)
+	_, err = store.FetchStreamMetadata(ctx, "todo-c")
+	assert.Nil(t, err)
+}
+
+func TestStoreSubscribe(t *testing.T) {
+	ctx := context.Background()
+	store := inmem.New()
+
+	if err := store.Create(ctx, eventstore.NewStreamWithName("todo", eventstore.StreamMetadata{}, []*messages.Event{
+		messages.NewEvent("ev1", "TodoAdded", map[string]interface{}{}, map[string]interface{}{}, 0, time.Now()),
+		messages.NewEvent("ev2", "TodoRemoved", map[string]interface{}{}, map[string]interface{}{}, 0, time.Now()),
+	})); err != nil {
+		t.Fatalf("unable to create stream: %s", err)
+	}
+
+	next := func(sub eventstore.Subscription) *messages.Event {
+		select {
+		case e := <-sub.Events():
+			return e
+		case <-time.After(time.Second):
+			t.Fatal("timed out waiting for an event from the subscription")
+			return nil
+		}
+	}
+
+	{ // Subscribing to a stream that does not exist fails.
+		_, err := store.Subscribe(ctx, "na", 0, eventstore.MetadataMatcher{})
+		assert.Equal(t, eventstore.ErrStreamDoesNotExist, err)
+	}
+
+	all, err := store.Subscribe(ctx, "todo", 0, eventstore.MetadataMatcher{})
+	assert.Nil(t, err)
+	defer all.Close()
+
+	later, err := store.Subscribe(ctx, "todo", 2, eventstore.MetadataMatcher{})
+	assert.Nil(t, err)
+	defer later.Close()
+
+	{ // History is delivered first with positions.
+		e := next(all)
+		assert.Equal(t, "ev1", e.MessageID())
+		assert.Equal(t, uint64(1), e.Position())
+		e = next(all)
+		assert.Equal(t, "ev2", e.MessageID())
+		assert.Equal(t, uint64(2), e.Position())
+	}
+
+	err = store.AppendTo(ctx, "todo", []*messages.Event{
+		messages.NewEvent("ev3", "TodoAdded", map[string]interface{}{"live": true}, map[string]interface{}{}, 0, time.Now()),
+	})
+	assert.Nil(t, err)
+
+	{ // Appended events are delivered live.
+		e := next(all)
+		assert.Equal(t, "ev3", e.MessageID())
+		assert.Equal(t, uint64(3), e.Position())
+	}
+
+	{ // Subscribing from a position skips the events before it.
+		e := next(later)
+		assert.Equal(t, "ev3", e.MessageID())
+	}
+
+	{ // Closing the subscription closes the events channel without an error.
+		all.Close()
+		for range all.Events() {
+		}
+		assert.Nil(t, all.Err())
+	}
+
+	{ // Cancelling the context ends the subscription with the context error.
+		cctx, cancel := context.WithCancel(ctx)
+		sub, err := store.Subscribe(cctx, "todo", 3, eventstore.MetadataMatcher{})
+		assert.Nil(t, err)
+		cancel()
+		for range sub.Events() {
+		}
+		assert.Equal(t, context.Canceled, sub.Err())
+	}
+}
+
+func TestStoreAllStream(t *testing.T) {
+	ctx := context.Background()
+	store := inmem.New()
+
+	assert.Equal(t, eventstore.ErrStreamNameReserved, store.Create(ctx, eventstore.EmptyStreamWithName(eventstore.AllStreamName)))
+
+	for _, name := range []string{"todo", "users", "removed"} {
+		if err := store.Create(ctx, eventstore.EmptyStreamWithName(name)); err != nil {
+			t.Fatalf("unable to create stream: %s", err)
+		}
+	}
+
+	appendEvent := func(streamName, id string) {
+		err := store.AppendTo(ctx, streamName, []*messages.Event{
+			messages.NewEvent(id, "Happened", map[string]interface{}{}, map[string]interface{}{"stream": streamName}, 0, time.Now()),
+		})
+		assert.Nil(t, err)
+	}
+
+	appendEvent("todo", "ev1")
+	appendEvent("users", "ev2")
+	appendEvent("removed", "ev3")
+	appendEvent("todo", "ev4")
+	assert.Nil(t, store.Delete(ctx, "removed"))
+
+	read := func(it eventstore.StreamIterator) ([]string, []uint64) {
+		defer it.Close()
+		ids, positions := []string{}, []uint64{}
+		for it.Next(ctx) == nil {
+			ids = append(ids, it.Current().MessageID())
+			positions = append(positions, it.Current().Position())
+		}
+		return ids, positions
+	}
+
+	{ // Every event in every stream in the order appended, skipping deleted streams.
+		ids, positions := read(store.Load(ctx, eventstore.AllStreamName, 0, 0, eventstore.MetadataMatcher{}))
+		assert.Equal(t, []string{"ev1", "ev2", "ev4"}, ids)
+		assert.Equal(t, []uint64{1, 2, 4}, positions)
+	}
+
+	{ // Resuming from a global position.
+		ids, _ := read(store.Load(ctx, eventstore.AllStreamName, 2, 0, eventstore.MetadataMatcher{}))
+		assert.Equal(t, []string{"ev4"}, ids)
+	}
+
+	{ // Matching across streams.
+		ids, _ := read(store.Load(ctx, eventstore.AllStreamName, 0, 0, eventstore.MetadataMatcher{
+			"stream": eventstore.MetadataMatcherCondition{Operation: eventstore.MatchOpEq, Values: []string{"todo"}},
+		}))
+		assert.Equal(t, []string{"ev1", "ev4"}, ids)
+	}
+
+	{ // Positions within a stream are unaffected.
+		_, positions := read(store.Load(ctx, "todo", 0, 0, eventstore.MetadataMatcher{}))
+		assert.Equal(t, []uint64{1, 2}, positions)
+	}
+}
@@ -13,6 +13,9 @@ type (
 		Error    error
 		Events   []*messages.Event
 		position int
+		// The position of the last stored event read, events can
+		// be dropped when they are upcast.
+		read uint64
 	}
 )
 
@@ -46,3 +49,8 @@ func (s *StreamIterator) Close() {
 	s.position = -1
 	s.Events = nil
 }
+
+// ReadPosition returns the position of the last stored event read.
+func (s *StreamIterator) ReadPosition() uint64 {
+	return s.read
+}
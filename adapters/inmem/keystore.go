@@ -0,0 +1,71 @@
+package inmem
+
+import (
+	"context"
+	"sync"
+
+	"github.com/go-cqrses/cqrses/shredding"
+)
+
+type (
+	// KeyStore stores encryption keys in memory.
+	KeyStore struct {
+		// Deleted keys are kept as nil so they are not created again.
+		keys map[string][]byte
+		lock *sync.Mutex
+	}
+)
+
+// NewKeyStore returns a new in memory key store.
+func NewKeyStore() *KeyStore {
+	return &KeyStore{
+		keys: map[string][]byte{},
+		lock: &sync.Mutex{},
+	}
+}
+
+// GetOrCreate will return the key for the subject, creating one if needed.
+func (s *KeyStore) GetOrCreate(ctx context.Context, subjectID string) ([]byte, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if key, ok := s.keys[subjectID]; ok {
+		if key == nil {
+			return nil, shredding.ErrKeyDeleted
+		}
+		return key, nil
+	}
+
+	key, err := shredding.NewKey()
+	if err != nil {
+		return nil, err
+	}
+
+	s.keys[subjectID] = key
+	return key, nil
+}
+
+// Get will return the key for the subject.
+func (s *KeyStore) Get(ctx context.Context, subjectID string) ([]byte, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	key, ok := s.keys[subjectID]
+	if !ok {
+		return nil, shredding.ErrKeyNotFound
+	}
+
+	if key == nil {
+		return nil, shredding.ErrKeyDeleted
+	}
+	return key, nil
+}
+
+// Delete will remove the key for the subject.
+func (s *KeyStore) Delete(ctx context.Context, subjectID string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.keys[subjectID] = nil
+	return nil
+}
@@ -0,0 +1,57 @@
+package inmem
+
+import (
+	"context"
+	"sync"
+
+	"github.com/go-cqrses/cqrses/snapshot"
+)
+
+type (
+	snapshotKey struct {
+		streamName  string
+		aggregateID string
+	}
+
+	// SnapshotStore stores aggregate snapshots in memory.
+	SnapshotStore struct {
+		snapshots map[snapshotKey]*snapshot.Snapshot
+		lock      *sync.Mutex
+	}
+)
+
+// NewSnapshotStore returns a new in memory snapshot store.
+func NewSnapshotStore() *SnapshotStore {
+	return &SnapshotStore{
+		snapshots: map[snapshotKey]*snapshot.Snapshot{},
+		lock:      &sync.Mutex{},
+	}
+}
+
+// Save will store the snapshot, replacing an older snapshot
+// for the same aggregate.
+func (s *SnapshotStore) Save(ctx context.Context, snap *snapshot.Snapshot) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	key := snapshotKey{snap.StreamName, snap.AggregateID}
+	if current, ok := s.snapshots[key]; ok && current.Version > snap.Version {
+		return nil
+	}
+
+	s.snapshots[key] = snap
+	return nil
+}
+
+// Get will return the latest snapshot for the aggregate.
+func (s *SnapshotStore) Get(ctx context.Context, streamName, aggregateID string) (*snapshot.Snapshot, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	snap, ok := s.snapshots[snapshotKey{streamName, aggregateID}]
+	if !ok {
+		return nil, snapshot.ErrSnapshotNotFound
+	}
+
+	return snap, nil
+}
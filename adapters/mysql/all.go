@@ -0,0 +1,258 @@
+package mysql
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+
+	"github.com/go-cqrses/cqrses/eventstore"
+	"github.com/go-cqrses/cqrses/messages"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+const (
+	// MySQL error number for a table that does not exist, a stream
+	// can be deleted while its events are being read.
+	errNoSuchTable = 1146
+)
+
+type (
+	// allStreamIterator iterates over the events of every stream in order
+	// of their global position, using the event_positions table to find
+	// events in each stream table.
+	allStreamIterator struct {
+		db              *sql.DB
+		forward         bool
+		whereConditions string
+		whereBindings   []interface{}
+		batchSize       uint64
+		from            uint64
+		count           uint64
+		builder         *eventBuilder
+
+		buffer   []eventstore.RawEvent
+		built    []*messages.Event
+		current  *messages.Event
+		position uint64
+		read     uint64
+		skipped  uint64
+		taken    uint64
+		started  bool
+		done     bool
+	}
+
+	// A reference to an event in a stream table.
+	eventPosition struct {
+		position  uint64
+		tableName string
+		no        uint64
+	}
+)
+
+func newAllStreamIterator(db *sql.DB, forward bool, batchSize, from, count uint64, matcher eventstore.MetadataMatcher, builder *eventBuilder) (*allStreamIterator, error) {
+	// Stream tables can have different generated columns, only
+	// those every stream table has are used.
+	wc, wb, err := metadataMatcherConditionsToSQL(matcher, defaultMetadataColumns)
+	if err != nil {
+		return nil, err
+	}
+
+	if wc == "" {
+		wc = "1"
+	}
+
+	if batchSize == 0 {
+		batchSize = DefaultBatchSize
+	}
+
+	return &allStreamIterator{
+		db:              db,
+		forward:         forward,
+		whereConditions: wc,
+		whereBindings:   wb,
+		batchSize:       batchSize,
+		from:            from,
+		count:           count,
+		builder:         builder,
+	}, nil
+}
+
+// Current will return the event we currently have.
+func (it *allStreamIterator) Current() *messages.Event {
+	return it.current
+}
+
+// Next will move to the next event in global order.
+func (it *allStreamIterator) Next(ctx context.Context) error {
+	for len(it.built) == 0 {
+		if it.count > 0 && it.taken == it.count {
+			return eventstore.EOF
+		}
+
+		for len(it.buffer) == 0 {
+			if it.done {
+				return eventstore.EOF
+			}
+
+			if err := it.fetch(ctx); err != nil {
+				return err
+			}
+		}
+
+		raw := it.buffer[0]
+		it.buffer = it.buffer[1:]
+		it.read = raw.Position
+		it.taken++
+
+		var err error
+		if it.built, err = it.builder.build(raw); err != nil {
+			return err
+		}
+	}
+
+	it.current = it.built[0]
+	it.built = it.built[1:]
+
+	return nil
+}
+
+// ReadPosition returns the global position of the last event read, events
+// can be dropped when they are upcast.
+func (it *allStreamIterator) ReadPosition() uint64 {
+	return it.read
+}
+
+// Rewind will go back to the first event.
+func (it *allStreamIterator) Rewind() {
+	it.buffer = nil
+	it.built = nil
+	it.current = nil
+	it.position = 0
+	it.read = 0
+	it.skipped = 0
+	it.taken = 0
+	it.started = false
+	it.done = false
+}
+
+// Close will clean up resources.
+func (it *allStreamIterator) Close() {
+	it.buffer = nil
+	it.current = nil
+}
+
+// Fetch the next batch of positions and the events they reference.
+func (it *allStreamIterator) fetch(ctx context.Context) error {
+	positions, err := it.fetchPositions(ctx)
+	if err != nil {
+		return err
+	}
+
+	if uint64(len(positions)) < it.batchSize {
+		it.done = true
+	}
+
+	if len(positions) == 0 {
+		return nil
+	}
+	it.position = positions[len(positions)-1].position
+	it.started = true
+
+	events, err := it.fetchEvents(ctx, positions)
+	if err != nil {
+		return err
+	}
+
+	for _, p := range positions {
+		e, ok := events[p.tableName][p.no]
+		if !ok {
+			// The event did not match, or the stream was deleted.
+			continue
+		}
+
+		// In reverse the from number is how many events to skip.
+		if !it.forward && it.skipped < it.from {
+			it.skipped++
+			continue
+		}
+
+		e.Position = p.position
+		it.buffer = append(it.buffer, e)
+	}
+
+	return nil
+}
+
+func (it *allStreamIterator) fetchPositions(ctx context.Context) ([]eventPosition, error) {
+	var rows *sql.Rows
+	var err error
+
+	switch {
+	case it.forward && !it.started:
+		rows, err = it.db.QueryContext(ctx, "select position, stream_name, no from event_positions where position > ? order by position limit ?", it.from, it.batchSize)
+	case it.forward:
+		rows, err = it.db.QueryContext(ctx, "select position, stream_name, no from event_positions where position > ? order by position limit ?", it.position, it.batchSize)
+	case !it.started:
+		rows, err = it.db.QueryContext(ctx, "select position, stream_name, no from event_positions order by position desc limit ?", it.batchSize)
+	default:
+		rows, err = it.db.QueryContext(ctx, "select position, stream_name, no from event_positions where position < ? order by position desc limit ?", it.position, it.batchSize)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	out := []eventPosition{}
+	for rows.Next() {
+		var p eventPosition
+		if err := rows.Scan(&p.position, &p.tableName, &p.no); err != nil {
+			return nil, err
+		}
+		out = append(out, p)
+	}
+
+	return out, rows.Err()
+}
+
+// Load the referenced events grouped by stream table and number.
+func (it *allStreamIterator) fetchEvents(ctx context.Context, positions []eventPosition) (map[string]map[uint64]eventstore.RawEvent, error) {
+	nos := map[string][]interface{}{}
+	for _, p := range positions {
+		nos[p.tableName] = append(nos[p.tableName], p.no)
+	}
+
+	out := map[string]map[uint64]eventstore.RawEvent{}
+	for tblName, tblNos := range nos {
+		statement := fmt.Sprintf(
+			"select %s from `%s` where `no` in (?%s) and %s",
+			eventColumns,
+			tblName,
+			strings.Repeat(",?", len(tblNos)-1),
+			it.whereConditions,
+		)
+
+		rows, err := it.db.QueryContext(ctx, statement, append(tblNos, it.whereBindings...)...)
+		if mErr, ok := err.(*mysql.MySQLError); ok && mErr.Number == errNoSuchTable {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+
+		events := map[uint64]eventstore.RawEvent{}
+		for rows.Next() {
+			e, err := scanRawEvent(rows)
+			if err != nil {
+				rows.Close()
+				return nil, err
+			}
+			events[e.Position] = e
+		}
+		rows.Close()
+
+		out[tblName] = events
+	}
+
+	return out, nil
+}
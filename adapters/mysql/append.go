@@ -0,0 +1,234 @@
+package mysql
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/go-cqrses/cqrses/eventstore"
+	"github.com/go-cqrses/cqrses/messages"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+const (
+	// MySQL error numbers for a duplicate key and a deadlock, both can
+	// happen when two writers append to the same aggregate at once.
+	errDuplicateEntry = 1062
+	errLockDeadlock   = 1213
+)
+
+type (
+	// queryer is satisfied by both *sql.DB and *sql.Tx.
+	queryer interface {
+		QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+		QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+		ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+	}
+)
+
+// Append the events to the stream table inside the transaction provided,
+// checking the stream or aggregate is at the expected version first.
+func appendTo(ctx context.Context, tx *sql.Tx, streamName, tblName string, expected eventstore.ExpectedVersion, events []*messages.Event) error {
+	if expected != eventstore.AnyVersion {
+		aID, _ := eventstore.AggregateIDFromEvents(events)
+		actual, err := streamVersion(ctx, tx, tblName, aID, true)
+		if err != nil {
+			return err
+		}
+
+		if !expected.Matches(actual) {
+			return &eventstore.ErrConcurrencyConflict{
+				StreamName:  streamName,
+				AggregateID: aID,
+				Expected:    expected,
+				Actual:      actual,
+			}
+		}
+	}
+
+	if len(events) == 0 {
+		return nil
+	}
+
+	values := "(?, ?, ?, ?, ?) "
+	statement := "insert into " + tblName + " (event_id, event_name, payload, metadata, created_at) values " + values
+	if l := len(events); l > 1 {
+		statement += strings.Repeat(", "+values, l-1)
+	}
+
+	bindings := []interface{}{}
+	for _, event := range events {
+		eJ, err := json.Marshal(event.Data())
+		if err != nil {
+			return err
+		}
+
+		eM, err := json.Marshal(event.Metadata())
+		if err != nil {
+			return err
+		}
+
+		bindings = append(
+			bindings,
+			event.MessageID(),
+			event.MessageName(),
+			string(eJ),
+			string(eM),
+			event.Created().UTC().Format(storeTimeFormat),
+		)
+	}
+
+	res, err := tx.ExecContext(ctx, statement, bindings...)
+	if err != nil {
+		return err
+	}
+
+	if ra, err := res.RowsAffected(); err != nil {
+		return err
+	} else if ra != int64(len(events)) {
+		return fmt.Errorf(
+			"events persisted (%d) did not match events given (%d)",
+			ra,
+			len(events),
+		)
+	}
+
+	return recordPositions(ctx, tx, tblName, events)
+}
+
+// Give the events just inserted into the stream table their global positions,
+// the sequence row stays locked until the transaction ends so positions become
+// visible in order.
+func recordPositions(ctx context.Context, tx *sql.Tx, tblName string, events []*messages.Event) error {
+	n := len(events)
+	if _, err := tx.ExecContext(ctx, "update event_sequence set position = last_insert_id(position + ?) where id = 1", n); err != nil {
+		return err
+	}
+
+	var last uint64
+	if err := tx.QueryRowContext(ctx, "select last_insert_id()").Scan(&last); err != nil {
+		return err
+	}
+
+	ids := make([]interface{}, n)
+	for i, e := range events {
+		ids[i] = e.MessageID()
+	}
+
+	_, err := tx.ExecContext(
+		ctx,
+		"insert into event_positions (position, stream_name, no) "+
+			"select ? + row_number() over (order by no), ?, no from `"+tblName+"` "+
+			"where event_id in (?"+strings.Repeat(",?", n-1)+")",
+		append([]interface{}{last - uint64(n), tblName}, ids...)...,
+	)
+	return err
+}
+
+// Get the current version of the stream, or of the aggregate within the
+// stream if an aggregate ID is given. When lock is true the rows read are
+// locked until the transaction ends.
+func streamVersion(ctx context.Context, q queryer, tblName, aggregateID string, lock bool) (uint64, error) {
+	var row *sql.Row
+	var suffix string
+	if lock {
+		suffix = " for update"
+	}
+
+	if aggregateID == "" {
+		row = q.QueryRowContext(ctx, "select coalesce(max(no), 0) from `"+tblName+"`"+suffix)
+	} else {
+		row = q.QueryRowContext(ctx, "select coalesce(max(aggregate_version), 0) from `"+tblName+"` where aggregate_id = ?"+suffix, aggregateID)
+	}
+
+	var version uint64
+	err := row.Scan(&version)
+	return version, err
+}
+
+// A duplicate aggregate version or a deadlock means another writer got there
+// first, in which case we report a concurrency conflict instead.
+func (s *EventStore) conflictFromError(ctx context.Context, err error, streamName, tblName string, expected eventstore.ExpectedVersion, events []*messages.Event) error {
+	mErr, ok := err.(*mysql.MySQLError)
+	if !ok {
+		return err
+	}
+
+	switch {
+	case mErr.Number == errDuplicateEntry && strings.Contains(mErr.Message, "ix_unique_event"):
+	case mErr.Number == errLockDeadlock:
+	default:
+		return err
+	}
+
+	aID, _ := eventstore.AggregateIDFromEvents(events)
+	actual, vErr := streamVersion(ctx, s.db, tblName, aID, false)
+	if vErr != nil {
+		return err
+	}
+
+	return &eventstore.ErrConcurrencyConflict{
+		StreamName:  streamName,
+		AggregateID: aID,
+		Expected:    expected,
+		Actual:      actual,
+	}
+}
+
+// Give every event without a global position one, the sequence row is locked
+// first so no positions are given out at the same time.
+func backfillPositions(ctx context.Context, tx *sql.Tx) (int64, error) {
+	var last uint64
+	if err := tx.QueryRowContext(ctx, "select position from event_sequence where id = 1 for update").Scan(&last); err != nil {
+		return 0, err
+	}
+
+	rows, err := tx.QueryContext(ctx, "select stream_name from event_streams")
+	if err != nil {
+		return 0, err
+	}
+
+	missing := []string{}
+	bindings := []interface{}{last}
+	for rows.Next() {
+		var tblName string
+		if err := rows.Scan(&tblName); err != nil {
+			rows.Close()
+			return 0, err
+		}
+
+		missing = append(missing, "select e.created_at, ? as stream_name, e.no from `"+tblName+"` e "+
+			"where not exists (select 1 from event_positions p where p.stream_name = ? and p.no = e.no)")
+		bindings = append(bindings, tblName, tblName)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	if len(missing) == 0 {
+		return 0, nil
+	}
+
+	res, err := tx.ExecContext(
+		ctx,
+		"insert into event_positions (position, stream_name, no) "+
+			"select ? + row_number() over (order by created_at, stream_name, no), stream_name, no "+
+			"from ("+strings.Join(missing, " union all ")+") missing",
+		bindings...,
+	)
+	if err != nil {
+		return 0, err
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil || n == 0 {
+		return 0, err
+	}
+
+	_, err = tx.ExecContext(ctx, "update event_sequence set position = position + ? where id = 1", n)
+	return n, err
+}
@@ -9,49 +9,89 @@ import (
 )
 
 type (
-	batchHandler func(ctx context.Context, offset, limit uint64) (*sql.Rows, error)
+	// batchHandler loads the next batch of rows. The from number is the one
+	// given to Load and last is the `no` of the last row read, once started.
+	batchHandler func(ctx context.Context, from, last uint64, started bool, limit uint64) (*sql.Rows, error)
 
 	aggregateBatchHandler struct {
 		db              *sql.DB
 		tblName         string
 		whereConditions string
 		whereBindings   []interface{}
-		orderBy         string
-		matcher         eventstore.MetadataMatcher
 	}
 )
 
-func newAggregateBatchHandler(db *sql.DB, tblName string, forward bool, matcher eventstore.MetadataMatcher) batchHandler {
-	wc, wb := metadataMatcherConditionsToSQL(matcher)
+// Batches are found using the primary key rather than an offset, forward
+// the events after the from number are loaded and in reverse the from
+// number is how many matching events to skip. The retention conditions
+// hide events as well as the matcher.
+func newAggregateBatchHandler(db *sql.DB, tblName string, forward bool, matcher eventstore.MetadataMatcher, columns map[string]bool, rc string, rb []interface{}) (batchHandler, error) {
+	wc, wb, err := metadataMatcherConditionsToSQL(matcher, columns)
+	if err != nil {
+		return nil, err
+	}
 
 	if wc == "" {
 		wc = "1"
 	}
 
+	if rc != "" {
+		wc = rc + " and " + wc
+		wb = append(rb[:len(rb):len(rb)], wb...)
+	}
+
 	ah := &aggregateBatchHandler{
 		db:              db,
 		tblName:         tblName,
 		whereConditions: wc,
 		whereBindings:   wb,
-		orderBy:         "`no`",
 	}
 
 	if !forward {
-		ah.orderBy = "`no` DESC"
+		return ah.previous, nil
+	}
+
+	return ah.next, nil
+}
+
+func (b *aggregateBatchHandler) next(ctx context.Context, from, last uint64, started bool, limit uint64) (*sql.Rows, error) {
+	after := from
+	if started {
+		after = last
 	}
 
-	return ah.next
+	statement := fmt.Sprintf(
+		"select %s from `%s` where `no` > ? and %s order by `no` limit %d",
+		eventColumns,
+		b.tblName,
+		b.whereConditions,
+		limit,
+	)
+
+	return b.db.QueryContext(ctx, statement, append([]interface{}{after}, b.whereBindings...)...)
 }
 
-func (b *aggregateBatchHandler) next(ctx context.Context, offset, limit uint64) (*sql.Rows, error) {
+func (b *aggregateBatchHandler) previous(ctx context.Context, from, last uint64, started bool, limit uint64) (*sql.Rows, error) {
+	if !started {
+		statement := fmt.Sprintf(
+			"select %s from `%s` where %s order by `no` desc limit %d,%d",
+			eventColumns,
+			b.tblName,
+			b.whereConditions,
+			from,
+			limit,
+		)
+
+		return b.db.QueryContext(ctx, statement, b.whereBindings...)
+	}
+
 	statement := fmt.Sprintf(
-		"select * from `%s` where %s order by %s limit %d,%d",
+		"select %s from `%s` where `no` < ? and %s order by `no` desc limit %d",
+		eventColumns,
 		b.tblName,
 		b.whereConditions,
-		b.orderBy,
-		offset,
 		limit,
 	)
 
-	return b.db.QueryContext(ctx, statement, b.whereBindings...)
+	return b.db.QueryContext(ctx, statement, append([]interface{}{last}, b.whereBindings...)...)
 }
@@ -2,47 +2,257 @@ package mysql
 
 import (
 	"fmt"
+	"regexp"
 	"strings"
 
 	"github.com/go-cqrses/cqrses/eventstore"
+	"github.com/go-cqrses/cqrses/messages"
+
+	"github.com/pkg/errors"
+)
+
+var (
+	// ErrUnsupportedRegex is returned when a regex metadata matcher uses syntax
+	// Go supports but the MySQL (ICU) regular expression library does not.
+	ErrUnsupportedRegex = errors.New("regular expression is not supported by MySQL")
+
+	// The ungreedy flag is specific to Go.
+	ungreedyFlag = regexp.MustCompile(`\(\?[a-zA-Z]*U`)
+)
+
+type (
+	// field holds the SQL expressions to read a metadata field or event
+	// property, each expression uses the bindings once.
+	field struct {
+		// value is compared for equality.
+		value string
+		// ordered is compared for order when not numeric.
+		ordered string
+		// text is the value as a string, for regular expressions.
+		text string
+		// number is the value as a number, when empty the text is
+		// checked to be a number and cast.
+		number string
+		// exists is true when the field exists.
+		exists   string
+		bindings []interface{}
+		// createdAt is set when the field is the created time, condition
+		// values are times rather than strings.
+		createdAt bool
+	}
+
+	// fieldToSQL returns how to read a metadata field or event property.
+	fieldToSQL func(name string) field
 )
 
-func metadataMatcherConditionsToSQL(conditions eventstore.MetadataMatcher) (string, []interface{}) {
+// A field read from a column.
+func columnField(column string) field {
+	c := fmt.Sprintf("`%s`", column)
+	return field{value: c, ordered: c, text: c, exists: c + " IS NOT NULL"}
+}
+
+// The aggregate version column is a number, it is compared as a string like
+// any other field unless the condition is numeric.
+func aggregateVersionField() field {
+	f := columnField(string(messages.MetaAggregateVersion))
+	f.number = f.value
+	f.ordered = "CAST(" + f.value + " AS CHAR)"
+	f.text = f.ordered
+	return f
+}
+
+// The created time is stored as a DATETIME in UTC, it is matched
+// as text using eventstore.CreatedAtFormat.
+func createdAtField() field {
+	f := columnField("created_at")
+	f.text = "DATE_FORMAT(`created_at`, '%Y-%m-%dT%H:%i:%s.%fZ')"
+	f.createdAt = true
+	return f
+}
+
+// Event metadata fields are matched against the generated column of the stream
+// table for the field when there is one, so its index can be used, otherwise
+// the value is read from the metadata JSON. Event properties are matched
+// against their columns.
+func metadataMatcherConditionsToSQL(conditions eventstore.MetadataMatcher, columns map[string]bool) (string, []interface{}, error) {
+	fromJSON := jsonFieldToSQL("metadata")
+
+	return matcherConditionsToSQL(conditions, func(name string) field {
+		switch {
+		case name == eventstore.PropertyMessageID:
+			return columnField("event_id")
+		case name == eventstore.PropertyMessageName:
+			return columnField("event_name")
+		case name == eventstore.PropertyCreatedAt:
+			return createdAtField()
+		case name == string(messages.MetaAggregateVersion) && columns[name]:
+			return aggregateVersionField()
+		case columns[name]:
+			return columnField(name)
+		}
+		return fromJSON(name)
+	})
+}
+
+// Stream metadata fields are read from the metadata JSON of the event_streams table.
+func streamMetadataMatcherConditionsToSQL(conditions eventstore.MetadataMatcher) (string, []interface{}, error) {
+	return matcherConditionsToSQL(conditions, jsonFieldToSQL("metadata"))
+}
+
+// Read a key from a JSON column, the key is bound as part of the path
+// so it does not need escaping in the statement.
+func jsonFieldToSQL(column string) fieldToSQL {
+	return func(name string) field {
+		v := fmt.Sprintf("JSON_UNQUOTE(JSON_EXTRACT(`%s`, ?))", column)
+		return field{
+			value:    v,
+			ordered:  v,
+			text:     v,
+			exists:   fmt.Sprintf("JSON_CONTAINS_PATH(`%s`, 'one', ?)", column),
+			bindings: []interface{}{jsonPath(name)},
+		}
+	}
+}
+
+// Make a JSON path for a top level key, quoting the key so any
+// characters can be used.
+func jsonPath(key string) string {
+	return `$."` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(key) + `"`
+}
+
+// Conditions match the same way eventstore.MetadataMatcher.MatchEvent does,
+// a condition without the values it needs never matches.
+func matcherConditionsToSQL(conditions eventstore.MetadataMatcher, toSQL fieldToSQL) (string, []interface{}, error) {
 	sql := []string{}
 	bindings := []interface{}{}
 
-	for field, condition := range conditions {
-		var op, val string
-		switch condition.Operation {
-		case eventstore.MatchOpIn:
-			op = "IN"
-			val = "(?" + strings.Repeat(",?", len(condition.Values)-1) + ")"
+	for name, condition := range conditions {
+		c, cb, err := conditionToSQL(toSQL(name), condition)
+		if err != nil {
+			return "", nil, err
+		}
+
+		sql = append(sql, "("+c+")")
+		bindings = append(bindings, cb...)
+	}
+
+	return strings.Join(sql, " AND "), bindings, nil
+}
 
-			vb := make([]interface{}, len(condition.Values))
-			for vi, vv := range condition.Values {
-				vb[vi] = vv
+func conditionToSQL(f field, condition eventstore.MetadataMatcherCondition) (string, []interface{}, error) {
+	switch condition.Operation {
+	case eventstore.MatchOpExists:
+		return f.exists, f.bindings, nil
+	case eventstore.MatchOpNotExists:
+		return "NOT " + f.exists, f.bindings, nil
+	}
+
+	value, ordered := f.value, f.ordered
+	guard, bindings := "", []interface{}{}
+
+	if condition.Numeric {
+		value = f.number
+		if value == "" {
+			// Check the value is a number before casting it,
+			// MySQL casts anything else to 0.
+			guard = f.text + " REGEXP ? AND "
+			bindings = append(bindings, f.bindings...)
+			bindings = append(bindings, eventstore.NumberPattern)
+			value = "CAST(" + f.text + " AS DOUBLE)"
+		}
+		ordered = value
+	}
+	bindings = append(bindings, f.bindings...)
+
+	if condition.Operation == eventstore.MatchOpRegex {
+		if len(condition.Values) != 1 {
+			return "0", nil, nil
+		}
+
+		if err := validateRegex(condition.Values[0]); err != nil {
+			return "", nil, err
+		}
+
+		// Match case sensitively like Go, the pattern is unanchored
+		// and ^ and $ only match at the start and end of the value.
+		return guard + "REGEXP_LIKE(" + f.text + ", ?, 'c')", append(bindings, condition.Values[0]), nil
+	}
+
+	values := conditionValues(f, condition)
+
+	switch condition.Operation {
+	case eventstore.MatchOpIn:
+		if len(values) == 0 {
+			return "0", nil, nil
+		}
+		return guard + value + " IN (?" + strings.Repeat(",?", len(values)-1) + ")", append(bindings, values...), nil
+	case eventstore.MatchOpNotIn:
+		if len(values) == 0 {
+			// Like the other operations the field must exist.
+			return guard + value + " IS NOT NULL", bindings, nil
+		}
+		return guard + value + " NOT IN (?" + strings.Repeat(",?", len(values)-1) + ")", append(bindings, values...), nil
+	case eventstore.MatchOpGt, eventstore.MatchOpGte, eventstore.MatchOpLt, eventstore.MatchOpLte:
+		if len(condition.Values) != 1 || len(values) != 1 {
+			return "0", nil, nil
+		}
+		return guard + ordered + " " + comparisonOperator(condition) + " ?", append(bindings, values...), nil
+	default: // MatchOpEq
+		if len(condition.Values) != 1 || len(values) != 1 {
+			return "0", nil, nil
+		}
+		return guard + value + " = ?", append(bindings, values...), nil
+	}
+}
+
+func comparisonOperator(condition eventstore.MetadataMatcherCondition) string {
+	switch condition.Operation {
+	case eventstore.MatchOpGt:
+		return ">"
+	case eventstore.MatchOpGte:
+		return ">="
+	case eventstore.MatchOpLt:
+		return "<"
+	}
+	return "<="
+}
+
+// Convert the condition values to bindings, numbers for numeric conditions
+// and times for the created time. Values that cannot be converted never
+// match so are removed.
+func conditionValues(f field, condition eventstore.MetadataMatcherCondition) []interface{} {
+	values := make([]interface{}, 0, len(condition.Values))
+	for _, v := range condition.Values {
+		switch {
+		case condition.Numeric:
+			if n, ok := eventstore.ParseNumber(v); ok {
+				values = append(values, n)
 			}
-			bindings = append(bindings, vb...)
-		case eventstore.MatchOpNotIn:
-			op = "NOT IN"
-			val = "(?" + strings.Repeat(",?", len(condition.Values)-1) + ")"
-
-			vb := make([]interface{}, len(condition.Values))
-			for vi, vv := range condition.Values {
-				vb[vi] = vv
+		case f.createdAt:
+			if t, ok := eventstore.ParseCreatedAt(v); ok {
+				values = append(values, t.UTC().Format(storeTimeFormat))
 			}
-			bindings = append(bindings, vb...)
-		case eventstore.MatchOpRegex:
-			op = "REGEX"
-			// todo (bweston92) add support for MySQL REGEX match.
-			panic("todo")
-		case eventstore.MatchOpEq:
-			op = "="
-			val = "?"
-			bindings = append(bindings, condition.Values[0])
+		default:
+			values = append(values, v)
 		}
-		sql = append(sql, fmt.Sprintf("(`%s` %s %s)", field, op, val))
+	}
+	return values
+}
+
+// Make sure a pattern is valid in Go and only uses syntax that
+// behaves the same in MySQL.
+func validateRegex(pattern string) error {
+	if _, err := regexp.Compile(pattern); err != nil {
+		return errors.Wrapf(ErrUnsupportedRegex, "%s", err)
+	}
+
+	if strings.Contains(pattern, "(?P<") {
+		return errors.Wrapf(ErrUnsupportedRegex, "named groups must be written as (?<name>...) in %q", pattern)
+	}
+
+	if ungreedyFlag.MatchString(pattern) {
+		return errors.Wrapf(ErrUnsupportedRegex, "the ungreedy flag is not supported in %q", pattern)
 	}
 
-	return strings.Join(sql, " AND "), bindings
+	return nil
 }
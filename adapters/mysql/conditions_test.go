@@ -5,6 +5,7 @@ import (
 
 	"github.com/go-cqrses/cqrses/eventstore"
 
+	"github.com/pkg/errors"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -16,7 +17,8 @@ func TestMetadataMatcherConditionsToSQLMatchOpIn(t *testing.T) {
 				Values:    []string{"abcd", "def"},
 			},
 		}
-		sql, bindings := metadataMatcherConditionsToSQL(m)
+		sql, bindings, err := metadataMatcherConditionsToSQL(m, map[string]bool{"field1": true})
+		assert.NoError(t, err)
 
 		assert.Contains(t, sql, "field1")
 		assert.Contains(t, sql, "?,?")
@@ -31,7 +33,8 @@ func TestMetadataMatcherConditionsToSQLMatchOpIn(t *testing.T) {
 				Values:    []string{"abcd"},
 			},
 		}
-		sql, bindings := metadataMatcherConditionsToSQL(m)
+		sql, bindings, err := metadataMatcherConditionsToSQL(m, map[string]bool{"field1": true})
+		assert.NoError(t, err)
 
 		assert.Contains(t, sql, "field1")
 		assert.Contains(t, sql, "?")
@@ -48,7 +51,8 @@ func TestMetadataMatcherConditionsToSQLMatchOpNotIn(t *testing.T) {
 				Values:    []string{"abcd", "def"},
 			},
 		}
-		sql, bindings := metadataMatcherConditionsToSQL(m)
+		sql, bindings, err := metadataMatcherConditionsToSQL(m, map[string]bool{"field1": true})
+		assert.NoError(t, err)
 
 		assert.Contains(t, sql, "field1")
 		assert.Contains(t, sql, "?,?")
@@ -63,7 +67,8 @@ func TestMetadataMatcherConditionsToSQLMatchOpNotIn(t *testing.T) {
 				Values:    []string{"abcd"},
 			},
 		}
-		sql, bindings := metadataMatcherConditionsToSQL(m)
+		sql, bindings, err := metadataMatcherConditionsToSQL(m, map[string]bool{"field1": true})
+		assert.NoError(t, err)
 
 		assert.Contains(t, sql, "field1")
 		assert.Contains(t, sql, "?")
@@ -79,9 +84,234 @@ func TestMetadataMatcherConditionsToSQLMatchOpEq(t *testing.T) {
 			Values:    []string{"abcd"},
 		},
 	}
-	sql, bindings := metadataMatcherConditionsToSQL(m)
+	sql, bindings, err := metadataMatcherConditionsToSQL(m, map[string]bool{"field1": true})
+	assert.NoError(t, err)
 
 	assert.Contains(t, sql, "field1")
 	assert.Len(t, bindings, 1)
 	assert.Equal(t, "abcd", bindings[0])
 }
+
+func TestStreamMetadataMatcherConditionsToSQL(t *testing.T) {
+	m := eventstore.MetadataMatcher{
+		`field"1`: eventstore.MetadataMatcherCondition{
+			Operation: eventstore.MatchOpEq,
+			Values:    []string{"abcd"},
+		},
+	}
+	sql, bindings, err := streamMetadataMatcherConditionsToSQL(m)
+	assert.NoError(t, err)
+
+	assert.Equal(t, "(JSON_UNQUOTE(JSON_EXTRACT(`metadata`, ?)) = ?)", sql)
+	assert.Equal(t, []interface{}{`$."field\"1"`, "abcd"}, bindings)
+}
+
+func TestMetadataMatcherConditionsToSQLMatchOpRegex(t *testing.T) {
+	m := eventstore.MetadataMatcher{
+		"field1": eventstore.MetadataMatcherCondition{
+			Operation: eventstore.MatchOpRegex,
+			Values:    []string{"^ab+c$"},
+		},
+	}
+	sql, bindings, err := metadataMatcherConditionsToSQL(m, map[string]bool{"field1": true})
+	assert.NoError(t, err)
+
+	assert.Equal(t, "(REGEXP_LIKE(`field1`, ?, 'c'))", sql)
+	assert.Equal(t, []interface{}{"^ab+c$"}, bindings)
+}
+
+func TestStreamMetadataMatcherConditionsToSQLMatchOpRegex(t *testing.T) {
+	m := eventstore.MetadataMatcher{
+		"field1": eventstore.MetadataMatcherCondition{
+			Operation: eventstore.MatchOpRegex,
+			Values:    []string{"^ab+c$"},
+		},
+	}
+	sql, bindings, err := streamMetadataMatcherConditionsToSQL(m)
+	assert.NoError(t, err)
+
+	assert.Equal(t, "(REGEXP_LIKE(JSON_UNQUOTE(JSON_EXTRACT(`metadata`, ?)), ?, 'c'))", sql)
+	assert.Equal(t, []interface{}{`$."field1"`, "^ab+c$"}, bindings)
+}
+
+func TestStreamMetadataMatcherConditionsToSQLMatchOpIn(t *testing.T) {
+	m := eventstore.MetadataMatcher{
+		"field1": eventstore.MetadataMatcherCondition{
+			Operation: eventstore.MatchOpIn,
+			Values:    []string{"a", "b"},
+		},
+	}
+	sql, bindings, err := streamMetadataMatcherConditionsToSQL(m)
+	assert.NoError(t, err)
+
+	assert.Equal(t, "(JSON_UNQUOTE(JSON_EXTRACT(`metadata`, ?)) IN (?,?))", sql)
+	assert.Equal(t, []interface{}{`$."field1"`, "a", "b"}, bindings)
+}
+
+func TestMetadataMatcherConditionsToSQLUnsupportedRegex(t *testing.T) {
+	for _, pattern := range []string{"(", "(?P<name>a)", "(?U)a+", "(?iU:a+)"} {
+		m := eventstore.MetadataMatcher{
+			"field1": eventstore.MetadataMatcherCondition{
+				Operation: eventstore.MatchOpRegex,
+				Values:    []string{pattern},
+			},
+		}
+		_, _, err := metadataMatcherConditionsToSQL(m, map[string]bool{"field1": true})
+
+		assert.Equal(t, ErrUnsupportedRegex, errors.Cause(err), pattern)
+	}
+}
+
+func TestMetadataMatcherConditionsToSQLWithoutValues(t *testing.T) {
+	cases := []struct {
+		condition eventstore.MetadataMatcherCondition
+		sql       string
+	}{
+		{eventstore.MetadataMatcherCondition{Operation: eventstore.MatchOpEq}, "(0)"},
+		{eventstore.MetadataMatcherCondition{Operation: eventstore.MatchOpIn}, "(0)"},
+		{eventstore.MetadataMatcherCondition{Operation: eventstore.MatchOpRegex}, "(0)"},
+		{eventstore.MetadataMatcherCondition{Operation: eventstore.MatchOpNotIn}, "(`field1` IS NOT NULL)"},
+	}
+
+	for _, c := range cases {
+		sql, bindings, err := metadataMatcherConditionsToSQL(eventstore.MetadataMatcher{"field1": c.condition}, map[string]bool{"field1": true})
+		assert.NoError(t, err)
+
+		assert.Equal(t, c.sql, sql)
+		assert.Empty(t, bindings)
+	}
+}
+
+func TestMetadataMatcherConditionsToSQLWithoutColumn(t *testing.T) {
+	m := eventstore.MetadataMatcher{
+		"correlation_id": eventstore.MetadataMatcherCondition{
+			Operation: eventstore.MatchOpEq,
+			Values:    []string{"abcd"},
+		},
+	}
+	sql, bindings, err := metadataMatcherConditionsToSQL(m, defaultMetadataColumns)
+	assert.NoError(t, err)
+
+	assert.Equal(t, "(JSON_UNQUOTE(JSON_EXTRACT(`metadata`, ?)) = ?)", sql)
+	assert.Equal(t, []interface{}{`$."correlation_id"`, "abcd"}, bindings)
+
+	sql, bindings, err = metadataMatcherConditionsToSQL(eventstore.MetadataMatcher{
+		"aggregate_id": m["correlation_id"],
+	}, defaultMetadataColumns)
+	assert.NoError(t, err)
+
+	assert.Equal(t, "(`aggregate_id` = ?)", sql)
+	assert.Equal(t, []interface{}{"abcd"}, bindings)
+}
+
+func TestMetadataMatcherConditionsToSQLComparisons(t *testing.T) {
+	cases := []struct {
+		name      string
+		condition eventstore.MetadataMatcherCondition
+		sql       string
+		bindings  []interface{}
+	}{
+		{
+			"score",
+			eventstore.MetadataMatcherCondition{Operation: eventstore.MatchOpGt, Values: []string{"b"}},
+			"(JSON_UNQUOTE(JSON_EXTRACT(`metadata`, ?)) > ?)",
+			[]interface{}{`$."score"`, "b"},
+		},
+		{
+			"score",
+			eventstore.MetadataMatcherCondition{Operation: eventstore.MatchOpLte, Values: []string{"1.5"}, Numeric: true},
+			"(JSON_UNQUOTE(JSON_EXTRACT(`metadata`, ?)) REGEXP ? AND CAST(JSON_UNQUOTE(JSON_EXTRACT(`metadata`, ?)) AS DOUBLE) <= ?)",
+			[]interface{}{`$."score"`, eventstore.NumberPattern, `$."score"`, 1.5},
+		},
+		{
+			"score",
+			eventstore.MetadataMatcherCondition{Operation: eventstore.MatchOpGte, Values: []string{"x"}, Numeric: true},
+			"(0)",
+			nil,
+		},
+		{
+			"aggregate_version",
+			eventstore.MetadataMatcherCondition{Operation: eventstore.MatchOpLt, Values: []string{"10"}, Numeric: true},
+			"(`aggregate_version` < ?)",
+			[]interface{}{float64(10)},
+		},
+		{
+			"aggregate_version",
+			eventstore.MetadataMatcherCondition{Operation: eventstore.MatchOpGte, Values: []string{"10"}},
+			"(CAST(`aggregate_version` AS CHAR) >= ?)",
+			[]interface{}{"10"},
+		},
+		{
+			"score",
+			eventstore.MetadataMatcherCondition{Operation: eventstore.MatchOpExists},
+			"(JSON_CONTAINS_PATH(`metadata`, 'one', ?))",
+			[]interface{}{`$."score"`},
+		},
+		{
+			"score",
+			eventstore.MetadataMatcherCondition{Operation: eventstore.MatchOpNotExists},
+			"(NOT JSON_CONTAINS_PATH(`metadata`, 'one', ?))",
+			[]interface{}{`$."score"`},
+		},
+	}
+
+	for _, c := range cases {
+		sql, bindings, err := metadataMatcherConditionsToSQL(eventstore.MetadataMatcher{c.name: c.condition}, defaultMetadataColumns)
+		assert.NoError(t, err)
+
+		assert.Equal(t, c.sql, sql)
+		if c.bindings == nil {
+			assert.Empty(t, bindings)
+		} else {
+			assert.Equal(t, c.bindings, bindings)
+		}
+	}
+}
+
+func TestMetadataMatcherConditionsToSQLEventProperties(t *testing.T) {
+	cases := []struct {
+		name      string
+		condition eventstore.MetadataMatcherCondition
+		sql       string
+		bindings  []interface{}
+	}{
+		{
+			eventstore.PropertyMessageID,
+			eventstore.MetadataMatcherCondition{Operation: eventstore.MatchOpEq, Values: []string{"abcd"}},
+			"(`event_id` = ?)",
+			[]interface{}{"abcd"},
+		},
+		{
+			eventstore.PropertyMessageName,
+			eventstore.MetadataMatcherCondition{Operation: eventstore.MatchOpIn, Values: []string{"a", "b"}},
+			"(`event_name` IN (?,?))",
+			[]interface{}{"a", "b"},
+		},
+		{
+			eventstore.PropertyCreatedAt,
+			eventstore.MetadataMatcherCondition{Operation: eventstore.MatchOpGt, Values: []string{"2020-01-02T05:04:05.5+02:00"}},
+			"(`created_at` > ?)",
+			[]interface{}{"2020-01-02 03:04:05.500000"},
+		},
+		{
+			eventstore.PropertyCreatedAt,
+			eventstore.MetadataMatcherCondition{Operation: eventstore.MatchOpIn, Values: []string{"2020-01-02T03:04:05Z", "never"}},
+			"(`created_at` IN (?))",
+			[]interface{}{"2020-01-02 03:04:05.000000"},
+		},
+		{
+			eventstore.PropertyCreatedAt,
+			eventstore.MetadataMatcherCondition{Operation: eventstore.MatchOpRegex, Values: []string{"^2020"}},
+			"(REGEXP_LIKE(DATE_FORMAT(`created_at`, '%Y-%m-%dT%H:%i:%s.%fZ'), ?, 'c'))",
+			[]interface{}{"^2020"},
+		},
+	}
+
+	for _, c := range cases {
+		sql, bindings, err := metadataMatcherConditionsToSQL(eventstore.MetadataMatcher{c.name: c.condition}, defaultMetadataColumns)
+		assert.NoError(t, err)
+
+		assert.Equal(t, c.sql, sql)
+		assert.Equal(t, c.bindings, bindings)
+	}
+}
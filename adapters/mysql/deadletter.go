@@ -0,0 +1,112 @@
+package mysql
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/go-cqrses/cqrses/deadletter"
+	"github.com/go-cqrses/cqrses/eventstore"
+)
+
+type (
+	// DeadLetterSink stores the events subscribers failed to handle in the
+	// MySQL database used by the event store, events are built using the
+	// payload builder of the event store.
+	DeadLetterSink struct {
+		es *EventStore
+	}
+)
+
+// NewDeadLetterSink will get a dead letter sink that uses the MySQL backend
+// to store letters.
+func NewDeadLetterSink(es *EventStore) deadletter.Sink {
+	return &DeadLetterSink{
+		es: es,
+	}
+}
+
+// Record will store the letter, replacing a letter with the same ID.
+func (s *DeadLetterSink) Record(ctx context.Context, l *deadletter.Letter) error {
+	payload, err := json.Marshal(l.Event.Data())
+	if err != nil {
+		return err
+	}
+
+	metadata, err := json.Marshal(l.Event.Metadata())
+	if err != nil {
+		return err
+	}
+
+	_, err = s.es.db.ExecContext(
+		ctx,
+		"insert into dead_letters (letter_id, subscriber, event_id, event_name, payload, metadata, version, created_at, error, attempts, failed_at) "+
+			"values (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?) "+
+			"on duplicate key update error = values(error), attempts = values(attempts), failed_at = values(failed_at)",
+		l.ID,
+		l.Subscriber,
+		l.Event.MessageID(),
+		l.Event.MessageName(),
+		string(payload),
+		string(metadata),
+		l.Event.Version(),
+		l.Event.Created().UTC().Format(storeTimeFormat),
+		l.Error,
+		l.Attempts,
+		l.Failed.UTC().Format(storeTimeFormat),
+	)
+	return err
+}
+
+// Letters returns up to limit letters for the subscriber, oldest first.
+func (s *DeadLetterSink) Letters(ctx context.Context, subscriber string, limit uint64) ([]*deadletter.Letter, error) {
+	query := "select letter_id, event_id, event_name, payload, metadata, version, created_at, error, attempts, failed_at " +
+		"from dead_letters where subscriber = ? order by no"
+	if limit > 0 {
+		query += fmt.Sprintf(" limit %d", limit)
+	}
+
+	rows, err := s.es.db.QueryContext(ctx, query, subscriber)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	out := []*deadletter.Letter{}
+	for rows.Next() {
+		var metadata, createdAt, failedAt string
+		raw := eventstore.RawEvent{}
+		l := &deadletter.Letter{Subscriber: subscriber}
+
+		if err := rows.Scan(&l.ID, &raw.MessageID, &raw.MessageName, &raw.Payload, &metadata, &raw.Version, &createdAt, &l.Error, &l.Attempts, &failedAt); err != nil {
+			return nil, err
+		}
+
+		if err := json.Unmarshal([]byte(metadata), &raw.Metadata); err != nil {
+			return nil, err
+		}
+
+		if raw.Created, err = time.Parse("2006-01-02 15:04:05", createdAt); err != nil {
+			return nil, err
+		}
+
+		if l.Failed, err = time.Parse("2006-01-02 15:04:05", failedAt); err != nil {
+			return nil, err
+		}
+
+		if l.Event, err = raw.Build(s.es.payloadBuilder); err != nil {
+			return nil, err
+		}
+
+		out = append(out, l)
+	}
+
+	return out, rows.Err()
+}
+
+// Remove will delete the letter.
+func (s *DeadLetterSink) Remove(ctx context.Context, id string) error {
+	_, err := s.es.db.ExecContext(ctx, "delete from dead_letters where letter_id = ?", id)
+	return err
+}
@@ -0,0 +1,98 @@
+package mysql
+
+import (
+	"fmt"
+	"regexp"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// DefaultIndexedMetadataLength is the maximum length of indexed
+	// metadata values when no length is given.
+	DefaultIndexedMetadataLength uint = 150
+)
+
+var (
+	// ErrInvalidIndexedMetadata is returned when creating a stream with
+	// an indexed metadata key that cannot be used as a column.
+	ErrInvalidIndexedMetadata = errors.New("invalid indexed metadata")
+
+	// Keys are used as column names and JSON paths without quoting.
+	indexedMetadataKey = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]{0,63}$`)
+
+	// Columns every stream table already has.
+	reservedColumns = map[string]bool{
+		"no":                true,
+		"event_id":          true,
+		"event_name":        true,
+		"payload":           true,
+		"metadata":          true,
+		"created_at":        true,
+		"aggregate_id":      true,
+		"aggregate_version": true,
+	}
+)
+
+type (
+	// IndexedMetadata is an event metadata key to add an indexed generated
+	// column for when creating a stream, conditions on the key are then
+	// matched using the index rather than reading the metadata JSON.
+	IndexedMetadata struct {
+		// Key of the metadata field, it is used as the column name so may
+		// only contain letters, digits and underscores.
+		Key string
+		// Length is the maximum length of a value, appending an event with
+		// a longer value fails. Defaults to DefaultIndexedMetadataLength.
+		Length uint
+	}
+)
+
+func (i IndexedMetadata) validate() error {
+	if !indexedMetadataKey.MatchString(i.Key) {
+		return errors.Wrapf(ErrInvalidIndexedMetadata, "key %q must only contain letters, digits and underscores", i.Key)
+	}
+
+	if reservedColumns[i.Key] {
+		return errors.Wrapf(ErrInvalidIndexedMetadata, "key %q is already a column", i.Key)
+	}
+
+	return nil
+}
+
+func (i IndexedMetadata) length() uint {
+	if i.Length == 0 {
+		return DefaultIndexedMetadataLength
+	}
+	return i.Length
+}
+
+// The generated column definition for the stream table.
+func (i IndexedMetadata) columnSQL() string {
+	return fmt.Sprintf(
+		"    `%s` VARCHAR(%d) CHARACTER SET utf8mb4 COLLATE utf8mb4_bin GENERATED ALWAYS AS (JSON_UNQUOTE(JSON_EXTRACT(metadata, '$.%s'))) VIRTUAL,",
+		i.Key,
+		i.length(),
+		i.Key,
+	)
+}
+
+// The index definition for the stream table.
+func (i IndexedMetadata) keySQL() string {
+	return fmt.Sprintf(",    KEY `ix_meta_%s` (`%s`)", i.Key, i.Key)
+}
+
+func validateIndexedMetadata(indexes []IndexedMetadata) error {
+	seen := map[string]bool{}
+	for _, i := range indexes {
+		if err := i.validate(); err != nil {
+			return err
+		}
+
+		if seen[i.Key] {
+			return errors.Wrapf(ErrInvalidIndexedMetadata, "key %q is given more than once", i.Key)
+		}
+		seen[i.Key] = true
+	}
+	return nil
+}
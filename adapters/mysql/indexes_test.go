@@ -0,0 +1,33 @@
+package mysql
+
+import (
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIndexedMetadataSQL(t *testing.T) {
+	i := IndexedMetadata{Key: "tenant_id", Length: 36}
+
+	assert.Equal(t, "    `tenant_id` VARCHAR(36) CHARACTER SET utf8mb4 COLLATE utf8mb4_bin GENERATED ALWAYS AS (JSON_UNQUOTE(JSON_EXTRACT(metadata, '$.tenant_id'))) VIRTUAL,", i.columnSQL())
+	assert.Equal(t, ",    KEY `ix_meta_tenant_id` (`tenant_id`)", i.keySQL())
+	assert.Contains(t, IndexedMetadata{Key: "tenant_id"}.columnSQL(), "VARCHAR(150)")
+}
+
+func TestValidateIndexedMetadata(t *testing.T) {
+	assert.NoError(t, validateIndexedMetadata([]IndexedMetadata{{Key: "tenant_id"}, {Key: "correlation_id"}}))
+
+	for _, indexes := range [][]IndexedMetadata{
+		{{Key: ""}},
+		{{Key: "tenant-id"}},
+		{{Key: "1tenant"}},
+		{{Key: "x') VIRTUAL, `y"}},
+		{{Key: "aggregate_id"}},
+		{{Key: "payload"}},
+		{{Key: "tenant_id"}, {Key: "tenant_id"}},
+	} {
+		err := validateIndexedMetadata(indexes)
+		assert.Equal(t, ErrInvalidIndexedMetadata, errors.Cause(err), indexes)
+	}
+}
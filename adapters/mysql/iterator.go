@@ -11,32 +11,53 @@ import (
 )
 
 type (
-	// StreamIterator iterates over events from a MySQL database.
+	// StreamIterator iterates over events from a MySQL database, loading
+	// them in batches as they are needed.
 	StreamIterator struct {
-		rows              *sql.Rows
-		currentItem       *messages.Event
-		batchHandler      batchHandler
-		currentKey        int
-		batchSize         uint64
-		batchPosition     uint64
-		fromNumber        uint64
-		currentFromNumber uint64
-		count             uint64
-		payloadBuilder    messages.PayloadBuilder
+		rows         *sql.Rows
+		currentItem  *messages.Event
+		batchHandler batchHandler
+		batchSize    uint64
+		fromNumber   uint64
+		count        uint64
+		builder      *eventBuilder
+		// Events built from the last row read, upcasting can turn
+		// one row into several events.
+		built []*messages.Event
+
+		// The number of rows asked for and read in the current batch.
+		batchLimit uint64
+		batchRead  uint64
+		// The `no` of the last row read.
+		last    uint64
+		started bool
+		taken   uint64
+		done    bool
+	}
+
+	// eventBuilder builds the events for rows of a stream table.
+	eventBuilder struct {
+		payloadBuilder messages.PayloadBuilder
+		upcasters      *eventstore.Upcasters
 	}
 )
 
-func iter(bh batchHandler, batchSize, fromNumber, count uint64, payloadBuilder messages.PayloadBuilder) *StreamIterator {
+func (b *eventBuilder) build(raw eventstore.RawEvent) ([]*messages.Event, error) {
+	return b.upcasters.Build(raw, b.payloadBuilder)
+}
+
+func iter(bh batchHandler, batchSize, fromNumber, count uint64, builder *eventBuilder) *StreamIterator {
+	if batchSize == 0 {
+		batchSize = DefaultBatchSize
+	}
+
 	return &StreamIterator{
-		currentItem:       nil,
-		currentKey:        -1,
-		batchHandler:      bh,
-		batchSize:         batchSize,
-		batchPosition:     0,
-		fromNumber:        fromNumber,
-		currentFromNumber: fromNumber,
-		count:             count,
-		payloadBuilder:    payloadBuilder,
+		currentItem:  nil,
+		batchHandler: bh,
+		batchSize:    batchSize,
+		fromNumber:   fromNumber,
+		count:        count,
+		builder:      builder,
 	}
 }
 
@@ -49,72 +70,123 @@ func (it *StreamIterator) Current() *messages.Event {
 // Once next has been called without an error returned you can grab
 // the result from Current()
 func (it *StreamIterator) Next(ctx context.Context) error {
-	if it.rows == nil {
-		limit := it.batchSize
-		if it.count > 0 {
-			limit = it.count
+	for {
+		if len(it.built) > 0 {
+			it.currentItem = it.built[0]
+			it.built = it.built[1:]
+			return nil
+		}
+
+		if it.rows == nil {
+			if err := it.nextBatch(ctx); err != nil {
+				return err
+			}
+		}
+
+		if it.rows.Next() {
+			raw, err := scanRawEvent(it.rows)
+			if err != nil {
+				return err
+			}
+
+			it.last = raw.Position
+			it.started = true
+			it.batchRead++
+			it.taken++
+
+			if it.built, err = it.builder.build(raw); err != nil {
+				return err
+			}
+			continue
 		}
-		rows, err := it.batchHandler(ctx, it.fromNumber, limit)
-		if err != nil {
+
+		if err := it.rows.Err(); err != nil {
 			return err
 		}
-		it.rows = rows
+		it.rows.Close()
+		it.rows = nil
+
+		// A short batch means there are no more rows.
+		if it.batchRead < it.batchLimit {
+			it.done = true
+		}
 	}
+}
 
-	if !it.rows.Next() {
+// Load the next batch of rows, at most count rows are loaded in total.
+func (it *StreamIterator) nextBatch(ctx context.Context) error {
+	if it.done || (it.count > 0 && it.taken == it.count) {
 		return eventstore.EOF
 	}
 
-	var no, eventID, eventName, payload, metadata, createdAt, aggregateID string
-	var aggregateVersion uint64
+	limit := it.batchSize
+	if it.count > 0 && it.count-it.taken < limit {
+		limit = it.count - it.taken
+	}
 
-	err := it.rows.Scan(&no, &eventID, &eventName, &payload, &metadata, &createdAt, &aggregateVersion, &aggregateID)
+	rows, err := it.batchHandler(ctx, it.fromNumber, it.last, it.started, limit)
 	if err != nil {
 		return err
 	}
 
-	var jm map[string]interface{}
-	if err := json.Unmarshal([]byte(metadata), &jm); err != nil {
-		return err
+	it.rows = rows
+	it.batchLimit = limit
+	it.batchRead = 0
+
+	return nil
+}
+
+// Scan an event from a row of a stream table.
+func scanRawEvent(rows *sql.Rows) (eventstore.RawEvent, error) {
+	var eventID, eventName, payload, metadata, createdAt, aggregateID string
+	var no, aggregateVersion uint64
+
+	err := rows.Scan(&no, &eventID, &eventName, &payload, &metadata, &createdAt, &aggregateVersion, &aggregateID)
+	if err != nil {
+		return eventstore.RawEvent{}, err
 	}
 
-	var jp interface{}
-	jp, ok := it.payloadBuilder.Build(eventName, []byte(payload))
-	if !ok {
-		var jp2 map[string]interface{}
-		if err := json.Unmarshal([]byte(payload), &jp2); err != nil {
-			return err
-		}
-		jp = jp2
+	var jm map[string]interface{}
+	if err := json.Unmarshal([]byte(metadata), &jm); err != nil {
+		return eventstore.RawEvent{}, err
 	}
 
 	t, err := time.Parse("2006-01-02 15:04:05", createdAt)
 	if err != nil {
-		return err
+		return eventstore.RawEvent{}, err
 	}
 
-	it.currentItem = messages.NewEvent(eventID, eventName, jp, jm, aggregateVersion, t)
+	return eventstore.RawEvent{
+		MessageID:   eventID,
+		MessageName: eventName,
+		Payload:     []byte(payload),
+		Metadata:    jm,
+		Version:     aggregateVersion,
+		Created:     t,
+		Position:    no,
+	}, nil
+}
 
-	return nil
+// ReadPosition returns the `no` of the last row read, events can be dropped
+// when they are upcast.
+func (it *StreamIterator) ReadPosition() uint64 {
+	return it.last
 }
 
 // Rewind will set the position of the stream back to the default
 // position and allow you to iterate of the stream again.
 func (it *StreamIterator) Rewind() {
-	//
-}
-
-// Set current will scan the row.
-func (it *StreamIterator) setCurrent() {
-	e := &messages.Event{}
-	err := it.rows.Scan()
-
-	if err != nil {
-		it.currentItem = nil
-		return
+	if it.rows != nil {
+		it.rows.Close()
 	}
 
-	it.currentItem = e
+	it.rows = nil
+	it.currentItem = nil
+	it.built = nil
+	it.last = 0
+	it.started = false
+	it.taken = 0
+	it.done = false
 }
 
 // Close will clean up resources, do not attempt to use stream
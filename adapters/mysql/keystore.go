@@ -0,0 +1,86 @@
+package mysql
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/go-cqrses/cqrses/shredding"
+)
+
+type (
+	// KeyStore stores encryption keys in the MySQL database
+	// used by the event store.
+	KeyStore struct {
+		es *EventStore
+	}
+)
+
+// NewKeyStore will get a key store that uses the MySQL backend
+// to store encryption keys.
+func NewKeyStore(es *EventStore) shredding.KeyStore {
+	return &KeyStore{
+		es: es,
+	}
+}
+
+// GetOrCreate will return the key for the subject, creating one if needed.
+func (s *KeyStore) GetOrCreate(ctx context.Context, subjectID string) ([]byte, error) {
+	key, err := shredding.NewKey()
+	if err != nil {
+		return nil, err
+	}
+
+	// Another process may create the key first, the key
+	// stored is always the one returned.
+	_, err = s.es.db.ExecContext(
+		ctx,
+		"insert into encryption_keys (subject_id, `key`, created_at) values (?, ?, ?) "+
+			"on duplicate key update subject_id = subject_id",
+		subjectID,
+		key,
+		time.Now().UTC().Format(storeTimeFormat),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.Get(ctx, subjectID)
+}
+
+// Get will return the key for the subject.
+func (s *KeyStore) Get(ctx context.Context, subjectID string) ([]byte, error) {
+	row := s.es.db.QueryRowContext(
+		ctx,
+		"select `key` from encryption_keys where subject_id = ?",
+		subjectID,
+	)
+
+	var key []byte
+	if err := row.Scan(&key); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, shredding.ErrKeyNotFound
+		}
+		return nil, err
+	}
+
+	if key == nil {
+		return nil, shredding.ErrKeyDeleted
+	}
+	return key, nil
+}
+
+// Delete will remove the key for the subject.
+func (s *KeyStore) Delete(ctx context.Context, subjectID string) error {
+	now := time.Now().UTC().Format(storeTimeFormat)
+
+	_, err := s.es.db.ExecContext(
+		ctx,
+		"insert into encryption_keys (subject_id, `key`, created_at, deleted_at) values (?, null, ?, ?) "+
+			"on duplicate key update `key` = null, deleted_at = coalesce(deleted_at, values(deleted_at))",
+		subjectID,
+		now,
+		now,
+	)
+	return err
+}
@@ -0,0 +1,139 @@
+package mysql
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/go-cqrses/cqrses/eventstore"
+	"github.com/go-cqrses/cqrses/messages"
+	"github.com/go-cqrses/cqrses/outbox"
+)
+
+type (
+	// Outbox reads the events written to the outbox of the MySQL event
+	// store, see EventStore.WriteOutbox. Events are built using the payload
+	// builder of the event store.
+	Outbox struct {
+		es *EventStore
+	}
+)
+
+// NewOutbox will get the outbox of the event store.
+func NewOutbox(es *EventStore) *Outbox {
+	return &Outbox{
+		es: es,
+	}
+}
+
+// Write the events appended to the stream to the outbox inside the transaction.
+func writeOutbox(ctx context.Context, tx *sql.Tx, streamName string, events []*messages.Event) error {
+	if len(events) == 0 {
+		return nil
+	}
+
+	values := "(?, ?, ?, ?, ?, ?, ?)"
+	statement := "insert into outbox (stream_name, event_id, event_name, payload, metadata, version, created_at) values " +
+		values + strings.Repeat(", "+values, len(events)-1)
+
+	bindings := []interface{}{}
+	for _, event := range events {
+		eJ, err := json.Marshal(event.Data())
+		if err != nil {
+			return err
+		}
+
+		eM, err := json.Marshal(event.Metadata())
+		if err != nil {
+			return err
+		}
+
+		bindings = append(
+			bindings,
+			streamName,
+			event.MessageID(),
+			event.MessageName(),
+			string(eJ),
+			string(eM),
+			event.Version(),
+			event.Created().UTC().Format(storeTimeFormat),
+		)
+	}
+
+	_, err := tx.ExecContext(ctx, statement, bindings...)
+	return err
+}
+
+// Pending returns up to limit entries that have not been delivered, oldest first.
+func (o *Outbox) Pending(ctx context.Context, limit uint64) ([]*outbox.Entry, error) {
+	query := "select no, stream_name, event_id, event_name, payload, metadata, version, created_at " +
+		"from outbox where delivered_at is null order by no"
+	if limit > 0 {
+		query += fmt.Sprintf(" limit %d", limit)
+	}
+
+	rows, err := o.es.db.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	out := []*outbox.Entry{}
+	for rows.Next() {
+		var metadata, createdAt string
+		raw := eventstore.RawEvent{}
+		e := &outbox.Entry{}
+
+		if err := rows.Scan(&e.ID, &e.StreamName, &raw.MessageID, &raw.MessageName, &raw.Payload, &metadata, &raw.Version, &createdAt); err != nil {
+			return nil, err
+		}
+
+		if err := json.Unmarshal([]byte(metadata), &raw.Metadata); err != nil {
+			return nil, err
+		}
+
+		if raw.Created, err = time.Parse("2006-01-02 15:04:05", createdAt); err != nil {
+			return nil, err
+		}
+
+		if e.Event, err = raw.Build(o.es.payloadBuilder); err != nil {
+			return nil, err
+		}
+
+		out = append(out, e)
+	}
+
+	return out, rows.Err()
+}
+
+// MarkDelivered will stop the entries being returned as pending.
+func (o *Outbox) MarkDelivered(ctx context.Context, ids ...uint64) error {
+	if len(ids) == 0 {
+		return nil
+	}
+
+	bindings := []interface{}{time.Now().UTC().Format(storeTimeFormat)}
+	for _, id := range ids {
+		bindings = append(bindings, id)
+	}
+
+	_, err := o.es.db.ExecContext(
+		ctx,
+		"update outbox set delivered_at = ? where no in (?"+strings.Repeat(",?", len(ids)-1)+")",
+		bindings...,
+	)
+	return err
+}
+
+// Purge deletes the entries delivered before the time given.
+func (o *Outbox) Purge(ctx context.Context, deliveredBefore time.Time) error {
+	_, err := o.es.db.ExecContext(
+		ctx,
+		"delete from outbox where delivered_at < ?",
+		deliveredBefore.UTC().Format(storeTimeFormat),
+	)
+	return err
+}
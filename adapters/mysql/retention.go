@@ -0,0 +1,91 @@
+package mysql
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-cqrses/cqrses/eventstore"
+)
+
+// Get the conditions hiding the events of a stream table that can not be
+// read because of the stream's retention metadata.
+func retentionToSQL(ctx context.Context, q queryer, tblName string, md eventstore.StreamMetadata, now time.Time) (string, []interface{}, error) {
+	r, err := eventstore.RetentionFromMetadata(md)
+	if err != nil || r.IsZero() {
+		return "", nil, err
+	}
+
+	conditions := []string{}
+	bindings := []interface{}{}
+
+	if r.TruncateBefore > 0 {
+		conditions = append(conditions, "`no` >= ?")
+		bindings = append(bindings, r.TruncateBefore)
+	}
+
+	if r.MaxCount > 0 {
+		var first uint64
+		err := q.QueryRowContext(
+			ctx,
+			fmt.Sprintf("select `no` from `%s` order by `no` desc limit %d,1", tblName, r.MaxCount-1),
+		).Scan(&first)
+
+		switch {
+		case err == sql.ErrNoRows:
+			// There are fewer events than the maximum.
+		case err != nil:
+			return "", nil, err
+		default:
+			conditions = append(conditions, "`no` >= ?")
+			bindings = append(bindings, first)
+		}
+	}
+
+	if r.MaxAge > 0 {
+		conditions = append(conditions, "`created_at` >= ?")
+		bindings = append(bindings, now.Add(-r.MaxAge).UTC().Format(storeTimeFormat))
+	}
+
+	return strings.Join(conditions, " and "), bindings, nil
+}
+
+// Delete the events of a stream before the position inside the transaction,
+// keeping the latest event of each aggregate so versions can still be checked.
+// The metadata with the new truncate before position is returned.
+func truncateStream(ctx context.Context, tx *sql.Tx, streamName, tblName string, md eventstore.StreamMetadata, before uint64) (eventstore.StreamMetadata, error) {
+	updated := eventstore.StreamMetadata{}
+	for k, v := range md {
+		updated[k] = v
+	}
+	updated[eventstore.StreamMetaTruncateBefore] = strconv.FormatUint(before, 10)
+	updated = eventstore.WithTruncation(md, updated)
+
+	// The position may have been moved further forward already.
+	before, _ = strconv.ParseUint(updated[eventstore.StreamMetaTruncateBefore], 10, 64)
+
+	if _, err := tx.ExecContext(ctx, "delete from event_positions where stream_name = ? and no < ?", tblName, before); err != nil {
+		return nil, err
+	}
+
+	// Grouping stops MySQL merging the derived table, which it
+	// does not allow when deleting from the same table.
+	_, err := tx.ExecContext(
+		ctx,
+		fmt.Sprintf(
+			"delete e from `%s` e left join (select max(`no`) as `no` from `%s` group by `aggregate_id`) l on l.`no` = e.`no` "+
+				"where e.`no` < ? and l.`no` is null",
+			tblName,
+			tblName,
+		),
+		before,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return updated, writeStreamMetadata(ctx, tx, streamName, updated)
+}
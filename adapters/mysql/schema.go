@@ -6,9 +6,11 @@ import (
 	"database/sql"
 	"encoding/json"
 	"fmt"
+	"math"
 	"strings"
 
 	"github.com/go-cqrses/cqrses/eventstore"
+	"github.com/go-cqrses/cqrses/messages"
 
 	"github.com/go-sql-driver/mysql"
 )
@@ -34,11 +36,19 @@ const (
 		"    `created_at` DATETIME(6) NOT NULL," +
 		"    `aggregate_version` INT(11) UNSIGNED GENERATED ALWAYS AS (JSON_EXTRACT(metadata, '$.aggregate_version')) STORED NOT NULL," +
 		"    `aggregate_id` CHAR(36) CHARACTER SET utf8mb4 COLLATE utf8mb4_bin GENERATED ALWAYS AS (JSON_UNQUOTE(JSON_EXTRACT(metadata, '$.aggregate_id'))) STORED NOT NULL," +
+		"{indexedColumns}" +
 		"    PRIMARY KEY (`no`)," +
 		"    UNIQUE KEY `ix_event_id` (`event_id`)," +
 		"    UNIQUE KEY `ix_unique_event` (`aggregate_id`, `aggregate_version`)" +
+		"{indexedKeys}" +
 		") ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_bin"
 
+	// Soft deleted streams are skipped when fetching stream names.
+	notSoftDeleted = "json_extract(coalesce(`metadata`, '{}'), '$.\"$deleted\"') is null"
+
+	// The columns of a stream table scanned into an event, in order.
+	eventColumns = "`no`, `event_id`, `event_name`, `payload`, `metadata`, `created_at`, `aggregate_version`, `aggregate_id`"
+
 	projectionTable = "" +
 		"CREATE TABLE IF NOT EXISTS `projections` (" +
 		"	`no` BIGINT(20) NOT NULL AUTO_INCREMENT," +
@@ -48,6 +58,88 @@ const (
 		"	PRIMARY KEY (`no`)," +
 		"	UNIQUE KEY `ix_name` (`name`)" +
 		") ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_bin;"
+
+	// The event sequence is a single row holding the last global position
+	// given out, the row is locked while appending so positions are
+	// committed in order.
+	eventSequenceTable = "" +
+		"CREATE TABLE IF NOT EXISTS `event_sequence` (" +
+		"	`id` TINYINT(1) NOT NULL," +
+		"	`position` BIGINT(20) NOT NULL," +
+		"	PRIMARY KEY (`id`)" +
+		") ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_bin;"
+
+	eventSequenceRow = "INSERT IGNORE INTO `event_sequence` (`id`, `position`) VALUES (1, 0);"
+
+	// Event positions references every event in every stream table
+	// by the global position it was given.
+	eventPositionsTable = "" +
+		"CREATE TABLE IF NOT EXISTS `event_positions` (" +
+		"	`position` BIGINT(20) NOT NULL," +
+		"	`stream_name` CHAR(41) NOT NULL," +
+		"	`no` BIGINT(20) NOT NULL," +
+		"	PRIMARY KEY (`position`)," +
+		"	KEY `ix_stream_no` (`stream_name`, `no`)" +
+		") ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_bin;"
+
+	snapshotTable = "" +
+		"CREATE TABLE IF NOT EXISTS `snapshots` (" +
+		"	`stream_name` VARCHAR(150) NOT NULL," +
+		"	`aggregate_id` VARCHAR(150) NOT NULL," +
+		"	`aggregate_version` BIGINT(20) UNSIGNED NOT NULL," +
+		"	`state` LONGBLOB NOT NULL," +
+		"	`created_at` DATETIME(6) NOT NULL," +
+		"	PRIMARY KEY (`stream_name`, `aggregate_id`)" +
+		") ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_bin;"
+
+	// Deleted keys keep their row, with a null key, so a key is
+	// never created again for a forgotten subject.
+	encryptionKeysTable = "" +
+		"CREATE TABLE IF NOT EXISTS `encryption_keys` (" +
+		"	`subject_id` VARCHAR(150) NOT NULL," +
+		"	`key` VARBINARY(32) NULL," +
+		"	`created_at` DATETIME(6) NOT NULL," +
+		"	`deleted_at` DATETIME(6) NULL," +
+		"	PRIMARY KEY (`subject_id`)" +
+		") ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_bin;"
+
+	// Letters are read oldest first using the number they were given
+	// when first recorded.
+	deadLettersTable = "" +
+		"CREATE TABLE IF NOT EXISTS `dead_letters` (" +
+		"	`no` BIGINT(20) NOT NULL AUTO_INCREMENT," +
+		"	`letter_id` CHAR(36) NOT NULL," +
+		"	`subscriber` VARCHAR(150) NOT NULL," +
+		"	`event_id` CHAR(36) NOT NULL," +
+		"	`event_name` VARCHAR(100) NOT NULL," +
+		"	`payload` JSON NOT NULL," +
+		"	`metadata` JSON NOT NULL," +
+		"	`version` BIGINT(20) UNSIGNED NOT NULL," +
+		"	`created_at` DATETIME(6) NOT NULL," +
+		"	`error` TEXT NOT NULL," +
+		"	`attempts` INT NOT NULL," +
+		"	`failed_at` DATETIME(6) NOT NULL," +
+		"	PRIMARY KEY (`no`)," +
+		"	UNIQUE KEY `ix_letter_id` (`letter_id`)," +
+		"	KEY `ix_subscriber` (`subscriber`, `no`)" +
+		") ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_bin;"
+
+	// Outbox rows are written in the same transaction as the events
+	// and kept, with the time they were delivered, until purged.
+	outboxTable = "" +
+		"CREATE TABLE IF NOT EXISTS `outbox` (" +
+		"	`no` BIGINT(20) NOT NULL AUTO_INCREMENT," +
+		"	`stream_name` VARCHAR(150) NOT NULL," +
+		"	`event_id` CHAR(36) NOT NULL," +
+		"	`event_name` VARCHAR(100) NOT NULL," +
+		"	`payload` JSON NOT NULL," +
+		"	`metadata` JSON NOT NULL," +
+		"	`version` BIGINT(20) UNSIGNED NOT NULL," +
+		"	`created_at` DATETIME(6) NOT NULL," +
+		"	`delivered_at` DATETIME(6) NULL," +
+		"	PRIMARY KEY (`no`)," +
+		"	KEY `ix_pending` (`delivered_at`, `no`)" +
+		") ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_bin;"
 )
 
 func applyEventStreamsSchema(ctx context.Context, db *sql.DB) error {
@@ -55,12 +147,49 @@ func applyEventStreamsSchema(ctx context.Context, db *sql.DB) error {
 	return err
 }
 
+func applyEventPositionsSchema(ctx context.Context, db *sql.DB) error {
+	for _, statement := range []string{eventSequenceTable, eventSequenceRow, eventPositionsTable} {
+		if _, err := db.ExecContext(ctx, statement); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func applyProjectionsSchema(ctx context.Context, db *sql.DB) error {
 	_, err := db.ExecContext(ctx, projectionTable)
 	return err
 }
 
-func createStream(ctx context.Context, db *sql.DB, stream *eventstore.Stream) error {
+func applySnapshotsSchema(ctx context.Context, db *sql.DB) error {
+	_, err := db.ExecContext(ctx, snapshotTable)
+	return err
+}
+
+func applyEncryptionKeysSchema(ctx context.Context, db *sql.DB) error {
+	_, err := db.ExecContext(ctx, encryptionKeysTable)
+	return err
+}
+
+func applyDeadLettersSchema(ctx context.Context, db *sql.DB) error {
+	_, err := db.ExecContext(ctx, deadLettersTable)
+	return err
+}
+
+func applyOutboxSchema(ctx context.Context, db *sql.DB) error {
+	_, err := db.ExecContext(ctx, outboxTable)
+	return err
+}
+
+var (
+	// The generated columns every stream table has.
+	defaultMetadataColumns = map[string]bool{
+		string(messages.MetaAggregateID):      true,
+		string(messages.MetaAggregateVersion): true,
+	}
+)
+
+func createStream(ctx context.Context, db *sql.DB, stream *eventstore.Stream, indexes []IndexedMetadata) error {
 	tblName := makeStreamTableName(stream.Name)
 
 	meta, err := json.Marshal(stream.Metadata)
@@ -81,15 +210,73 @@ func createStream(ctx context.Context, db *sql.DB, stream *eventstore.Stream) er
 		return err
 	}
 
-	return createStreamTable(ctx, db, tblName)
+	return createStreamTable(ctx, db, tblName, indexes)
+}
+
+// Create a soft deleted stream again, the table is kept so the stream
+// carries on from its last position.
+func recreateStream(ctx context.Context, db *sql.DB, stream *eventstore.Stream) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	_, current, err := fetchStream(ctx, tx, stream.Name, true)
+	if err == nil && !eventstore.IsSoftDeleted(current) {
+		err = eventstore.ErrStreamAlreadyExists
+	}
+
+	if err == nil {
+		err = writeStreamMetadata(ctx, tx, stream.Name, eventstore.WithTruncation(current, stream.Metadata))
+	}
+
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
 }
 
-func createStreamTable(ctx context.Context, db *sql.DB, name string) error {
-	statement := strings.Replace(eventStreamTable, "{tableName}", name, 1)
+func createStreamTable(ctx context.Context, db *sql.DB, name string, indexes []IndexedMetadata) error {
+	var columns, keys string
+	for _, i := range indexes {
+		columns += i.columnSQL()
+		keys += i.keySQL()
+	}
+
+	statement := strings.NewReplacer(
+		"{tableName}", name,
+		"{indexedColumns}", columns,
+		"{indexedKeys}", keys,
+	).Replace(eventStreamTable)
 	_, err := db.ExecContext(ctx, statement)
 	return err
 }
 
+// Get the names of the generated columns of a stream table.
+func fetchGeneratedColumns(ctx context.Context, db *sql.DB, tblName string) (map[string]bool, error) {
+	rows, err := db.QueryContext(
+		ctx,
+		"select column_name from information_schema.columns where table_schema = database() and table_name = ? and generation_expression <> ''",
+		tblName,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	out := map[string]bool{}
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		out[name] = true
+	}
+
+	return out, rows.Err()
+}
+
 // Create a table name for a stream with the given name.
 // We do this to avoid conflicts.
 func makeStreamTableName(streamName string) string {
@@ -105,3 +292,129 @@ func getStreamTableName(ctx context.Context, db *sql.DB, streamName string) (out
 	}
 	return
 }
+
+// Get the table name and metadata of a stream, when lock is true the row
+// is locked until the transaction ends.
+func fetchStream(ctx context.Context, q queryer, streamName string, lock bool) (string, eventstore.StreamMetadata, error) {
+	statement := "select stream_name, metadata from event_streams where real_stream_name = ?"
+	if lock {
+		statement += " for update"
+	}
+
+	var tblName string
+	var raw sql.NullString
+	if err := q.QueryRowContext(ctx, statement, streamName).Scan(&tblName, &raw); err == sql.ErrNoRows {
+		return "", nil, eventstore.ErrStreamDoesNotExist
+	} else if err != nil {
+		return "", nil, err
+	}
+
+	md := eventstore.StreamMetadata{}
+	if !raw.Valid {
+		return tblName, md, nil
+	}
+
+	return tblName, md, json.Unmarshal([]byte(raw.String), &md)
+}
+
+// Get the table name and metadata of a stream that has not been soft deleted.
+func openStream(ctx context.Context, q queryer, streamName string, lock bool) (string, eventstore.StreamMetadata, error) {
+	tblName, md, err := fetchStream(ctx, q, streamName, lock)
+	if err != nil {
+		return "", nil, err
+	}
+
+	if eventstore.IsSoftDeleted(md) {
+		return "", nil, eventstore.ErrStreamDoesNotExist
+	}
+	return tblName, md, nil
+}
+
+// Get stream names matching the condition and metadata matcher in order,
+// the limit is ignored when 0. Soft deleted streams are skipped.
+func fetchStreamNames(ctx context.Context, db *sql.DB, condition string, binding interface{}, matcher eventstore.MetadataMatcher, limit, offset uint64) ([]string, error) {
+	wc, wb, err := streamMetadataMatcherConditionsToSQL(matcher)
+	if err != nil {
+		return nil, err
+	}
+	if wc == "" {
+		wc = "1"
+	}
+
+	if limit == 0 {
+		limit = math.MaxUint64
+	}
+
+	statement := fmt.Sprintf(
+		"select real_stream_name from event_streams where %s and %s and %s order by real_stream_name limit %d,%d",
+		condition,
+		wc,
+		notSoftDeleted,
+		offset,
+		limit,
+	)
+
+	rows, err := db.QueryContext(ctx, statement, append([]interface{}{binding}, wb...)...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	out := make([]string, 0)
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		out = append(out, name)
+	}
+
+	return out, rows.Err()
+}
+
+func fetchStreamMetadata(ctx context.Context, db *sql.DB, streamName string) (eventstore.StreamMetadata, error) {
+	_, md, err := openStream(ctx, db, streamName, false)
+	if err != nil {
+		return nil, err
+	}
+	return md, nil
+}
+
+// Update the metadata, keeping the truncate before position of the
+// current metadata.
+func updateStreamMetadata(ctx context.Context, db *sql.DB, streamName string, metadata eventstore.StreamMetadata) error {
+	if err := eventstore.ValidateStreamMetadata(metadata); err != nil {
+		return err
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	_, current, err := openStream(ctx, tx, streamName, true)
+	if err == nil {
+		err = writeStreamMetadata(ctx, tx, streamName, eventstore.WithTruncation(current, metadata))
+	}
+
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+func writeStreamMetadata(ctx context.Context, q queryer, streamName string, metadata eventstore.StreamMetadata) error {
+	meta, err := json.Marshal(metadata)
+	if err != nil {
+		return err
+	}
+
+	_, err = q.ExecContext(ctx, "update event_streams set metadata = ? where real_stream_name = ?", string(meta), streamName)
+	return err
+}
+
+// Escape the wildcard characters in a like pattern.
+func escapeLike(in string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(in)
+}
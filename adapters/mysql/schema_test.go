@@ -9,3 +9,7 @@ import (
 func TestMakeStreamTableName(t *testing.T) {
 	assert.Equal(t, "_5B7DCD14A4FAA2CDD54CF6EB8D4BC35DA31914A1", makeStreamTableName("users"))
 }
+
+func TestEscapeLike(t *testing.T) {
+	assert.Equal(t, `users\_100\%\\`, escapeLike(`users_100%\`))
+}
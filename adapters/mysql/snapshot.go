@@ -0,0 +1,75 @@
+package mysql
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/go-cqrses/cqrses/snapshot"
+)
+
+type (
+	// SnapshotStore stores aggregate snapshots in the MySQL database
+	// used by the event store.
+	SnapshotStore struct {
+		es *EventStore
+	}
+)
+
+// NewSnapshotStore will get a snapshot store that uses the MySQL backend
+// to store aggregate snapshots.
+func NewSnapshotStore(es *EventStore) snapshot.SnapshotStore {
+	return &SnapshotStore{
+		es: es,
+	}
+}
+
+// Save will store the snapshot, an older snapshot for the same aggregate
+// is replaced but a newer one is kept.
+func (s *SnapshotStore) Save(ctx context.Context, snap *snapshot.Snapshot) error {
+	_, err := s.es.db.ExecContext(
+		ctx,
+		"insert into snapshots (stream_name, aggregate_id, aggregate_version, state, created_at) values (?, ?, ?, ?, ?) "+
+			"on duplicate key update "+
+			"state = if(values(aggregate_version) > aggregate_version, values(state), state), "+
+			"created_at = if(values(aggregate_version) > aggregate_version, values(created_at), created_at), "+
+			"aggregate_version = greatest(aggregate_version, values(aggregate_version))",
+		snap.StreamName,
+		snap.AggregateID,
+		snap.Version,
+		snap.Data,
+		snap.Created.UTC().Format(storeTimeFormat),
+	)
+	return err
+}
+
+// Get will return the latest snapshot for the aggregate.
+func (s *SnapshotStore) Get(ctx context.Context, streamName, aggregateID string) (*snapshot.Snapshot, error) {
+	row := s.es.db.QueryRowContext(
+		ctx,
+		"select aggregate_version, state, created_at from snapshots where stream_name = ? and aggregate_id = ?",
+		streamName,
+		aggregateID,
+	)
+
+	var createdAt string
+	out := &snapshot.Snapshot{
+		StreamName:  streamName,
+		AggregateID: aggregateID,
+	}
+
+	if err := row.Scan(&out.Version, &out.Data, &createdAt); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, snapshot.ErrSnapshotNotFound
+		}
+		return nil, err
+	}
+
+	t, err := time.Parse("2006-01-02 15:04:05", createdAt)
+	if err != nil {
+		return nil, err
+	}
+	out.Created = t
+
+	return out, nil
+}
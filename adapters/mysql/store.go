@@ -3,9 +3,9 @@ package mysql
 import (
 	"context"
 	"database/sql"
-	"encoding/json"
-	"fmt"
-	"strings"
+	"regexp"
+	"sync"
+	"time"
 
 	"github.com/go-cqrses/cqrses/eventstore"
 	"github.com/go-cqrses/cqrses/messages"
@@ -19,7 +19,12 @@ const (
 	// DefaultBatchSize ...
 	DefaultBatchSize uint64 = 1000
 
-	storeTimeFormat = "2006-01-02T15:04:05"
+	// DefaultPollInterval is how long subscriptions wait before checking
+	// for events appended by other processes.
+	DefaultPollInterval = 200 * time.Millisecond
+
+	// Times are stored in UTC with microseconds, the precision of the columns.
+	storeTimeFormat = "2006-01-02 15:04:05.000000"
 )
 
 type (
@@ -28,6 +33,21 @@ type (
 		db             *sql.DB
 		batchSize      uint64
 		payloadBuilder messages.PayloadBuilder
+		upcasters      *eventstore.Upcasters
+		lazyStreams    func(streamName string) bool
+		outboxStreams  func(streamName string) bool
+		appended       *eventstore.Broadcaster
+
+		// Subscriptions are woken every poll interval by a ticker that
+		// runs while subscriptions are waiting.
+		pollInterval time.Duration
+		poller       *time.Ticker
+		polled       bool
+		pollLock     *sync.Mutex
+
+		// The generated columns of each stream table.
+		columns     map[string]map[string]bool
+		columnsLock *sync.RWMutex
 	}
 )
 
@@ -57,15 +77,45 @@ func New(ctx context.Context, dsn string, batchSize uint64, payloadBuilder messa
 		return nil, err
 	}
 
+	if err := applyEventPositionsSchema(ctx, db); err != nil {
+		db.Close()
+		return nil, err
+	}
+
 	if err := applyProjectionsSchema(ctx, db); err != nil {
 		db.Close()
 		return nil, err
 	}
 
+	if err := applySnapshotsSchema(ctx, db); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	if err := applyEncryptionKeysSchema(ctx, db); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	if err := applyDeadLettersSchema(ctx, db); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	if err := applyOutboxSchema(ctx, db); err != nil {
+		db.Close()
+		return nil, err
+	}
+
 	return &EventStore{
 		db:             db,
 		batchSize:      batchSize,
 		payloadBuilder: payloadBuilder,
+		appended:       eventstore.NewBroadcaster(),
+		pollInterval:   DefaultPollInterval,
+		pollLock:       &sync.Mutex{},
+		columns:        map[string]map[string]bool{},
+		columnsLock:    &sync.RWMutex{},
 	}, nil
 }
 
@@ -74,6 +124,24 @@ func (s *EventStore) Ping(ctx context.Context) error {
 	return s.db.PingContext(ctx)
 }
 
+// SetPollInterval sets how long subscriptions wait before checking for
+// events appended by other processes, events appended using this event
+// store are delivered straight away. DefaultPollInterval is used when the
+// duration is not positive.
+func (s *EventStore) SetPollInterval(d time.Duration) {
+	s.pollLock.Lock()
+	defer s.pollLock.Unlock()
+
+	if d <= 0 {
+		d = DefaultPollInterval
+	}
+
+	s.pollInterval = d
+	if s.poller != nil {
+		s.poller.Reset(d)
+	}
+}
+
 // DB will return the database being used.
 func (s *EventStore) DB() *sql.DB {
 	return s.db
@@ -84,37 +152,151 @@ func (s *EventStore) GetProjectionManager() projection.Manager {
 	return NewProjectionManager(s)
 }
 
+// SetUpcasters sets the upcasters applied to events as they are loaded,
+// before their payloads are built.
+func (s *EventStore) SetUpcasters(upcasters *eventstore.Upcasters) {
+	s.upcasters = upcasters
+}
+
+// CreateStreamsLazily will create the streams with names matching when
+// events are first appended to them, rather than returning
+// eventstore.ErrStreamDoesNotExist. This suits a stream per aggregate.
+func (s *EventStore) CreateStreamsLazily(match func(streamName string) bool) {
+	s.lazyStreams = match
+}
+
+// WriteOutbox will write the events appended to streams the match function
+// returns true for to the outbox, in the same transaction, for an
+// outbox.Relay to publish using NewOutbox.
+func (s *EventStore) WriteOutbox(match func(streamName string) bool) {
+	s.outboxStreams = match
+}
+
+func (s *EventStore) eventBuilder() *eventBuilder {
+	return &eventBuilder{
+		payloadBuilder: s.payloadBuilder,
+		upcasters:      s.upcasters,
+	}
+}
+
 // Load events from the given stream name.
 func (s *EventStore) Load(ctx context.Context, streamName string, from, count uint64, matcher eventstore.MetadataMatcher) eventstore.StreamIterator {
-	tblName, err := getStreamTableName(ctx, s.db, streamName)
-	if err != nil {
-		return &ErrorStreamIterator{err}
-	}
-	return iter(newAggregateBatchHandler(s.db, tblName, true, matcher), s.batchSize, from, count, s.payloadBuilder)
+	return s.load(ctx, streamName, true, from, count, matcher)
 }
 
 // LoadReverse Loads events from the given stream name in reverse.
 func (s *EventStore) LoadReverse(ctx context.Context, streamName string, from, count uint64, matcher eventstore.MetadataMatcher) eventstore.StreamIterator {
-	tblName, err := getStreamTableName(ctx, s.db, streamName)
+	return s.load(ctx, streamName, false, from, count, matcher)
+}
+
+func (s *EventStore) load(ctx context.Context, streamName string, forward bool, from, count uint64, matcher eventstore.MetadataMatcher) eventstore.StreamIterator {
+	if streamName == eventstore.AllStreamName {
+		it, err := newAllStreamIterator(s.db, forward, s.batchSize, from, count, matcher, s.eventBuilder())
+		if err != nil {
+			return &ErrorStreamIterator{err}
+		}
+		return it
+	}
+
+	bh, err := s.batchHandler(ctx, streamName, forward, matcher)
 	if err != nil {
 		return &ErrorStreamIterator{err}
 	}
-	return iter(newAggregateBatchHandler(s.db, tblName, false, matcher), s.batchSize, from, count, s.payloadBuilder)
+	return iter(bh, s.batchSize, from, count, s.eventBuilder())
+}
+
+// Get the batch handler for a stream, hiding events the stream's
+// retention metadata says can not be read.
+func (s *EventStore) batchHandler(ctx context.Context, streamName string, forward bool, matcher eventstore.MetadataMatcher) (batchHandler, error) {
+	tblName, md, err := openStream(ctx, s.db, streamName, false)
+	if err != nil {
+		return nil, err
+	}
+
+	columns, err := s.metadataColumns(ctx, tblName)
+	if err != nil {
+		return nil, err
+	}
+
+	rc, rb, err := retentionToSQL(ctx, s.db, tblName, md, time.Now())
+	if err != nil {
+		return nil, err
+	}
+
+	return newAggregateBatchHandler(s.db, tblName, forward, matcher, columns, rc, rb)
 }
 
 // FetchStreamNames gets  stream names that match the filter.
 func (s *EventStore) FetchStreamNames(ctx context.Context, filter string, matcher eventstore.MetadataMatcher, limit, offset uint64) ([]string, error) {
-	return []string{}, nil
+	return fetchStreamNames(ctx, s.db, "real_stream_name like ?", "%"+escapeLike(filter)+"%", matcher, limit, offset)
 }
 
 // FetchStreamNamesRegex gets stream names that match the regex filter.
 func (s *EventStore) FetchStreamNamesRegex(ctx context.Context, filter string, matcher eventstore.MetadataMatcher, limit, offset uint64) ([]string, error) {
-	return []string{}, nil
+	if _, err := regexp.Compile(filter); err != nil {
+		return nil, err
+	}
+
+	return fetchStreamNames(ctx, s.db, "REGEXP_LIKE(real_stream_name, ?, 'c')", filter, matcher, limit, offset)
 }
 
 // FetchStreamMetadata gets the metadata about a stream.
 func (s *EventStore) FetchStreamMetadata(ctx context.Context, streamName string) (eventstore.StreamMetadata, error) {
-	return nil, eventstore.ErrStreamDoesNotExist
+	return fetchStreamMetadata(ctx, s.db, streamName)
+}
+
+// Subscribe delivers the events in the stream after the position given
+// followed by events as they are appended.
+func (s *EventStore) Subscribe(ctx context.Context, streamName string, from uint64, matcher eventstore.MetadataMatcher) (eventstore.Subscription, error) {
+	// Check the stream and matcher now rather than when the first batch is loaded.
+	if streamName == eventstore.AllStreamName {
+		if _, _, err := metadataMatcherConditionsToSQL(matcher, defaultMetadataColumns); err != nil {
+			return nil, err
+		}
+	} else if _, err := s.batchHandler(ctx, streamName, true, matcher); err != nil {
+		return nil, err
+	}
+
+	// Each batch reads the stream's retention again, so events are hidden
+	// as the retention moves on while subscribed.
+	load := func(ctx context.Context, from uint64) eventstore.StreamIterator {
+		return s.load(ctx, streamName, true, from, s.batchSize, matcher)
+	}
+
+	return eventstore.NewSubscription(ctx, from, load, s.waitForAppend), nil
+}
+
+// Wait until events are appended by this store, or long enough
+// that another process may have appended events.
+func (s *EventStore) waitForAppend() <-chan struct{} {
+	s.pollLock.Lock()
+	defer s.pollLock.Unlock()
+
+	s.polled = true
+	if s.poller == nil {
+		s.poller = time.NewTicker(s.pollInterval)
+		go s.poll(s.poller)
+	}
+
+	return s.appended.Wait()
+}
+
+// Wake the waiting subscriptions on every tick, the ticker is stopped once
+// no subscription waited since the last tick.
+func (s *EventStore) poll(t *time.Ticker) {
+	for range t.C {
+		s.pollLock.Lock()
+		if !s.polled {
+			t.Stop()
+			s.poller = nil
+			s.pollLock.Unlock()
+			return
+		}
+		s.polled = false
+		s.pollLock.Unlock()
+
+		s.appended.Broadcast()
+	}
 }
 
 // Create will create the stream with the name and metadata provided.
@@ -123,11 +305,40 @@ func (s *EventStore) FetchStreamMetadata(ctx context.Context, streamName string)
 // along with inserting rows etc so this could leave the database in
 // a dodgy state.
 func (s *EventStore) Create(ctx context.Context, stream *eventstore.Stream) error {
-	if err := createStream(ctx, s.db, stream); err != nil {
+	return s.CreateWithIndexes(ctx, stream)
+}
+
+// CreateWithIndexes will create the stream like Create, adding an indexed
+// column for each of the event metadata keys given. Loading events matching
+// on these keys uses the index, other keys are matched by reading the
+// metadata of every event.
+func (s *EventStore) CreateWithIndexes(ctx context.Context, stream *eventstore.Stream, indexes ...IndexedMetadata) error {
+	if stream.Name == eventstore.AllStreamName {
+		return eventstore.ErrStreamNameReserved
+	}
+
+	if err := validateIndexedMetadata(indexes); err != nil {
+		return err
+	}
+
+	if err := eventstore.ValidateStreamMetadata(stream.Metadata); err != nil {
+		return err
+	}
+
+	err := createStream(ctx, s.db, stream, indexes)
+	if err == eventstore.ErrStreamAlreadyExists {
+		// Soft deleted streams are created again without new indexes.
+		if err := recreateStream(ctx, s.db, stream); err != nil {
+			return err
+		}
+		return s.AppendTo(ctx, stream.Name, stream.Events)
+	}
+
+	if err != nil {
 		return err
 	}
 
-	err := s.AppendTo(ctx, stream.Name, stream.Events)
+	err = s.AppendTo(ctx, stream.Name, stream.Events)
 	if err != nil {
 		// Hope and prey we can delete cleanly, if the DB has gone then we are done for.
 		s.Delete(ctx, stream.Name)
@@ -137,60 +348,171 @@ func (s *EventStore) Create(ctx context.Context, stream *eventstore.Stream) erro
 
 // AppendTo will append events to the stream.
 func (s *EventStore) AppendTo(ctx context.Context, streamName string, events []*messages.Event) error {
-	if len(events) == 0 {
-		return nil
+	return s.AppendToExpecting(ctx, streamName, eventstore.AnyVersion, events)
+}
+
+// AppendToExpecting will append events to the stream if the stream, or
+// aggregate the events belong to, is at the expected version.
+func (s *EventStore) AppendToExpecting(ctx context.Context, streamName string, expected eventstore.ExpectedVersion, events []*messages.Event) error {
+	if streamName == eventstore.AllStreamName {
+		return eventstore.ErrStreamNameReserved
 	}
-	tblName, err := getStreamTableName(ctx, s.db, streamName)
-	if err != nil {
-		return err
+
+	if len(events) == 0 && expected == eventstore.AnyVersion {
+		return nil
 	}
 
-	values := "(?, ?, ?, ?, ?) "
-	statement := "insert into " + tblName + " (event_id, event_name, payload, metadata, created_at) values " + values
-	if l := len(events); l > 1 {
-		statement += strings.Repeat(", "+values, l-1)
+	uow := eventstore.NewUnitOfWork()
+	uow.AppendToExpecting(streamName, expected, events)
+
+	return s.Commit(ctx, uow)
+}
+
+// Commit will make every append in the unit of work in a single transaction.
+func (s *EventStore) Commit(ctx context.Context, uow *eventstore.UnitOfWork) error {
+	appends := uow.Appends()
+	if len(appends) == 0 {
+		return nil
 	}
 
-	bindings := []interface{}{}
-	for _, event := range events {
-		eJ, err := json.Marshal(event.Data())
-		if err != nil {
-			return err
+	tblNames := make([]string, len(appends))
+	for i, a := range appends {
+		if a.StreamName == eventstore.AllStreamName {
+			return eventstore.ErrStreamNameReserved
 		}
 
-		eM, err := json.Marshal(event.Metadata())
+		tblName, err := s.appendStream(ctx, a.StreamName)
 		if err != nil {
 			return err
 		}
-
-		bindings = append(
-			bindings,
-			event.MessageID(),
-			event.MessageName(),
-			string(eJ),
-			string(eM),
-			event.Created().Format(storeTimeFormat),
-		)
+		tblNames[i] = tblName
 	}
 
-	res, err := s.db.ExecContext(ctx, statement, bindings...)
+	tx, err := s.db.BeginTx(ctx, nil)
 	if err != nil {
 		return err
 	}
 
-	if ra, err := res.RowsAffected(); err != nil {
+	for i, a := range appends {
+		if err := appendTo(ctx, tx, a.StreamName, tblNames[i], a.Expected, a.Events); err != nil {
+			tx.Rollback()
+			return s.conflictFromError(ctx, err, a.StreamName, tblNames[i], a.Expected, a.Events)
+		}
+
+		if s.outboxStreams != nil && s.outboxStreams(a.StreamName) {
+			if err := writeOutbox(ctx, tx, a.StreamName, a.Events); err != nil {
+				tx.Rollback()
+				return err
+			}
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
 		return err
-	} else if ra != int64(len(events)) {
-		return fmt.Errorf(
-			"events persisted (%d) did not match events given (%d)",
-			ra,
-			len(events),
-		)
 	}
 
+	s.appended.Broadcast()
 	return nil
 }
 
+// Get the table name of a stream being appended to, creating
+// the stream first if it is created lazily.
+func (s *EventStore) appendStream(ctx context.Context, streamName string) (string, error) {
+	tblName, _, err := openStream(ctx, s.db, streamName, false)
+	if err != eventstore.ErrStreamDoesNotExist || s.lazyStreams == nil || !s.lazyStreams(streamName) {
+		return tblName, err
+	}
+
+	// Another writer may have created the stream already.
+	if err := s.Create(ctx, eventstore.EmptyStreamWithName(streamName)); err != nil && err != eventstore.ErrStreamAlreadyExists {
+		return "", err
+	}
+
+	tblName, _, err = openStream(ctx, s.db, streamName, false)
+	return tblName, err
+}
+
+// BackfillPositions gives the events stored before global positions were
+// recorded a position, until then they are not read from the $all stream.
+// The events are placed after those that already have a position, ordered
+// by the time they were created, so run it once after upgrading before
+// appending new events. The number of events given a position is returned.
+func (s *EventStore) BackfillPositions(ctx context.Context) (int64, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+
+	n, err := backfillPositions(ctx, tx)
+	if err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+
+	if n > 0 {
+		s.appended.Broadcast()
+	}
+	return n, nil
+}
+
+// Truncate will remove the events in the stream before the position given.
+func (s *EventStore) Truncate(ctx context.Context, streamName string, before uint64) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	tblName, md, err := openStream(ctx, tx, streamName, true)
+	if err == nil {
+		_, err = truncateStream(ctx, tx, streamName, tblName, md, before)
+	}
+
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// SoftDelete will truncate every event in the stream and hide the stream,
+// the stream table is kept until the stream is deleted.
+func (s *EventStore) SoftDelete(ctx context.Context, streamName string) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	if err = softDelete(ctx, tx, streamName); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+func softDelete(ctx context.Context, tx *sql.Tx, streamName string) error {
+	tblName, md, err := openStream(ctx, tx, streamName, true)
+	if err != nil {
+		return err
+	}
+
+	last, err := streamVersion(ctx, tx, tblName, "", true)
+	if err != nil {
+		return err
+	}
+
+	md, err = truncateStream(ctx, tx, streamName, tblName, md, last+1)
+	if err != nil {
+		return err
+	}
+
+	md[eventstore.StreamMetaDeleted] = "true"
+	return writeStreamMetadata(ctx, tx, streamName, md)
+}
+
 // Delete will remove the stream.
 func (s *EventStore) Delete(ctx context.Context, streamName string) error {
 	tblName, err := getStreamTableName(ctx, s.db, streamName)
@@ -202,11 +524,42 @@ func (s *EventStore) Delete(ctx context.Context, streamName string) error {
 		return err
 	}
 
+	s.columnsLock.Lock()
+	delete(s.columns, tblName)
+	s.columnsLock.Unlock()
+
+	if _, err := s.db.ExecContext(ctx, "delete from event_positions where stream_name = ?", tblName); err != nil {
+		return err
+	}
+
 	_, err = s.db.ExecContext(ctx, "delete from event_streams where real_stream_name = ?", streamName)
 	return err
 }
 
 // UpdateStreamMetadata sets the metadata for the given stream name.
 func (s *EventStore) UpdateStreamMetadata(ctx context.Context, streamName string, newMetadata eventstore.StreamMetadata) error {
-	return nil
+	return updateStreamMetadata(ctx, s.db, streamName, newMetadata)
+}
+
+// Get the generated columns of a stream table, they are looked up
+// once as they do not change after the stream is created.
+func (s *EventStore) metadataColumns(ctx context.Context, tblName string) (map[string]bool, error) {
+	s.columnsLock.RLock()
+	columns, ok := s.columns[tblName]
+	s.columnsLock.RUnlock()
+
+	if ok {
+		return columns, nil
+	}
+
+	columns, err := fetchGeneratedColumns(ctx, s.db, tblName)
+	if err != nil {
+		return nil, err
+	}
+
+	s.columnsLock.Lock()
+	s.columns[tblName] = columns
+	s.columnsLock.Unlock()
+
+	return columns, nil
 }
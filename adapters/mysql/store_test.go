@@ -0,0 +1,332 @@
+package mysql
+
+import (
+	"context"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-cqrses/cqrses/deadletter"
+	"github.com/go-cqrses/cqrses/eventstore"
+	"github.com/go-cqrses/cqrses/eventstore/eventstoretest"
+	"github.com/go-cqrses/cqrses/messages"
+	"github.com/go-cqrses/cqrses/outbox"
+	"github.com/go-cqrses/cqrses/shredding"
+
+	"github.com/gofrs/uuid"
+	"github.com/stretchr/testify/assert"
+)
+
+// The suite needs a MySQL database, set CQRSES_MYSQL_DSN to run it,
+// for example "root:abcd@tcp(localhost:3306)/events_test".
+func TestEventStoreSuite(t *testing.T) {
+	es := testEventStore(t, DefaultBatchSize)
+
+	eventstoretest.RunSuite(t, func(t *testing.T) eventstore.EventStore {
+		return es
+	})
+}
+
+// Reading streams over many batches.
+func TestEventStoreSuiteSmallBatches(t *testing.T) {
+	es := testEventStore(t, 7)
+
+	eventstoretest.RunSuite(t, func(t *testing.T) eventstore.EventStore {
+		return es
+	})
+}
+
+func TestEventStoreUpcasting(t *testing.T) {
+	eventstoretest.RunUpcastingSuite(t, func(t *testing.T, upcasters *eventstore.Upcasters) eventstore.EventStore {
+		es := testEventStore(t, DefaultBatchSize)
+		es.SetUpcasters(upcasters)
+		return es
+	})
+}
+
+func TestEventStoreCreateWithIndexes(t *testing.T) {
+	es := testEventStore(t, DefaultBatchSize)
+	ctx := context.Background()
+	name := "indexed-" + uuid.Must(uuid.NewV4()).String()[:8]
+
+	err := es.CreateWithIndexes(ctx, eventstore.EmptyStreamWithName(name), IndexedMetadata{Key: "tenant"})
+	assert.Nil(t, err)
+	defer es.Delete(ctx, name)
+
+	tblName, err := getStreamTableName(ctx, es.db, name)
+	assert.Nil(t, err)
+
+	columns, err := es.metadataColumns(ctx, tblName)
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]bool{"aggregate_id": true, "aggregate_version": true, "tenant": true}, columns)
+
+	aID := uuid.Must(uuid.NewV4()).String()
+	assert.Nil(t, es.AppendTo(ctx, name, []*messages.Event{
+		messages.NewEvent(uuid.Must(uuid.NewV4()).String(), "created", map[string]interface{}{}, map[string]interface{}{
+			"aggregate_id":      aID,
+			"aggregate_version": 1,
+			"tenant":            "acme",
+		}, 1, time.Now()),
+	}))
+
+	it := es.Load(ctx, name, 0, 0, eventstore.MetadataMatcher{
+		"tenant": eventstore.MetadataMatcherCondition{Operation: eventstore.MatchOpEq, Values: []string{"acme"}},
+	})
+	defer it.Close()
+
+	assert.Nil(t, it.Next(ctx))
+	assert.Equal(t, "created", it.Current().MessageName())
+	assert.Equal(t, eventstore.EOF, it.Next(ctx))
+}
+
+// An event store connected to the database in CQRSES_MYSQL_DSN, the
+// test is skipped when it is not set.
+func testEventStore(t *testing.T, batchSize uint64) *EventStore {
+	dsn := os.Getenv("CQRSES_MYSQL_DSN")
+	if dsn == "" {
+		t.Skip("CQRSES_MYSQL_DSN is not set")
+	}
+
+	es, err := New(context.Background(), dsn, batchSize, messages.NewJSONMessageFactory())
+	if err != nil {
+		t.Fatalf("unable to connect to database: %s", err)
+	}
+	return es
+}
+
+func TestKeyStore(t *testing.T) {
+	ctx := context.Background()
+	keys := NewKeyStore(testEventStore(t, DefaultBatchSize))
+	subjectID := uuid.Must(uuid.NewV4()).String()
+
+	_, err := keys.Get(ctx, subjectID)
+	assert.Equal(t, shredding.ErrKeyNotFound, err)
+
+	key, err := keys.GetOrCreate(ctx, subjectID)
+	assert.Nil(t, err)
+	assert.Len(t, key, shredding.KeySize)
+
+	again, err := keys.GetOrCreate(ctx, subjectID)
+	assert.Nil(t, err)
+	assert.Equal(t, key, again)
+
+	assert.Nil(t, keys.Delete(ctx, subjectID))
+
+	_, err = keys.Get(ctx, subjectID)
+	assert.Equal(t, shredding.ErrKeyDeleted, err)
+
+	_, err = keys.GetOrCreate(ctx, subjectID)
+	assert.Equal(t, shredding.ErrKeyDeleted, err)
+}
+
+func TestDeadLetterSink(t *testing.T) {
+	ctx := context.Background()
+	sink := NewDeadLetterSink(testEventStore(t, DefaultBatchSize))
+	subscriber := "test-" + uuid.Must(uuid.NewV4()).String()
+
+	letters := []*deadletter.Letter{}
+	for i := 0; i < 2; i++ {
+		e := messages.NewAggregateEvent(ctx, uuid.Must(uuid.NewV4()).String(), 1, "created", map[string]interface{}{"n": "v"})
+		l := &deadletter.Letter{
+			ID:         uuid.Must(uuid.NewV4()).String(),
+			Subscriber: subscriber,
+			Event:      e,
+			Error:      "failed",
+			Attempts:   1,
+			Failed:     time.Now(),
+		}
+		assert.Nil(t, sink.Record(ctx, l))
+		letters = append(letters, l)
+	}
+
+	letters[0].Attempts = 3
+	assert.Nil(t, sink.Record(ctx, letters[0]))
+
+	got, err := sink.Letters(ctx, subscriber, 0)
+	assert.Nil(t, err)
+	if assert.Len(t, got, 2) {
+		assert.Equal(t, letters[0].ID, got[0].ID)
+		assert.Equal(t, 3, got[0].Attempts)
+		assert.Equal(t, letters[0].Event.MessageID(), got[0].Event.MessageID())
+		assert.Equal(t, map[string]interface{}{"n": "v"}, got[0].Event.Data())
+	}
+
+	assert.Nil(t, sink.Remove(ctx, letters[0].ID))
+	got, err = sink.Letters(ctx, subscriber, 1)
+	assert.Nil(t, err)
+	if assert.Len(t, got, 1) {
+		assert.Equal(t, letters[1].ID, got[0].ID)
+	}
+	assert.Nil(t, sink.Remove(ctx, letters[1].ID))
+}
+
+func TestOutbox(t *testing.T) {
+	ctx := context.Background()
+	es := testEventStore(t, DefaultBatchSize)
+	box := NewOutbox(es)
+	streamName := "outbox-" + uuid.Must(uuid.NewV4()).String()[:8]
+	es.WriteOutbox(func(name string) bool {
+		return name == streamName
+	})
+
+	assert.Nil(t, es.Create(ctx, eventstore.EmptyStreamWithName(streamName)))
+	defer es.Delete(ctx, streamName)
+
+	// Deliver anything left by earlier runs.
+	relay := outbox.NewRelay(box, outbox.PublisherFunc(func(context.Context, *outbox.Entry) error { return nil }), 0, time.Millisecond)
+	_, err := relay.RunOnce(ctx)
+	assert.Nil(t, err)
+
+	aID := uuid.Must(uuid.NewV4()).String()
+	assert.Nil(t, es.AppendTo(ctx, streamName, []*messages.Event{
+		messages.NewAggregateEvent(ctx, aID, 1, "created", map[string]interface{}{"n": "v"}),
+		messages.NewAggregateEvent(ctx, aID, 2, "updated", map[string]interface{}{"n": "w"}),
+	}))
+
+	// A failed append writes nothing to the outbox.
+	err = es.AppendToExpecting(ctx, streamName, eventstore.ExactVersion(0), []*messages.Event{
+		messages.NewAggregateEvent(ctx, aID, 1, "created", map[string]interface{}{}),
+	})
+	assert.IsType(t, &eventstore.ErrConcurrencyConflict{}, err)
+
+	pending, err := box.Pending(ctx, 0)
+	assert.Nil(t, err)
+	if assert.Len(t, pending, 2) {
+		assert.Equal(t, streamName, pending[0].StreamName)
+		assert.Equal(t, "created", pending[0].Event.MessageName())
+		assert.Equal(t, map[string]interface{}{"n": "w"}, pending[1].Event.Data())
+	}
+
+	n, err := relay.RunOnce(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, n)
+
+	pending, err = box.Pending(ctx, 0)
+	assert.Nil(t, err)
+	assert.Empty(t, pending)
+	assert.Nil(t, box.Purge(ctx, time.Now().Add(time.Minute)))
+}
+
+func TestEventStoreCreateStreamsLazily(t *testing.T) {
+	es := testEventStore(t, DefaultBatchSize)
+	ctx := context.Background()
+	prefix := "lazy-" + uuid.Must(uuid.NewV4()).String()[:8]
+	es.CreateStreamsLazily(func(streamName string) bool {
+		return strings.HasPrefix(streamName, prefix)
+	})
+
+	aID := uuid.Must(uuid.NewV4()).String()
+	name := prefix + "-" + aID
+	defer es.Delete(ctx, name)
+
+	event := messages.NewAggregateEvent(ctx, aID, 1, "created", map[string]interface{}{})
+	assert.Nil(t, es.AppendToExpecting(ctx, name, eventstore.NoStream, []*messages.Event{event}))
+
+	it := es.Load(ctx, name, 0, 0, eventstore.MetadataMatcher{})
+	defer it.Close()
+	assert.Nil(t, it.Next(ctx))
+	assert.Equal(t, "created", it.Current().MessageName())
+
+	// Other streams are not created.
+	assert.Equal(t, eventstore.ErrStreamDoesNotExist, es.AppendTo(ctx, "other-"+aID, []*messages.Event{event}))
+}
+
+func TestEventStoreBackfillPositions(t *testing.T) {
+	es := testEventStore(t, DefaultBatchSize)
+	ctx := context.Background()
+	name := "backfill-" + uuid.Must(uuid.NewV4()).String()[:8]
+
+	assert.Nil(t, es.Create(ctx, eventstore.EmptyStreamWithName(name)))
+	defer es.Delete(ctx, name)
+
+	aID := uuid.Must(uuid.NewV4()).String()
+	assert.Nil(t, es.AppendTo(ctx, name, []*messages.Event{
+		messages.NewAggregateEvent(ctx, aID, 1, "created", map[string]interface{}{}),
+		messages.NewAggregateEvent(ctx, aID, 2, "updated", map[string]interface{}{}),
+	}))
+
+	matcher := eventstore.MetadataMatcher{
+		"aggregate_id": eventstore.MetadataMatcherCondition{
+			Operation: eventstore.MatchOpEq,
+			Values:    []string{aID},
+		},
+	}
+	names := func() []string {
+		it := es.Load(ctx, eventstore.AllStreamName, 0, 0, matcher)
+		defer it.Close()
+
+		out := []string{}
+		for it.Next(ctx) == nil {
+			out = append(out, it.Current().MessageName())
+		}
+		return out
+	}
+
+	// Events stored before positions were recorded are not read.
+	tblName, err := getStreamTableName(ctx, es.db, name)
+	assert.Nil(t, err)
+	_, err = es.db.ExecContext(ctx, "delete from event_positions where stream_name = ?", tblName)
+	assert.Nil(t, err)
+	assert.Empty(t, names())
+
+	n, err := es.BackfillPositions(ctx)
+	assert.Nil(t, err)
+	assert.True(t, n >= 2)
+	assert.Equal(t, []string{"created", "updated"}, names())
+
+	n, err = es.BackfillPositions(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(0), n)
+}
+
+func TestEventStoreSetPollInterval(t *testing.T) {
+	es := &EventStore{appended: eventstore.NewBroadcaster(), pollLock: &sync.Mutex{}}
+
+	// Durations that would stop the ticker are not used.
+	for _, d := range []time.Duration{0, -time.Second} {
+		es.SetPollInterval(d)
+		assert.Equal(t, DefaultPollInterval, es.pollInterval)
+	}
+
+	es.waitForAppend()
+	es.SetPollInterval(time.Millisecond)
+	assert.Equal(t, time.Millisecond, es.pollInterval)
+	es.SetPollInterval(0)
+	assert.Equal(t, DefaultPollInterval, es.pollInterval)
+}
+
+func TestEventStoreSubscribeRetention(t *testing.T) {
+	es := testEventStore(t, DefaultBatchSize)
+	es.SetPollInterval(10 * time.Millisecond)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	name := "retention-" + uuid.Must(uuid.NewV4()).String()[:8]
+
+	assert.Nil(t, es.Create(ctx, eventstore.EmptyStreamWithName(name)))
+	defer es.Delete(ctx, name)
+
+	sub, err := es.Subscribe(ctx, name, 0, eventstore.MetadataMatcher{})
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer sub.Close()
+
+	// Retention set after subscribing hides events.
+	assert.Nil(t, es.UpdateStreamMetadata(ctx, name, eventstore.StreamMetadata{eventstore.StreamMetaMaxCount: "1"}))
+	aID := uuid.Must(uuid.NewV4()).String()
+	assert.Nil(t, es.AppendTo(ctx, name, []*messages.Event{
+		messages.NewAggregateEvent(ctx, aID, 1, "created", map[string]interface{}{}),
+		messages.NewAggregateEvent(ctx, aID, 2, "updated", map[string]interface{}{}),
+	}))
+
+	select {
+	case e := <-sub.Events():
+		if assert.NotNil(t, e, "subscription ended: %v", sub.Err()) {
+			assert.Equal(t, "updated", e.MessageName())
+		}
+	case <-ctx.Done():
+		t.Fatal("timed out waiting for an event from the subscription")
+	}
+}
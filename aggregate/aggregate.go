@@ -3,11 +3,22 @@ package aggregate
 import (
 	"context"
 	"errors"
+	"strconv"
 	"sync"
+	"time"
 
 	"github.com/go-cqrses/cqrses/esbridge"
 	"github.com/go-cqrses/cqrses/eventstore"
 	"github.com/go-cqrses/cqrses/messages"
+	"github.com/go-cqrses/cqrses/snapshot"
+)
+
+var (
+	// ErrHistoryTruncated is returned when events of the aggregate are
+	// hidden by the retention of the stream, such as $maxCount, $maxAge or
+	// Truncate. Aggregates in these streams must be loaded from a snapshot
+	// taken after the hidden events.
+	ErrHistoryTruncated = errors.New("aggregate history is hidden by stream retention")
 )
 
 type (
@@ -33,6 +44,8 @@ type (
 		state State
 		// A lock used to ensure no race conditions within the instance.
 		lock *sync.Mutex
+		// Options the aggregate was loaded with.
+		opts *Opts
 	}
 
 	// EventRecorder will record aggregate events.
@@ -43,9 +56,28 @@ type (
 		Handle(context.Context, messages.Message, EventRecorder) error
 		Apply(*messages.Event) error
 	}
+
+	// Snapshotter can be implemented by a State to allow it to be stored in
+	// and restored from a snapshot, see WithSnapshots.
+	Snapshotter interface {
+		// Snapshot serialises the current state.
+		Snapshot() ([]byte, error)
+		// Restore replaces the current state with the serialised state.
+		Restore([]byte) error
+	}
 )
 
-func Make(af StateFactory, streamName string) func(ctx context.Context, msg messages.Message) error {
+// Make returns a command handler that loads the aggregate the command is for,
+// lets the state handle the command and persists the recorded events. The
+// stream name is the aggregate type given to the stream strategy, by default
+// events are stored in the stream with that name.
+//
+// When WithRetry is given and the events conflict with events recorded for the
+// same aggregate by someone else, the aggregate is reloaded into a new state
+// and the command is handled again.
+func Make(af StateFactory, streamName string, opts ...Opt) func(ctx context.Context, msg messages.Message) error {
+	o := buildOptions(opts)
+
 	return func(ctx context.Context, msg messages.Message) error {
 		cmd, ok := msg.Data().(Command)
 		if !ok {
@@ -53,74 +85,127 @@ func Make(af StateFactory, streamName string) func(ctx context.Context, msg mess
 		}
 
 		es := esbridge.MustGetEventStoreFromContext(ctx)
-		ag := af()
-		history, err := Load(ctx, cmd.AggregateID(), es, streamName, ag)
 
-		if err != nil {
+		return retry(ctx, o, func() error {
+			return handle(ctx, es, cmd.AggregateID(), streamName, af(), msg, opts)
+		})
+	}
+}
+
+// Call fn again while it returns a concurrency conflict, up to the retries
+// in the options.
+func retry(ctx context.Context, o *Opts, fn func() error) error {
+	for attempt := 1; ; attempt++ {
+		err := fn()
+
+		var conflict *eventstore.ErrConcurrencyConflict
+		if err == nil || !errors.As(err, &conflict) || attempt > o.Retries {
 			return err
 		}
 
-		if err := history.Handle(ctx, msg); err != nil {
-			return err
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(o.Backoff(attempt)):
 		}
+	}
+}
+
+func handle(ctx context.Context, es eventstore.EventStore, aID, streamName string, state State, msg messages.Message, opts []Opt) error {
+	history, err := Load(ctx, aID, es, streamName, state, opts...)
+	if err != nil {
+		return err
+	}
 
-		return history.Close(ctx)
+	if err := history.Handle(ctx, msg); err != nil {
+		return err
 	}
+
+	return history.Close(ctx)
 }
 
 // New should be used when intiailising an aggregate.
-func New(aID string, store eventstore.EventStore, streamName string, state State) *Aggregate {
+func New(aID string, store eventstore.EventStore, streamName string, state State, opts ...Opt) *Aggregate {
+	o := buildOptions(opts)
+
 	return &Aggregate{
 		aggregateID: aID,
 		store:       store,
-		streamName:  streamName,
+		streamName:  o.Streams.StreamName(streamName, aID),
 		pending:     []*messages.Event{},
 		version:     0,
 		state:       state,
 		lock:        &sync.Mutex{},
+		opts:        o,
 	}
 }
 
 // Load will get an aggregates Aggregate, reconstitue the aggregate using the
 // event handler provided and then returning the Aggregate to allow adding more events.
-func Load(ctx context.Context, aID string, store eventstore.EventStore, streamName string, state State) (*Aggregate, error) {
-	a := &Aggregate{
-		aggregateID: aID,
-		store:       store,
-		streamName:  streamName,
-		pending:     []*messages.Event{},
-		version:     0,
-		state:       state,
-		lock:        &sync.Mutex{},
+//
+// When WithSnapshots is given and the state is a Snapshotter, the state is
+// restored from the latest snapshot and only later events are replayed.
+func Load(ctx context.Context, aID string, store eventstore.EventStore, streamName string, state State, opts ...Opt) (*Aggregate, error) {
+	a := New(aID, store, streamName, state, opts...)
+
+	if err := a.restoreSnapshot(ctx); err != nil {
+		return nil, err
 	}
 
-	events := store.Load(ctx, streamName, 0, 0, eventstore.MetadataMatcher{
-		"aggregate_id": eventstore.MetadataMatcherCondition{
-			Operation: eventstore.MatchOpEq,
-			Values:    []string{aID},
-		},
-	})
+	// Only load the events after the snapshot.
+	events := store.Load(ctx, a.streamName, 0, 0, a.eventsAfter(a.version))
 	defer events.Close()
 
-	for {
+	for first := true; ; first = false {
 		if err := events.Next(ctx); err != nil {
 			if err == eventstore.EOF {
 				break
 			}
 
+			// The stream of a new aggregate is created on Close.
+			if err == eventstore.ErrStreamDoesNotExist && a.opts.Streams.PerAggregate() {
+				break
+			}
+
 			return nil, err
 		}
 
+		// Upcasters can drop or split events, so later versions can repeat
+		// or skip, only a gap before the first event can be retention.
 		event := events.Current()
+		if first && event.Version() > a.version+1 {
+			if hidden, err := a.retained(ctx); err != nil {
+				return nil, err
+			} else if hidden {
+				return nil, ErrHistoryTruncated
+			}
+		}
+
 		if err := a.state.Apply(event); err != nil {
 			return nil, err
 		}
-		a.version = event.Version()
+		if event.Version() > a.version {
+			a.version = event.Version()
+		}
 	}
 
 	return a, nil
 }
 
+// AggregateID returns the ID of the aggregate.
+func (h *Aggregate) AggregateID() string {
+	return h.aggregateID
+}
+
+// Version returns the version of the aggregate including recorded events that
+// are not yet persisted.
+func (h *Aggregate) Version() uint64 {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	return h.version
+}
+
 // Handle will execute the callback with the message and persist any events.
 func (h *Aggregate) Handle(ctx context.Context, msg messages.Message) error {
 	h.lock.Lock()
@@ -141,13 +226,28 @@ func (h *Aggregate) RecordThat(ctx context.Context, eventName string, data inter
 
 func (h *Aggregate) record(ctx context.Context, eventName string, data interface{}) error {
 	h.version++
-	event := messages.NewAggregateEvent(ctx, h.aggregateID, h.version, eventName, data)
+	event := messages.NewEventFromContext(
+		ctx,
+		h.opts.NewID(),
+		eventName,
+		data,
+		map[string]interface{}{
+			string(messages.MetaAggregateID):      h.aggregateID,
+			string(messages.MetaAggregateVersion): h.version,
+		},
+		h.version,
+		h.opts.Clock(),
+	)
 	h.pending = append(h.pending, event)
 	return h.state.Apply(event)
 }
 
 // Close will persist any pending events, returning an error if anything failed,
 // if an error is returned all pending events will be missing still.
+//
+// The events are only persisted if no other events have been recorded for the
+// aggregate since it was loaded, otherwise an *eventstore.ErrConcurrencyConflict
+// is returned.
 func (h *Aggregate) Close(ctx context.Context) error {
 	h.lock.Lock()
 	defer func() {
@@ -155,5 +255,160 @@ func (h *Aggregate) Close(ctx context.Context) error {
 		h.lock.Unlock()
 	}()
 
-	return h.store.AppendTo(ctx, h.streamName, h.pending)
+	if len(h.pending) == 0 {
+		return nil
+	}
+
+	loadedVersion := h.version - uint64(len(h.pending))
+	expected := eventstore.ExactVersion(loadedVersion)
+	err := h.store.AppendToExpecting(ctx, h.streamName, expected, h.pending)
+	if err == eventstore.ErrStreamDoesNotExist && h.opts.Streams.PerAggregate() {
+		err = h.createStream(ctx, expected)
+	}
+
+	var conflict *eventstore.ErrConcurrencyConflict
+	if errors.As(err, &conflict) && h.historyHidden(ctx, loadedVersion) {
+		return ErrHistoryTruncated
+	}
+
+	if err != nil {
+		return err
+	}
+
+	if every := h.opts.SnapshotEvery; h.opts.Snapshots != nil && every > 0 && h.version/every > loadedVersion/every {
+		// The events are persisted, a failed snapshot only means
+		// more events will be replayed on the next load.
+		_ = h.takeSnapshot(ctx)
+	}
+
+	return nil
+}
+
+// Stage adds the pending events to the unit of work rather than persisting
+// them, expecting the aggregate to be at the version it was loaded at. This
+// lets the events of several aggregates be committed together.
+//
+// Streams are not created by Stage, so with StreamPerAggregate the event
+// store must create streams as they are appended to.
+func (h *Aggregate) Stage(uow *eventstore.UnitOfWork) {
+	h.lock.Lock()
+	defer func() {
+		h.pending = []*messages.Event{}
+		h.lock.Unlock()
+	}()
+
+	if len(h.pending) == 0 {
+		return
+	}
+
+	loadedVersion := h.version - uint64(len(h.pending))
+	uow.AppendToExpecting(h.streamName, eventstore.ExactVersion(loadedVersion), h.pending)
+}
+
+// Create the stream of a new aggregate then append the pending events, so
+// event store decorators see them. Another writer may create the stream first.
+func (h *Aggregate) createStream(ctx context.Context, expected eventstore.ExpectedVersion) error {
+	if expected != eventstore.NoStream {
+		return &eventstore.ErrConcurrencyConflict{
+			StreamName:  h.streamName,
+			AggregateID: h.aggregateID,
+			Expected:    expected,
+			Actual:      0,
+		}
+	}
+
+	err := h.store.Create(ctx, eventstore.EmptyStreamWithName(h.streamName))
+	if err != nil && err != eventstore.ErrStreamAlreadyExists {
+		return err
+	}
+
+	return h.store.AppendToExpecting(ctx, h.streamName, expected, h.pending)
+}
+
+// Match the events of the aggregate after the version given.
+func (h *Aggregate) eventsAfter(version uint64) eventstore.MetadataMatcher {
+	matcher := eventstore.MetadataMatcher{}
+	if !h.opts.Streams.PerAggregate() {
+		matcher[string(messages.MetaAggregateID)] = eventstore.MetadataMatcherCondition{
+			Operation: eventstore.MatchOpEq,
+			Values:    []string{h.aggregateID},
+		}
+	}
+
+	if version > 0 {
+		matcher[string(messages.MetaAggregateVersion)] = eventstore.MetadataMatcherCondition{
+			Operation: eventstore.MatchOpGt,
+			Values:    []string{strconv.FormatUint(version, 10)},
+			Numeric:   true,
+		}
+	}
+
+	return matcher
+}
+
+// Whether the stream has retention that can hide the events of the aggregate,
+// otherwise a gap in its versions is left by events dropped by upcasters.
+func (h *Aggregate) retained(ctx context.Context) (bool, error) {
+	md, err := h.store.FetchStreamMetadata(ctx, h.streamName)
+	if err != nil {
+		return false, err
+	}
+
+	r, err := eventstore.RetentionFromMetadata(md)
+	if err != nil {
+		return false, err
+	}
+
+	return !r.IsZero(), nil
+}
+
+// A conflict where none of the events after the loaded version can be read
+// means they are hidden by the retention of the stream, loading again would
+// conflict forever.
+func (h *Aggregate) historyHidden(ctx context.Context, loadedVersion uint64) bool {
+	events := h.store.Load(ctx, h.streamName, 0, 1, h.eventsAfter(loadedVersion))
+	defer events.Close()
+
+	return events.Next(ctx) == eventstore.EOF
+}
+
+func (h *Aggregate) restoreSnapshot(ctx context.Context) error {
+	s, ok := h.state.(Snapshotter)
+	if !ok || h.opts.Snapshots == nil {
+		return nil
+	}
+
+	snap, err := h.opts.Snapshots.Get(ctx, h.streamName, h.aggregateID)
+	if err == snapshot.ErrSnapshotNotFound {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	if err := s.Restore(snap.Data); err != nil {
+		return err
+	}
+	h.version = snap.Version
+
+	return nil
+}
+
+func (h *Aggregate) takeSnapshot(ctx context.Context) error {
+	s, ok := h.state.(Snapshotter)
+	if !ok {
+		return nil
+	}
+
+	data, err := s.Snapshot()
+	if err != nil {
+		return err
+	}
+
+	return h.opts.Snapshots.Save(ctx, &snapshot.Snapshot{
+		StreamName:  h.streamName,
+		AggregateID: h.aggregateID,
+		Version:     h.version,
+		Data:        data,
+		Created:     h.opts.Clock(),
+	})
 }
@@ -2,10 +2,14 @@ package aggregate_test
 
 import (
 	"context"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/go-cqrses/cqrses/adapters/inmem"
 	"github.com/go-cqrses/cqrses/aggregate"
+	"github.com/go-cqrses/cqrses/bus"
+	"github.com/go-cqrses/cqrses/esbridge"
 	"github.com/go-cqrses/cqrses/eventstore"
 	"github.com/go-cqrses/cqrses/messages"
 
@@ -52,3 +56,455 @@ func TestHistory(t *testing.T) {
 		assert.Equal(t, 4, as.appliedCount)
 	}
 }
+
+func TestHistoryConcurrentClose(t *testing.T) {
+	ctx := context.Background()
+	es := inmem.New()
+	es.Create(ctx, eventstore.EmptyStreamWithName("users"))
+	aID := "1df0d42f-596c-4fbb-8d8b-363524d50195"
+
+	first, err := aggregate.Load(ctx, aID, es, "users", &state{})
+	assert.Nil(t, err)
+	second, err := aggregate.Load(ctx, aID, es, "users", &state{})
+	assert.Nil(t, err)
+
+	_ = first.RecordThat(ctx, "itHappened", map[string]interface{}{})
+	_ = second.RecordThat(ctx, "itHappened", map[string]interface{}{})
+
+	assert.Nil(t, first.Close(ctx))
+
+	err = second.Close(ctx)
+	conflict, ok := err.(*eventstore.ErrConcurrencyConflict)
+	if !ok {
+		t.Fatalf("expected *eventstore.ErrConcurrencyConflict but got: %+v", err)
+	}
+	assert.Equal(t, eventstore.NoStream, conflict.Expected)
+	assert.Equal(t, uint64(1), conflict.Actual)
+}
+
+func TestHistoryStage(t *testing.T) {
+	ctx := context.Background()
+	es := inmem.New()
+	es.Create(ctx, eventstore.EmptyStreamWithName("accounts"))
+	fromID, toID := "1df0d42f-596c-4fbb-8d8b-363524d50195", "7a4b5c1e-2b8e-4c55-9d0b-0b6f8e0d6d2a"
+
+	from, err := aggregate.Load(ctx, fromID, es, "accounts", &state{})
+	assert.Nil(t, err)
+	to, err := aggregate.Load(ctx, toID, es, "accounts", &state{})
+	assert.Nil(t, err)
+
+	_ = from.RecordThat(ctx, "debited", map[string]interface{}{})
+	_ = to.RecordThat(ctx, "credited", map[string]interface{}{})
+
+	uow := eventstore.NewUnitOfWork()
+	from.Stage(uow)
+	to.Stage(uow)
+	assert.Len(t, uow.Appends(), 2)
+	assert.Nil(t, es.Commit(ctx, uow))
+
+	for _, aID := range []string{fromID, toID} {
+		as := &state{}
+		_, err := aggregate.Load(ctx, aID, es, "accounts", as)
+		assert.Nil(t, err)
+		assert.Equal(t, 1, as.appliedCount)
+	}
+
+	// Staging again has nothing to add.
+	uow = eventstore.NewUnitOfWork()
+	from.Stage(uow)
+	assert.Len(t, uow.Appends(), 0)
+}
+
+type racingCommand struct {
+	id string
+}
+
+func (c *racingCommand) AggregateID() string {
+	return c.id
+}
+
+// racingState records an event for the same aggregate from somewhere
+// else the first time it handles a command, causing a conflict.
+type racingState struct {
+	es      eventstore.EventStore
+	handled *int
+	version uint64
+}
+
+func (s *racingState) Handle(ctx context.Context, msg messages.Message, er aggregate.EventRecorder) error {
+	*s.handled++
+	if *s.handled == 1 {
+		other := aggregate.New(msg.Data().(aggregate.Command).AggregateID(), s.es, "users", &state{})
+		_ = other.RecordThat(ctx, "itHappenedElsewhere", map[string]interface{}{})
+		if err := other.Close(ctx); err != nil {
+			return err
+		}
+	}
+	return er("itHappened", map[string]interface{}{"seen": s.version})
+}
+
+func (s *racingState) Apply(e *messages.Event) error {
+	s.version = e.Version()
+	return nil
+}
+
+// recordingState records an event for every command it handles.
+type recordingState struct{}
+
+func (s *recordingState) Handle(_ context.Context, _ messages.Message, er aggregate.EventRecorder) error {
+	return er("itHappened", map[string]interface{}{})
+}
+
+func (s *recordingState) Apply(*messages.Event) error {
+	return nil
+}
+
+func TestMakeRetriesOnConflict(t *testing.T) {
+	aID := "1df0d42f-596c-4fbb-8d8b-363524d50195"
+	cmd := messages.NewCommand("cmd1", "doIt", &racingCommand{aID}, map[string]interface{}{}, 0, time.Now())
+
+	run := func(opts ...aggregate.Opt) (eventstore.EventStore, int, error) {
+		ctx := context.Background()
+		es := inmem.New()
+		es.Create(ctx, eventstore.EmptyStreamWithName("users"))
+
+		handled := 0
+		cmdBus := bus.NewCommandBus()
+		cmdBus.PushMiddleware(esbridge.AttachEventStoreToBus(es))
+		cmdBus.Register("doIt", aggregate.Make(func() aggregate.State {
+			return &racingState{es: es, handled: &handled}
+		}, "users", opts...))
+
+		err := cmdBus.Handle(ctx, cmd)
+		return es, handled, err
+	}
+
+	{ // Without retries the conflict is returned.
+		_, handled, err := run()
+		assert.NotNil(t, err)
+		assert.Equal(t, 1, handled)
+	}
+
+	{ // With retries the command is handled again against the latest state.
+		es, handled, err := run(aggregate.WithRetry(3, aggregate.ConstantBackoff(time.Millisecond)))
+		assert.Nil(t, err)
+		assert.Equal(t, 2, handled)
+
+		events := es.Load(context.Background(), "users", 0, 0, eventstore.MetadataMatcher{})
+		names := []string{}
+		for events.Next(context.Background()) == nil {
+			names = append(names, events.Current().MessageName())
+		}
+		assert.Equal(t, []string{"itHappenedElsewhere", "itHappened"}, names)
+	}
+
+	{ // Without a backoff the command is retried straight away.
+		_, handled, err := run(aggregate.WithRetry(3, nil))
+		assert.Nil(t, err)
+		assert.Equal(t, 2, handled)
+	}
+}
+
+func TestMakeDoesNotRetryUnpublishedEvents(t *testing.T) {
+	ctx := context.Background()
+	aID := "1df0d42f-596c-4fbb-8d8b-363524d50195"
+	cmd := messages.NewCommand("cmd1", "doIt", &racingCommand{aID}, map[string]interface{}{}, 0, time.Now())
+
+	// A subscriber conflicting once the events are persisted.
+	eventBus := bus.NewEventBus()
+	eventBus.Subscribe("projector", bus.MatchAny(), func(context.Context, messages.Message) error {
+		return &eventstore.ErrConcurrencyConflict{StreamName: "projections"}
+	})
+	es := bus.EventStoreWithBus(eventBus, inmem.New())
+	es.Create(ctx, eventstore.EmptyStreamWithName("users"))
+
+	cmdBus := bus.NewCommandBus()
+	cmdBus.PushMiddleware(esbridge.AttachEventStoreToBus(es))
+	cmdBus.Register("doIt", aggregate.Make(func() aggregate.State {
+		return &recordingState{}
+	}, "users", aggregate.WithRetry(3, aggregate.ConstantBackoff(time.Millisecond))))
+
+	// Handled again the event would be stored twice.
+	err := cmdBus.Handle(ctx, cmd)
+	assert.ErrorIs(t, err, bus.ErrNotPublished)
+
+	events := es.Load(ctx, "users", 0, 0, eventstore.MetadataMatcher{})
+	defer events.Close()
+	stored := 0
+	for events.Next(ctx) == nil {
+		stored++
+	}
+	assert.Equal(t, 1, stored)
+}
+
+func TestExponentialBackoff(t *testing.T) {
+	b := aggregate.ExponentialBackoff(10*time.Millisecond, 50*time.Millisecond)
+	assert.Equal(t, 10*time.Millisecond, b(1))
+	assert.Equal(t, 20*time.Millisecond, b(2))
+	assert.Equal(t, 40*time.Millisecond, b(3))
+	assert.Equal(t, 50*time.Millisecond, b(4))
+}
+
+type snapshottingState struct {
+	state
+	restored string
+}
+
+func (s *snapshottingState) Snapshot() ([]byte, error) {
+	return []byte("applied"), nil
+}
+
+func (s *snapshottingState) Restore(in []byte) error {
+	s.restored = string(in)
+	return nil
+}
+
+func TestHistorySnapshots(t *testing.T) {
+	ctx := context.Background()
+	es := inmem.New()
+	es.Create(ctx, eventstore.EmptyStreamWithName("users"))
+	snapshots := inmem.NewSnapshotStore()
+	aID := "1df0d42f-596c-4fbb-8d8b-363524d50195"
+	opts := []aggregate.Opt{aggregate.WithSnapshots(snapshots, 3)}
+
+	{ // Recording past the snapshot frequency takes a snapshot.
+		h := aggregate.New(aID, es, "users", &snapshottingState{}, opts...)
+		for i := 0; i < 4; i++ {
+			_ = h.RecordThat(ctx, "itHappened", map[string]interface{}{})
+		}
+		assert.Nil(t, h.Close(ctx))
+
+		snap, err := snapshots.Get(ctx, "users", aID)
+		assert.Nil(t, err)
+		assert.Equal(t, uint64(4), snap.Version)
+	}
+
+	{ // Recording without crossing the frequency does not take a snapshot.
+		h, err := aggregate.Load(ctx, aID, es, "users", &snapshottingState{}, opts...)
+		assert.Nil(t, err)
+		_ = h.RecordThat(ctx, "itHappened", map[string]interface{}{})
+		assert.Nil(t, h.Close(ctx))
+
+		snap, err := snapshots.Get(ctx, "users", aID)
+		assert.Nil(t, err)
+		assert.Equal(t, uint64(4), snap.Version)
+	}
+
+	{ // Loading restores the snapshot and replays only later events.
+		as := &snapshottingState{}
+		h, err := aggregate.Load(ctx, aID, es, "users", as, opts...)
+		assert.Nil(t, err)
+		assert.Equal(t, "applied", as.restored)
+		assert.Equal(t, 1, as.appliedCount)
+
+		// The loaded version must include the snapshot.
+		_ = h.RecordThat(ctx, "itHappened", map[string]interface{}{})
+		assert.Nil(t, h.Close(ctx))
+	}
+
+	{ // Loading without snapshots replays everything.
+		as := &snapshottingState{}
+		_, err := aggregate.Load(ctx, aID, es, "users", as)
+		assert.Nil(t, err)
+		assert.Equal(t, "", as.restored)
+		assert.Equal(t, 6, as.appliedCount)
+	}
+}
+
+func TestStreamStrategies(t *testing.T) {
+	ctx := context.Background()
+	aID := "1df0d42f-596c-4fbb-8d8b-363524d50195"
+
+	record := func(es eventstore.EventStore, aggregateType string, opts ...aggregate.Opt) error {
+		h, err := aggregate.Load(ctx, aID, es, aggregateType, &state{}, opts...)
+		if err != nil {
+			return err
+		}
+		_ = h.RecordThat(ctx, "itHappened", map[string]interface{}{})
+		return h.Close(ctx)
+	}
+
+	count := func(es eventstore.EventStore, streamName string) int {
+		events := es.Load(ctx, streamName, 0, 0, eventstore.MetadataMatcher{})
+		defer events.Close()
+
+		n := 0
+		for events.Next(ctx) == nil {
+			n++
+		}
+		return n
+	}
+
+	{ // Every aggregate type in one stream.
+		es := inmem.New()
+		es.Create(ctx, eventstore.EmptyStreamWithName("events"))
+		opt := aggregate.WithStreamStrategy(aggregate.SingleStream("events"))
+
+		assert.Nil(t, record(es, "users", opt))
+		assert.Nil(t, record(es, "orders", opt))
+		assert.Equal(t, 2, count(es, "events"))
+	}
+
+	{ // A stream per aggregate, created on the first write.
+		es := inmem.New()
+		opt := aggregate.WithStreamStrategy(aggregate.StreamPerAggregate())
+
+		assert.Nil(t, record(es, "user", opt))
+		assert.Nil(t, record(es, "user", opt))
+		assert.Equal(t, 2, count(es, "user-"+aID))
+
+		as := &state{}
+		_, err := aggregate.Load(ctx, aID, es, "user", as, opt)
+		assert.Nil(t, err)
+		assert.Equal(t, 2, as.appliedCount)
+
+		// Two new aggregates racing to create the stream.
+		first, _ := aggregate.Load(ctx, "other", es, "user", &state{}, opt)
+		second, _ := aggregate.Load(ctx, "other", es, "user", &state{}, opt)
+		_ = first.RecordThat(ctx, "itHappened", map[string]interface{}{})
+		_ = second.RecordThat(ctx, "itHappened", map[string]interface{}{})
+
+		assert.Nil(t, first.Close(ctx))
+		assert.IsType(t, &eventstore.ErrConcurrencyConflict{}, second.Close(ctx))
+	}
+
+	{ // Decorators see the events that create the stream.
+		published := 0
+		events := bus.NewEventBus()
+		events.Register(bus.MatchAny(), func(context.Context, messages.Message) error {
+			published++
+			return nil
+		})
+		es := bus.EventStoreWithBus(events, inmem.New())
+		opt := aggregate.WithStreamStrategy(aggregate.StreamPerAggregate())
+
+		assert.Nil(t, record(es, "user", opt))
+		assert.Nil(t, record(es, "user", opt))
+		assert.Equal(t, 2, published)
+	}
+
+	{ // Staged events need the store to create streams.
+		es := inmem.New()
+		es.CreateStreamsLazily(func(streamName string) bool {
+			return strings.HasPrefix(streamName, "user-")
+		})
+		opt := aggregate.WithStreamStrategy(aggregate.StreamPerAggregate())
+
+		h, err := aggregate.Load(ctx, aID, es, "user", &state{}, opt)
+		assert.Nil(t, err)
+		_ = h.RecordThat(ctx, "itHappened", map[string]interface{}{})
+
+		uow := eventstore.NewUnitOfWork()
+		h.Stage(uow)
+		assert.Nil(t, es.Commit(ctx, uow))
+		assert.Equal(t, 1, count(es, "user-"+aID))
+	}
+}
+
+func TestLoadHiddenHistory(t *testing.T) {
+	ctx := context.Background()
+	es := inmem.New()
+	es.Create(ctx, eventstore.EmptyStreamWithName("users"))
+	snapshots := inmem.NewSnapshotStore()
+	aID := "1df0d42f-596c-4fbb-8d8b-363524d50195"
+	opts := []aggregate.Opt{aggregate.WithSnapshots(snapshots, 3)}
+
+	h := aggregate.New(aID, es, "users", &snapshottingState{}, opts...)
+	for i := 0; i < 3; i++ {
+		_ = h.RecordThat(ctx, "itHappened", map[string]interface{}{})
+	}
+	assert.Nil(t, h.Close(ctx))
+
+	{ // Hiding the first events leaves a gap in the history.
+		assert.Nil(t, es.UpdateStreamMetadata(ctx, "users", eventstore.StreamMetadata{eventstore.StreamMetaMaxCount: "1"}))
+		_, err := aggregate.Load(ctx, aID, es, "users", &snapshottingState{})
+		assert.Equal(t, aggregate.ErrHistoryTruncated, err)
+	}
+
+	// Hiding every event is found when persisting, rather than
+	// conflicting on every retry.
+	assert.Nil(t, es.UpdateStreamMetadata(ctx, "users", eventstore.StreamMetadata{}))
+	assert.Nil(t, es.Truncate(ctx, "users", 4))
+
+	{
+		h, err := aggregate.Load(ctx, aID, es, "users", &snapshottingState{})
+		assert.Nil(t, err)
+		_ = h.RecordThat(ctx, "itHappened", map[string]interface{}{})
+		assert.Equal(t, aggregate.ErrHistoryTruncated, h.Close(ctx))
+	}
+
+	{ // A snapshot after the hidden events is loaded instead.
+		h, err := aggregate.Load(ctx, aID, es, "users", &snapshottingState{}, opts...)
+		assert.Nil(t, err)
+		assert.Equal(t, uint64(3), h.Version())
+		_ = h.RecordThat(ctx, "itHappened", map[string]interface{}{})
+		assert.Nil(t, h.Close(ctx))
+	}
+}
+
+// namingState remembers the names of the events applied.
+type namingState struct {
+	applied []string
+}
+
+func (s *namingState) Handle(context.Context, messages.Message, aggregate.EventRecorder) error {
+	return nil
+}
+
+func (s *namingState) Apply(e *messages.Event) error {
+	s.applied = append(s.applied, e.MessageName())
+	return nil
+}
+
+func TestLoadUpcastHistory(t *testing.T) {
+	ctx := context.Background()
+	aID := "1df0d42f-596c-4fbb-8d8b-363524d50195"
+
+	load := func(upcaster eventstore.Upcaster) (*namingState, *aggregate.Aggregate, error) {
+		es := inmem.New()
+		es.Create(ctx, eventstore.EmptyStreamWithName("users"))
+
+		h := aggregate.New(aID, es, "users", &namingState{})
+		_ = h.RecordThat(ctx, "Old", map[string]interface{}{})
+		_ = h.RecordThat(ctx, "Other", map[string]interface{}{})
+		if err := h.Close(ctx); err != nil {
+			return nil, nil, err
+		}
+
+		u := eventstore.NewUpcasters()
+		u.Register("Old", 1, upcaster)
+		es.SetUpcasters(u)
+
+		s := &namingState{}
+		h, err := aggregate.Load(ctx, aID, es, "users", s)
+		return s, h, err
+	}
+
+	{ // Split events share the version of the event they replace.
+		s, h, err := load(func(e eventstore.RawEvent) ([]eventstore.RawEvent, error) {
+			first, second := e, e
+			first.MessageName, second.MessageName = "New", "Newer"
+			return []eventstore.RawEvent{first, second}, nil
+		})
+		if assert.Nil(t, err) {
+			assert.Equal(t, []string{"New", "Newer", "Other"}, s.applied)
+			assert.Equal(t, uint64(2), h.Version())
+
+			_ = h.RecordThat(ctx, "itHappened", map[string]interface{}{})
+			assert.Nil(t, h.Close(ctx))
+		}
+	}
+
+	{ // Dropped events leave a gap, which is not hidden history.
+		s, h, err := load(func(eventstore.RawEvent) ([]eventstore.RawEvent, error) {
+			return nil, nil
+		})
+		if assert.Nil(t, err) {
+			assert.Equal(t, []string{"Other"}, s.applied)
+			assert.Equal(t, uint64(2), h.Version())
+
+			_ = h.RecordThat(ctx, "itHappened", map[string]interface{}{})
+			assert.Nil(t, h.Close(ctx))
+		}
+	}
+}
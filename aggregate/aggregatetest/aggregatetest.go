@@ -0,0 +1,200 @@
+// Package aggregatetest tests aggregate states by handling a command with
+// aggregate.Make given the events already recorded, then comparing the events
+// recorded or the error returned with those expected.
+package aggregatetest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/go-cqrses/cqrses/adapters/inmem"
+	"github.com/go-cqrses/cqrses/aggregate"
+	"github.com/go-cqrses/cqrses/esbridge"
+	"github.com/go-cqrses/cqrses/eventstore"
+	"github.com/go-cqrses/cqrses/messages"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var (
+	// Epoch is the time events are recorded at unless changed using At.
+	Epoch = time.Date(2020, time.January, 1, 0, 0, 0, 0, time.UTC)
+)
+
+type (
+	// Scenario handles a command given the events already recorded for the
+	// aggregate, in a new in memory event store each time it is run. Events
+	// are recorded at a fixed time and given the IDs "event-1", "event-2"
+	// and so on, the command has the ID "command-1".
+	Scenario struct {
+		t          *testing.T
+		factory    aggregate.StateFactory
+		streamName string
+		opts       []aggregate.Opt
+		now        time.Time
+		given      []*messages.Event
+		when       messages.Message
+	}
+
+	// recorded is what is compared for each event, so mismatches are shown
+	// as a diff of the parts that matter.
+	recorded struct {
+		Name     string
+		Data     interface{}
+		Metadata map[string]interface{}
+	}
+)
+
+// New returns a scenario for the aggregate type, the state factory, type and
+// options are given to aggregate.Make.
+func New(t *testing.T, factory aggregate.StateFactory, streamName string, opts ...aggregate.Opt) *Scenario {
+	return &Scenario{
+		t:          t,
+		factory:    factory,
+		streamName: streamName,
+		opts:       opts,
+		now:        Epoch,
+		given:      []*messages.Event{},
+	}
+}
+
+// Event returns an event to give or expect, only the name and payload are
+// used. Metadata added using messages.EventWithMetadata is compared with the
+// same keys of the events recorded.
+func Event(name string, data interface{}) *messages.Event {
+	return messages.NewEvent("", name, data, map[string]interface{}{}, 0, time.Time{})
+}
+
+// At changes the time events are recorded at.
+func (s *Scenario) At(now time.Time) *Scenario {
+	s.now = now
+	return s
+}
+
+// Given the events already recorded for the aggregate the command is for.
+func (s *Scenario) Given(events ...*messages.Event) *Scenario {
+	s.given = append(s.given, events...)
+	return s
+}
+
+// When the command is handled, it is named after its type.
+func (s *Scenario) When(cmd aggregate.Command) *Scenario {
+	return s.WhenMessage(messages.NewCommand("command-1", fmt.Sprintf("%T", cmd), cmd, map[string]interface{}{}, 0, s.now))
+}
+
+// WhenMessage is the same as When but the command message is given.
+func (s *Scenario) WhenMessage(msg messages.Message) *Scenario {
+	s.when = msg
+	return s
+}
+
+// Then the events expected are recorded in order, the test fails otherwise.
+func (s *Scenario) Then(expected ...*messages.Event) bool {
+	s.t.Helper()
+
+	events, err := s.run()
+	if err != nil {
+		s.t.Errorf("expected events to be recorded but got error: %s", err)
+		return false
+	}
+
+	want := make([]recorded, len(expected))
+	got := make([]recorded, len(events))
+	for i, e := range expected {
+		want[i] = recorded{Name: e.MessageName(), Data: e.Data(), Metadata: e.Metadata()}
+	}
+	for i, e := range events {
+		// Only compare the metadata expected.
+		md := map[string]interface{}{}
+		if i < len(expected) {
+			for k := range expected[i].Metadata() {
+				if v, ok := e.Metadata()[k]; ok {
+					md[k] = v
+				}
+			}
+		}
+		got[i] = recorded{Name: e.MessageName(), Data: e.Data(), Metadata: md}
+	}
+
+	return assert.Equal(s.t, want, got, "events recorded")
+}
+
+// ThenError the error expected is returned, compared using errors.Is, and no
+// events are recorded.
+func (s *Scenario) ThenError(expected error) bool {
+	s.t.Helper()
+
+	events, err := s.run()
+	if !errors.Is(err, expected) {
+		return assert.Equal(s.t, expected, err, "error returned")
+	}
+
+	names := []string{}
+	for _, e := range events {
+		names = append(names, e.MessageName())
+	}
+	return assert.Empty(s.t, names, "events recorded")
+}
+
+// Record the given events, handle the command and return the events it
+// recorded.
+func (s *Scenario) run() ([]*messages.Event, error) {
+	if s.when == nil {
+		return nil, errors.New("aggregatetest: no command given, call When first")
+	}
+
+	cmd, ok := s.when.Data().(aggregate.Command)
+	if !ok {
+		return nil, errors.New("aggregatetest: the command payload does not implement aggregate.Command")
+	}
+
+	ctx := context.Background()
+	es := inmem.New()
+
+	ids := 0
+	opts := append([]aggregate.Opt{
+		aggregate.WithClock(func() time.Time {
+			return s.now
+		}),
+		aggregate.WithIDGenerator(func() string {
+			ids++
+			return fmt.Sprintf("event-%d", ids)
+		}),
+	}, s.opts...)
+
+	aID := cmd.AggregateID()
+	if err := es.Create(ctx, eventstore.EmptyStreamWithName(aggregate.StreamName(s.streamName, aID, opts...))); err != nil {
+		return nil, err
+	}
+
+	history := aggregate.New(aID, es, s.streamName, s.factory(), opts...)
+	for _, e := range s.given {
+		if err := history.RecordThat(ctx, e.MessageName(), e.Data()); err != nil {
+			return nil, fmt.Errorf("aggregatetest: unable to apply given event %s: %w", e.MessageName(), err)
+		}
+	}
+	if err := history.Close(ctx); err != nil {
+		return nil, err
+	}
+
+	handler := aggregate.Make(s.factory, s.streamName, opts...)
+	err := esbridge.AttachEventStoreToBus(es)(ctx, s.when, handler)
+
+	events := []*messages.Event{}
+	it := es.Load(ctx, eventstore.AllStreamName, uint64(len(s.given)), 0, eventstore.MetadataMatcher{})
+	defer it.Close()
+
+	for {
+		if err := it.Next(ctx); err == eventstore.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		events = append(events, it.Current())
+	}
+
+	return events, err
+}
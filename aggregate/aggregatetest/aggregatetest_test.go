@@ -0,0 +1,98 @@
+package aggregatetest_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/go-cqrses/cqrses/aggregate"
+	"github.com/go-cqrses/cqrses/aggregate/aggregatetest"
+	"github.com/go-cqrses/cqrses/messages"
+)
+
+var errNotRegistered = errors.New("user is not registered")
+
+type (
+	register struct {
+		ID, Name string
+	}
+
+	rename struct {
+		ID, Name string
+	}
+
+	registered struct {
+		Name string
+	}
+
+	renamed struct {
+		From, To string
+	}
+
+	user struct {
+		name string
+	}
+)
+
+func (c *register) AggregateID() string { return c.ID }
+func (c *rename) AggregateID() string   { return c.ID }
+
+func (s *user) Handle(_ context.Context, msg messages.Message, er aggregate.EventRecorder) error {
+	switch cmd := msg.Data().(type) {
+	case *register:
+		return er("registered", &registered{Name: cmd.Name})
+	case *rename:
+		if s.name == "" {
+			return errNotRegistered
+		}
+		if cmd.Name == s.name {
+			return nil
+		}
+		return er("renamed", &renamed{From: s.name, To: cmd.Name})
+	}
+	return nil
+}
+
+func (s *user) Apply(e *messages.Event) error {
+	switch data := e.Data().(type) {
+	case *registered:
+		s.name = data.Name
+	case *renamed:
+		s.name = data.To
+	}
+	return nil
+}
+
+func newUser() aggregate.State {
+	return &user{}
+}
+
+func TestScenario(t *testing.T) {
+	aggregatetest.New(t, newUser, "users").
+		When(&register{"u1", "Ann"}).
+		Then(aggregatetest.Event("registered", &registered{Name: "Ann"}))
+
+	aggregatetest.New(t, newUser, "users").
+		Given(aggregatetest.Event("registered", &registered{Name: "Ann"})).
+		When(&rename{"u1", "Bob"}).
+		Then(messages.EventWithMetadata(aggregatetest.Event("renamed", &renamed{From: "Ann", To: "Bob"}), map[string]interface{}{
+			string(messages.MetaAggregateVersion): uint64(2),
+			string(messages.MetaCausationID):      "command-1",
+		}))
+
+	aggregatetest.New(t, newUser, "users").
+		Given(aggregatetest.Event("registered", &registered{Name: "Ann"})).
+		When(&rename{"u1", "Ann"}).
+		Then()
+
+	aggregatetest.New(t, newUser, "users").
+		When(&rename{"u1", "Bob"}).
+		ThenError(errNotRegistered)
+}
+
+func TestScenarioStreamPerAggregate(t *testing.T) {
+	aggregatetest.New(t, newUser, "user", aggregate.WithStreamStrategy(aggregate.StreamPerAggregate())).
+		Given(aggregatetest.Event("registered", &registered{Name: "Ann"})).
+		When(&rename{"u1", "Bob"}).
+		Then(aggregatetest.Event("renamed", &renamed{From: "Ann", To: "Bob"}))
+}
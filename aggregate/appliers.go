@@ -0,0 +1,154 @@
+package aggregate
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"unicode"
+
+	"github.com/go-cqrses/cqrses/messages"
+)
+
+var (
+	// ErrUnhandledEvent is returned by strict appliers when nothing applies
+	// an event.
+	ErrUnhandledEvent = errors.New("no applier for event")
+
+	// ErrUnexpectedPayload is returned when the payload of an event is not
+	// the type its applier takes, usually because the payload builder does
+	// not build the event.
+	ErrUnexpectedPayload = errors.New("unexpected event payload")
+
+	eventType = reflect.TypeOf(&messages.Event{})
+	errorType = reflect.TypeOf((*error)(nil)).Elem()
+)
+
+type (
+	// Appliers dispatches events to the function registered for their name,
+	// or to a method named after the event, so a State can implement Apply
+	// without a type switch:
+	//
+	//	func newUser() aggregate.State {
+	//		u := &user{}
+	//		u.appliers = aggregate.NewAppliers().Methods(u).Strict()
+	//		return u
+	//	}
+	//
+	//	func (u *user) Apply(e *messages.Event) error {
+	//		return u.appliers.Apply(e)
+	//	}
+	//
+	// Events nothing applies are ignored unless the appliers are strict.
+	Appliers struct {
+		fns    map[string]func(*messages.Event) error
+		target reflect.Value
+		strict bool
+	}
+)
+
+// NewAppliers returns appliers without any functions registered.
+func NewAppliers() *Appliers {
+	return &Appliers{
+		fns: map[string]func(*messages.Event) error{},
+	}
+}
+
+// OnEvent registers a function applying the events with the name given, the
+// payload is given as the type the function takes.
+func OnEvent[T any](a *Appliers, eventName string, fn func(data T, e *messages.Event) error) *Appliers {
+	return a.On(eventName, func(e *messages.Event) error {
+		data, ok := e.Data().(T)
+		if !ok {
+			return fmt.Errorf("%w: %s has a %T payload, expected %T", ErrUnexpectedPayload, e.MessageName(), e.Data(), data)
+		}
+		return fn(data, e)
+	})
+}
+
+// On registers a function applying the events with the name given.
+func (a *Appliers) On(eventName string, fn func(*messages.Event) error) *Appliers {
+	a.fns[eventName] = fn
+	return a
+}
+
+// Methods will apply events without a registered function using the method of
+// the target named "Apply" followed by the event name in camel case, so
+// "user.passwordChanged" is applied by ApplyUserPasswordChanged. Methods take
+// the payload, and optionally the event, and may return an error.
+func (a *Appliers) Methods(target interface{}) *Appliers {
+	a.target = reflect.ValueOf(target)
+	return a
+}
+
+// Strict makes Apply return ErrUnhandledEvent for events nothing applies.
+func (a *Appliers) Strict() *Appliers {
+	a.strict = true
+	return a
+}
+
+// Apply the event using its registered function or method.
+func (a *Appliers) Apply(e *messages.Event) error {
+	if fn, ok := a.fns[e.MessageName()]; ok {
+		return fn(e)
+	}
+
+	if a.target.IsValid() {
+		if m := a.target.MethodByName("Apply" + methodName(e.MessageName())); m.IsValid() {
+			return callApplier(m, e)
+		}
+	}
+
+	if a.strict {
+		return fmt.Errorf("%w: %s", ErrUnhandledEvent, e.MessageName())
+	}
+	return nil
+}
+
+// Call the method with the payload, and the event if it takes it.
+func callApplier(m reflect.Value, e *messages.Event) error {
+	t := m.Type()
+	if t.NumIn() < 1 || t.NumIn() > 2 || (t.NumIn() == 2 && t.In(1) != eventType) ||
+		t.NumOut() > 1 || (t.NumOut() == 1 && t.Out(0) != errorType) {
+		return fmt.Errorf("applier for %s must take the payload and optionally the event, and return nothing or an error", e.MessageName())
+	}
+
+	args := []reflect.Value{}
+	switch data := reflect.ValueOf(e.Data()); {
+	case t.NumIn() == 1 && t.In(0) == eventType:
+		args = append(args, reflect.ValueOf(e))
+	case data.IsValid() && data.Type().AssignableTo(t.In(0)):
+		args = append(args, data)
+	default:
+		return fmt.Errorf("%w: %s has a %T payload, expected %s", ErrUnexpectedPayload, e.MessageName(), e.Data(), t.In(0))
+	}
+	if t.NumIn() == 2 {
+		args = append(args, reflect.ValueOf(e))
+	}
+
+	out := m.Call(args)
+	if len(out) == 1 && !out[0].IsNil() {
+		return out[0].Interface().(error)
+	}
+	return nil
+}
+
+// The event name in camel case, without anything other than letters and
+// digits, for example "user.password_changed" becomes UserPasswordChanged.
+func methodName(eventName string) string {
+	var b strings.Builder
+	upper := true
+	for _, r := range eventName {
+		if !unicode.IsLetter(r) && !unicode.IsDigit(r) {
+			upper = true
+			continue
+		}
+
+		if upper {
+			r = unicode.ToUpper(r)
+			upper = false
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
@@ -0,0 +1,67 @@
+package aggregate_test
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/go-cqrses/cqrses/aggregate"
+	"github.com/go-cqrses/cqrses/messages"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type (
+	nameChanged struct {
+		Name string
+	}
+
+	person struct {
+		name    string
+		renames int
+	}
+)
+
+func (p *person) ApplyPersonNameChanged(data *nameChanged, e *messages.Event) {
+	p.name = data.Name
+}
+
+func (p *person) ApplyPersonForgotten(e *messages.Event) error {
+	return fmt.Errorf("forgotten at version %d", e.Version())
+}
+
+func event(name string, data interface{}) *messages.Event {
+	return messages.NewAggregateEvent(context.Background(), "p1", 1, name, data)
+}
+
+func TestAppliersMethods(t *testing.T) {
+	p := &person{}
+	a := aggregate.NewAppliers().Methods(p)
+
+	assert.Nil(t, a.Apply(event("person.name_changed", &nameChanged{"Ann"})))
+	assert.Equal(t, "Ann", p.name)
+
+	assert.EqualError(t, a.Apply(event("personForgotten", nil)), "forgotten at version 1")
+	assert.ErrorIs(t, a.Apply(event("person.nameChanged", map[string]interface{}{"Name": "Bob"})), aggregate.ErrUnexpectedPayload)
+
+	// Events without a method are ignored unless strict.
+	assert.Nil(t, a.Apply(event("person.moved", nil)))
+	assert.ErrorIs(t, a.Strict().Apply(event("person.moved", nil)), aggregate.ErrUnhandledEvent)
+}
+
+func TestAppliersOnEvent(t *testing.T) {
+	p := &person{}
+	a := aggregate.NewAppliers().Methods(p).Strict()
+	aggregate.OnEvent(a, "person.nameChanged", func(data *nameChanged, _ *messages.Event) error {
+		p.name = data.Name
+		p.renames++
+		return nil
+	})
+
+	// Registered functions are used before methods.
+	assert.Nil(t, a.Apply(event("person.nameChanged", &nameChanged{"Ann"})))
+	assert.Equal(t, "Ann", p.name)
+	assert.Equal(t, 1, p.renames)
+
+	assert.ErrorIs(t, a.Apply(event("person.nameChanged", &struct{}{})), aggregate.ErrUnexpectedPayload)
+}
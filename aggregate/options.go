@@ -0,0 +1,114 @@
+package aggregate
+
+import (
+	"time"
+
+	"github.com/go-cqrses/cqrses/bus"
+	"github.com/go-cqrses/cqrses/snapshot"
+
+	"github.com/gofrs/uuid"
+)
+
+type (
+	// Opt applies configuration to the aggregate options.
+	Opt func(*Opts)
+
+	// Opts contains options for handling commands with an aggregate.
+	Opts struct {
+		// Retries is how many times a command will be retried when the aggregate
+		// was changed by someone else while the command was being handled.
+		Retries int
+		// Backoff decides how long to wait before each retry.
+		Backoff Backoff
+		// Snapshots is where aggregate snapshots are stored, if nil
+		// snapshots are not used.
+		Snapshots snapshot.SnapshotStore
+		// SnapshotEvery is how many events to record between snapshots.
+		SnapshotEvery uint64
+		// Streams decides which stream the events of an aggregate are stored in.
+		Streams StreamStrategy
+		// Clock returns the time events are recorded at.
+		Clock func() time.Time
+		// NewID returns the message ID of each event recorded.
+		NewID func() string
+	}
+
+	// Backoff returns how long to wait before the retry attempt given,
+	// attempts start from 1.
+	Backoff func(attempt int) time.Duration
+)
+
+func buildOptions(opts []Opt) *Opts {
+	out := &Opts{
+		Retries: 0,
+		Backoff: ConstantBackoff(0),
+		Streams: StreamPerType(),
+		Clock:   time.Now,
+		NewID: func() string {
+			return uuid.Must(uuid.NewV4()).String()
+		},
+	}
+	for _, opt := range opts {
+		opt(out)
+	}
+	return out
+}
+
+// WithRetry will retry a command up to the number of retries given when the
+// events recorded conflict with events recorded by another command. Without
+// a backoff commands are retried straight away.
+func WithRetry(retries int, backoff Backoff) Opt {
+	if backoff == nil {
+		backoff = ConstantBackoff(0)
+	}
+
+	return func(o *Opts) {
+		o.Retries = retries
+		o.Backoff = backoff
+	}
+}
+
+// WithSnapshots will restore aggregates from the latest snapshot in the store
+// when loading, and take a new snapshot every n events. The aggregate state
+// must implement Snapshotter otherwise the option has no effect.
+func WithSnapshots(store snapshot.SnapshotStore, every uint64) Opt {
+	return func(o *Opts) {
+		o.Snapshots = store
+		o.SnapshotEvery = every
+	}
+}
+
+// WithStreamStrategy will store the events of aggregates in the streams
+// chosen by the strategy, rather than the stream named after their type.
+func WithStreamStrategy(strategy StreamStrategy) Opt {
+	return func(o *Opts) {
+		o.Streams = strategy
+	}
+}
+
+// WithClock will record events at the times returned by the clock, rather
+// than the current time.
+func WithClock(clock func() time.Time) Opt {
+	return func(o *Opts) {
+		o.Clock = clock
+	}
+}
+
+// WithIDGenerator will give recorded events the message IDs returned by the
+// generator, rather than random UUIDs.
+func WithIDGenerator(newID func() string) Opt {
+	return func(o *Opts) {
+		o.NewID = newID
+	}
+}
+
+// ConstantBackoff waits the same duration before every attempt.
+func ConstantBackoff(d time.Duration) Backoff {
+	return bus.ConstantBackoff(d)
+}
+
+// ExponentialBackoff doubles the duration waited after every attempt,
+// starting at initial and never waiting longer than max.
+func ExponentialBackoff(initial, max time.Duration) Backoff {
+	return bus.ExponentialBackoff(initial, max)
+}
@@ -0,0 +1,244 @@
+package aggregate
+
+import (
+	"context"
+	"errors"
+	"sync"
+
+	"github.com/go-cqrses/cqrses/bus"
+	"github.com/go-cqrses/cqrses/eventstore"
+	"github.com/go-cqrses/cqrses/messages"
+)
+
+var (
+	// ErrAggregateNotFound is returned when getting an aggregate that has
+	// no events.
+	ErrAggregateNotFound = errors.New("aggregate not found")
+
+	// ErrAggregateExists is returned when creating an aggregate that
+	// already has events.
+	ErrAggregateExists = errors.New("aggregate already exists")
+)
+
+type (
+	unitOfWorkCtxKey struct{}
+
+	// CreateCommand is implemented by commands that create the aggregate
+	// they are for, rather than change an existing one.
+	CreateCommand interface {
+		Command
+		CreatesAggregate()
+	}
+
+	// Repository gets and saves the aggregates of one type.
+	Repository struct {
+		store      eventstore.EventStore
+		streamName string
+		factory    StateFactory
+		opts       []Opt
+	}
+
+	// UnitOfWork tracks the aggregates used while handling a command, an
+	// aggregate is only loaded once and its events are committed together
+	// with the events of every other aggregate saved.
+	UnitOfWork struct {
+		events     *eventstore.UnitOfWork
+		aggregates map[string]*Aggregate
+		lock       *sync.Mutex
+	}
+)
+
+// NewRepository returns a repository for the aggregate type given, the type
+// is given to the stream strategy in the same way as Make.
+func NewRepository(store eventstore.EventStore, streamName string, factory StateFactory, opts ...Opt) *Repository {
+	return &Repository{
+		store:      store,
+		streamName: streamName,
+		factory:    factory,
+		opts:       opts,
+	}
+}
+
+// Get loads the aggregate, ErrAggregateNotFound is returned if it has no
+// events. Within a unit of work the same instance is returned every time.
+func (r *Repository) Get(ctx context.Context, aID string) (*Aggregate, error) {
+	a, err := r.load(ctx, aID)
+	if err != nil {
+		return nil, err
+	}
+
+	if a.Version() == 0 {
+		return nil, ErrAggregateNotFound
+	}
+	return a, nil
+}
+
+// Create returns a new aggregate, ErrAggregateExists is returned if it
+// already has events.
+func (r *Repository) Create(ctx context.Context, aID string) (*Aggregate, error) {
+	a, err := r.load(ctx, aID)
+	if err != nil {
+		return nil, err
+	}
+
+	if a.Version() > 0 {
+		return nil, ErrAggregateExists
+	}
+	return a, nil
+}
+
+// Exists reports whether the aggregate has any events, without loading it.
+func (r *Repository) Exists(ctx context.Context, aID string) (bool, error) {
+	if uow, ok := UnitOfWorkFromContext(ctx); ok {
+		if a, ok := uow.get(r.streamName, aID); ok {
+			return a.Version() > 0, nil
+		}
+	}
+
+	o := buildOptions(r.opts)
+	matcher := eventstore.MetadataMatcher{}
+	if !o.Streams.PerAggregate() {
+		matcher[string(messages.MetaAggregateID)] = eventstore.MetadataMatcherCondition{
+			Operation: eventstore.MatchOpEq,
+			Values:    []string{aID},
+		}
+	}
+
+	events := r.store.Load(ctx, o.Streams.StreamName(r.streamName, aID), 0, 1, matcher)
+	defer events.Close()
+
+	switch err := events.Next(ctx); {
+	case err == nil:
+		return true, nil
+	case err == eventstore.EOF:
+		return false, nil
+	case err == eventstore.ErrStreamDoesNotExist && o.Streams.PerAggregate():
+		return false, nil
+	default:
+		return false, err
+	}
+}
+
+// Save persists the events recorded by the aggregate. Within a unit of work
+// the events are staged and persisted when the unit of work is committed.
+func (r *Repository) Save(ctx context.Context, a *Aggregate) error {
+	if uow, ok := UnitOfWorkFromContext(ctx); ok {
+		a.Stage(uow.events)
+		return nil
+	}
+	return a.Close(ctx)
+}
+
+// Handler returns a command handler that creates the aggregate for create
+// commands and gets it for any other command, lets the state handle the
+// command and saves the recorded events. Conflicts are retried as with Make
+// when the command is not handled within a unit of work.
+func (r *Repository) Handler() func(ctx context.Context, msg messages.Message) error {
+	o := buildOptions(r.opts)
+
+	return func(ctx context.Context, msg messages.Message) error {
+		cmd, ok := msg.Data().(Command)
+		if !ok {
+			return errors.New("this command payload cannot be handled by cqrses.aggregate.Repository")
+		}
+
+		return retry(ctx, o, func() error {
+			var a *Aggregate
+			var err error
+			if _, ok := cmd.(CreateCommand); ok {
+				a, err = r.Create(ctx, cmd.AggregateID())
+			} else {
+				a, err = r.Get(ctx, cmd.AggregateID())
+			}
+			if err != nil {
+				return err
+			}
+
+			if err := a.Handle(ctx, msg); err != nil {
+				return err
+			}
+			return r.Save(ctx, a)
+		})
+	}
+}
+
+func (r *Repository) load(ctx context.Context, aID string) (*Aggregate, error) {
+	uow, ok := UnitOfWorkFromContext(ctx)
+	if !ok {
+		return Load(ctx, aID, r.store, r.streamName, r.factory(), r.opts...)
+	}
+
+	uow.lock.Lock()
+	defer uow.lock.Unlock()
+
+	key := identity(r.streamName, aID)
+	if a, ok := uow.aggregates[key]; ok {
+		return a, nil
+	}
+
+	a, err := Load(ctx, aID, r.store, r.streamName, r.factory(), r.opts...)
+	if err != nil {
+		return nil, err
+	}
+	uow.aggregates[key] = a
+	return a, nil
+}
+
+// NewUnitOfWork returns an empty unit of work.
+func NewUnitOfWork() *UnitOfWork {
+	return &UnitOfWork{
+		events:     eventstore.NewUnitOfWork(),
+		aggregates: map[string]*Aggregate{},
+		lock:       &sync.Mutex{},
+	}
+}
+
+// ContextWithUnitOfWork returns a context repositories will use the unit of
+// work from.
+func ContextWithUnitOfWork(ctx context.Context, uow *UnitOfWork) context.Context {
+	return context.WithValue(ctx, unitOfWorkCtxKey{}, uow)
+}
+
+// UnitOfWorkFromContext will return the unit of work from the context, if it
+// does not exist the second return value will be false.
+func UnitOfWorkFromContext(ctx context.Context) (*UnitOfWork, bool) {
+	uow, ok := ctx.Value(unitOfWorkCtxKey{}).(*UnitOfWork)
+	return uow, ok
+}
+
+// Commit persists the events of every aggregate saved, either all of them
+// are persisted or none are.
+func (u *UnitOfWork) Commit(ctx context.Context, store eventstore.EventStore) error {
+	return store.Commit(ctx, u.events)
+}
+
+func (u *UnitOfWork) get(streamName, aID string) (*Aggregate, bool) {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+
+	a, ok := u.aggregates[identity(streamName, aID)]
+	return a, ok
+}
+
+// The aggregate ID alone is not unique when several types share a stream.
+func identity(streamName, aID string) string {
+	return streamName + "\x00" + aID
+}
+
+// HandleInUnitOfWork is a command bus middleware which handles each command
+// within a unit of work, committing it to the event store when the command
+// was handled. Commands handled while handling a command share its unit of
+// work.
+func HandleInUnitOfWork(es eventstore.EventStore) bus.CommandBusMiddleware {
+	return func(ctx context.Context, msg messages.Message, next func(context.Context, messages.Message) error) error {
+		if _, ok := UnitOfWorkFromContext(ctx); ok {
+			return next(ctx, msg)
+		}
+
+		uow := NewUnitOfWork()
+		if err := next(ContextWithUnitOfWork(ctx, uow), msg); err != nil {
+			return err
+		}
+		return uow.Commit(ctx, es)
+	}
+}
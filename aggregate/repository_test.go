@@ -0,0 +1,178 @@
+package aggregate_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/go-cqrses/cqrses/adapters/inmem"
+	"github.com/go-cqrses/cqrses/aggregate"
+	"github.com/go-cqrses/cqrses/bus"
+	"github.com/go-cqrses/cqrses/eventstore"
+	"github.com/go-cqrses/cqrses/messages"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type (
+	openAccount struct {
+		ID string
+	}
+
+	deposit struct {
+		ID     string
+		Amount int
+	}
+
+	transfer struct {
+		From, To string
+		Amount   int
+	}
+
+	account struct {
+		balance int
+	}
+)
+
+func (c *openAccount) AggregateID() string { return c.ID }
+func (c *openAccount) CreatesAggregate()   {}
+func (c *deposit) AggregateID() string     { return c.ID }
+
+func (s *account) Handle(_ context.Context, msg messages.Message, er aggregate.EventRecorder) error {
+	switch cmd := msg.Data().(type) {
+	case *openAccount:
+		return er("opened", map[string]interface{}{})
+	case *deposit:
+		return er("deposited", map[string]interface{}{"amount": cmd.Amount})
+	}
+	return nil
+}
+
+func (s *account) Apply(e *messages.Event) error {
+	if e.MessageName() == "deposited" {
+		s.balance += e.Data().(map[string]interface{})["amount"].(int)
+	}
+	return nil
+}
+
+func command(name string, data interface{}) messages.Message {
+	return messages.NewCommand(name, name, data, map[string]interface{}{}, 0, time.Now())
+}
+
+func accountsRepository(es eventstore.EventStore) *aggregate.Repository {
+	return aggregate.NewRepository(es, "accounts", func() aggregate.State {
+		return &account{}
+	})
+}
+
+func TestRepository(t *testing.T) {
+	ctx := context.Background()
+	es := inmem.New()
+	es.Create(ctx, eventstore.EmptyStreamWithName("accounts"))
+	repo := accountsRepository(es)
+
+	_, err := repo.Get(ctx, "acc1")
+	assert.Equal(t, aggregate.ErrAggregateNotFound, err)
+
+	exists, err := repo.Exists(ctx, "acc1")
+	assert.Nil(t, err)
+	assert.False(t, exists)
+
+	a, err := repo.Create(ctx, "acc1")
+	assert.Nil(t, err)
+	assert.Nil(t, a.RecordThat(ctx, "opened", map[string]interface{}{}))
+	assert.Nil(t, repo.Save(ctx, a))
+
+	exists, err = repo.Exists(ctx, "acc1")
+	assert.Nil(t, err)
+	assert.True(t, exists)
+
+	_, err = repo.Create(ctx, "acc1")
+	assert.Equal(t, aggregate.ErrAggregateExists, err)
+
+	a, err = repo.Get(ctx, "acc1")
+	assert.Nil(t, err)
+	assert.Equal(t, "acc1", a.AggregateID())
+	assert.Equal(t, uint64(1), a.Version())
+}
+
+func TestRepositoryHandler(t *testing.T) {
+	ctx := context.Background()
+	es := inmem.New()
+	es.Create(ctx, eventstore.EmptyStreamWithName("accounts"))
+
+	cmdBus := bus.NewCommandBus()
+	handler := accountsRepository(es).Handler()
+	cmdBus.Register("open", handler)
+	cmdBus.Register("deposit", handler)
+
+	assert.ErrorIs(t, cmdBus.Handle(ctx, command("deposit", &deposit{"acc1", 10})), aggregate.ErrAggregateNotFound)
+	assert.Nil(t, cmdBus.Handle(ctx, command("open", &openAccount{"acc1"})))
+	assert.ErrorIs(t, cmdBus.Handle(ctx, command("open", &openAccount{"acc1"})), aggregate.ErrAggregateExists)
+	assert.Nil(t, cmdBus.Handle(ctx, command("deposit", &deposit{"acc1", 10})))
+
+	as := &account{}
+	_, err := aggregate.Load(ctx, "acc1", es, "accounts", as)
+	assert.Nil(t, err)
+	assert.Equal(t, 10, as.balance)
+}
+
+func TestRepositoryUnitOfWork(t *testing.T) {
+	ctx := context.Background()
+	es := inmem.New()
+	es.Create(ctx, eventstore.EmptyStreamWithName("accounts"))
+	repo := accountsRepository(es)
+
+	for _, aID := range []string{"acc1", "acc2"} {
+		a, _ := repo.Create(ctx, aID)
+		_ = a.RecordThat(ctx, "deposited", map[string]interface{}{"amount": 10})
+		assert.Nil(t, repo.Save(ctx, a))
+	}
+
+	cmdBus := bus.NewCommandBus()
+	cmdBus.PushMiddleware(aggregate.HandleInUnitOfWork(es))
+	cmdBus.Register("transfer", func(ctx context.Context, msg messages.Message) error {
+		cmd := msg.Data().(*transfer)
+
+		from, err := repo.Get(ctx, cmd.From)
+		if err != nil {
+			return err
+		}
+		to, err := repo.Get(ctx, cmd.To)
+		if err != nil {
+			return err
+		}
+
+		_ = from.RecordThat(ctx, "deposited", map[string]interface{}{"amount": -cmd.Amount})
+		_ = to.RecordThat(ctx, "deposited", map[string]interface{}{"amount": cmd.Amount})
+		if err := repo.Save(ctx, from); err != nil {
+			return err
+		}
+		return repo.Save(ctx, to)
+	})
+
+	{ // A transfer to itself uses the same instance twice.
+		assert.Nil(t, cmdBus.Handle(ctx, command("transfer", &transfer{"acc1", "acc1", 5})))
+
+		a, _ := repo.Get(ctx, "acc1")
+		assert.Equal(t, uint64(3), a.Version())
+	}
+
+	{ // Nothing is persisted when the command fails.
+		assert.ErrorIs(t, cmdBus.Handle(ctx, command("transfer", &transfer{"acc1", "acc3", 5})), aggregate.ErrAggregateNotFound)
+
+		a, _ := repo.Get(ctx, "acc1")
+		assert.Equal(t, uint64(3), a.Version())
+	}
+
+	{ // Both accounts change together.
+		assert.Nil(t, cmdBus.Handle(ctx, command("transfer", &transfer{"acc1", "acc2", 5})))
+
+		for aID, balance := range map[string]int{"acc1": 5, "acc2": 15} {
+			as := &account{}
+			_, err := aggregate.Load(ctx, aID, es, "accounts", as)
+			assert.Nil(t, err)
+			assert.Equal(t, balance, as.balance)
+		}
+	}
+}
@@ -0,0 +1,79 @@
+package aggregate
+
+type (
+	// StreamStrategy decides which stream the events of an aggregate are
+	// stored in. The aggregate type is the stream name given to Make, Load
+	// and New.
+	StreamStrategy interface {
+		// StreamName returns the name of the stream the events of the
+		// aggregate are stored in.
+		StreamName(aggregateType, aggregateID string) string
+
+		// PerAggregate reports whether each aggregate has a stream of its
+		// own, which is created when its first events are persisted.
+		PerAggregate() bool
+	}
+
+	singleStream struct {
+		streamName string
+	}
+
+	streamPerType struct{}
+
+	streamPerAggregate struct{}
+)
+
+// SingleStream stores the events of every aggregate, whatever the type,
+// in the stream given.
+func SingleStream(streamName string) StreamStrategy {
+	return &singleStream{streamName: streamName}
+}
+
+// StreamName returns the stream given to SingleStream.
+func (s *singleStream) StreamName(string, string) string {
+	return s.streamName
+}
+
+// PerAggregate is false.
+func (s *singleStream) PerAggregate() bool {
+	return false
+}
+
+// StreamPerType stores the events of each aggregate type in a stream named
+// after the type, this is the default.
+func StreamPerType() StreamStrategy {
+	return &streamPerType{}
+}
+
+// StreamName returns the aggregate type.
+func (s *streamPerType) StreamName(aggregateType, _ string) string {
+	return aggregateType
+}
+
+// PerAggregate is false.
+func (s *streamPerType) PerAggregate() bool {
+	return false
+}
+
+// StreamPerAggregate stores the events of each aggregate in a stream of its
+// own named "<type>-<id>", for example "user-1df0d42f". Streams are created
+// when the first events of an aggregate are persisted using Close.
+func StreamPerAggregate() StreamStrategy {
+	return &streamPerAggregate{}
+}
+
+// StreamName returns "<type>-<id>".
+func (s *streamPerAggregate) StreamName(aggregateType, aggregateID string) string {
+	return aggregateType + "-" + aggregateID
+}
+
+// PerAggregate is true.
+func (s *streamPerAggregate) PerAggregate() bool {
+	return true
+}
+
+// StreamName returns the name of the stream the events of the aggregate are
+// stored in when using the options given.
+func StreamName(aggregateType, aggregateID string, opts ...Opt) string {
+	return buildOptions(opts).Streams.StreamName(aggregateType, aggregateID)
+}
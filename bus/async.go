@@ -0,0 +1,199 @@
+package bus
+
+import (
+	"context"
+	"errors"
+	"hash/fnv"
+	"sync"
+	"sync/atomic"
+
+	"github.com/go-cqrses/cqrses/messages"
+)
+
+var (
+	// ErrBusClosed is returned when dispatching a command after the bus
+	// was closed.
+	ErrBusClosed = errors.New("command bus closed")
+)
+
+type (
+	// aggregateCommand is satisfied by aggregate.Command.
+	aggregateCommand interface {
+		AggregateID() string
+	}
+
+	// AsyncCommandBus handles commands using a pool of workers. Commands for
+	// the same aggregate always go to the same worker, so they are handled in
+	// the order they were dispatched, one at a time. Commands on different
+	// workers are handled in parallel.
+	AsyncCommandBus struct {
+		bus    *CommandBus
+		queues []chan *asyncCommand
+		next   uint64
+		closed bool
+		// Closed when the bus is closed, to stop dispatches waiting for room.
+		closing chan struct{}
+		// Dispatches sending to a queue, the queues are closed once they are done.
+		sending *sync.WaitGroup
+		lock    *sync.Mutex
+		wg      *sync.WaitGroup
+	}
+
+	asyncCommand struct {
+		ctx    context.Context
+		msg    messages.Message
+		future *Future
+	}
+
+	// Future is the result of a command handled asynchronously.
+	Future struct {
+		done chan struct{}
+		err  error
+	}
+)
+
+// NewAsyncCommandBus returns a command bus handling commands on the number of
+// workers given using the command bus provided, each worker queues up to
+// queueSize commands before Dispatch blocks.
+func NewAsyncCommandBus(bus *CommandBus, workers, queueSize int) *AsyncCommandBus {
+	if workers < 1 {
+		workers = 1
+	}
+
+	a := &AsyncCommandBus{
+		bus:     bus,
+		queues:  make([]chan *asyncCommand, workers),
+		closing: make(chan struct{}),
+		sending: &sync.WaitGroup{},
+		lock:    &sync.Mutex{},
+		wg:      &sync.WaitGroup{},
+	}
+
+	for i := range a.queues {
+		a.queues[i] = make(chan *asyncCommand, queueSize)
+		a.wg.Add(1)
+		go a.work(a.queues[i])
+	}
+
+	return a
+}
+
+// Dispatch queues the command to be handled, returning a future for the result.
+// The context given is used to handle the command, if the queue is full
+// Dispatch waits until there is room, the context is done or the bus is closed.
+func (a *AsyncCommandBus) Dispatch(ctx context.Context, msg messages.Message) (*Future, error) {
+	a.lock.Lock()
+	if a.closed {
+		a.lock.Unlock()
+		return nil, ErrBusClosed
+	}
+	a.sending.Add(1)
+	a.lock.Unlock()
+	defer a.sending.Done()
+
+	cmd := &asyncCommand{
+		ctx:    ctx,
+		msg:    msg,
+		future: &Future{done: make(chan struct{})},
+	}
+
+	select {
+	case a.queue(msg) <- cmd:
+		return cmd.future, nil
+	case <-a.closing:
+		return nil, ErrBusClosed
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// Handle dispatches the command and waits for the result.
+func (a *AsyncCommandBus) Handle(ctx context.Context, msg messages.Message) error {
+	f, err := a.Dispatch(ctx, msg)
+	if err != nil {
+		return err
+	}
+	return f.Wait(ctx)
+}
+
+// Close stops commands being dispatched and waits for the commands already
+// dispatched to be handled, or for the context to be done. Dispatches waiting
+// for room in a queue return ErrBusClosed.
+func (a *AsyncCommandBus) Close(ctx context.Context) error {
+	a.lock.Lock()
+	if !a.closed {
+		a.closed = true
+		close(a.closing)
+
+		// The queues are closed once nothing is sending to them.
+		go func() {
+			a.sending.Wait()
+			for _, q := range a.queues {
+				close(q)
+			}
+		}()
+	}
+	a.lock.Unlock()
+
+	drained := make(chan struct{})
+	go func() {
+		a.wg.Wait()
+		close(drained)
+	}()
+
+	select {
+	case <-drained:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Commands for an aggregate always go to the same queue, other commands are
+// spread over every queue.
+func (a *AsyncCommandBus) queue(msg messages.Message) chan *asyncCommand {
+	n := uint64(len(a.queues))
+
+	if cmd, ok := msg.Data().(aggregateCommand); ok {
+		h := fnv.New64a()
+		_, _ = h.Write([]byte(cmd.AggregateID()))
+		return a.queues[h.Sum64()%n]
+	}
+
+	return a.queues[atomic.AddUint64(&a.next, 1)%n]
+}
+
+func (a *AsyncCommandBus) work(queue chan *asyncCommand) {
+	defer a.wg.Done()
+
+	for cmd := range queue {
+		cmd.future.err = a.bus.Handle(cmd.ctx, cmd.msg)
+		close(cmd.future.done)
+	}
+}
+
+// Done is closed once the command has been handled.
+func (f *Future) Done() <-chan struct{} {
+	return f.done
+}
+
+// Err returns the error handling the command, it is nil until Done is closed.
+func (f *Future) Err() error {
+	select {
+	case <-f.done:
+		return f.err
+	default:
+		return nil
+	}
+}
+
+// Wait for the command to be handled and return the error handling it, or the
+// context error if the context is done first.
+func (f *Future) Wait(ctx context.Context) error {
+	select {
+	case <-f.done:
+		return f.err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,176 @@
+package bus_test
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-cqrses/cqrses/bus"
+	"github.com/go-cqrses/cqrses/messages"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type asyncCmd struct {
+	ID string
+	N  int
+}
+
+func (c *asyncCmd) AggregateID() string { return c.ID }
+
+func asyncCommand(aID string, n int) messages.Message {
+	return messages.NewCommand("c1", "do", &asyncCmd{aID, n}, map[string]interface{}{}, 0, time.Now())
+}
+
+func TestAsyncCommandBus(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	lock := &sync.Mutex{}
+	seen := map[string][]int{}
+	running := map[string]bool{}
+	overlapped := false
+	errOdd := errors.New("odd")
+
+	cmdBus := bus.NewCommandBus()
+	cmdBus.Register("do", func(_ context.Context, msg messages.Message) error {
+		cmd := msg.Data().(*asyncCmd)
+
+		lock.Lock()
+		if running[cmd.ID] {
+			overlapped = true
+		}
+		running[cmd.ID] = true
+		lock.Unlock()
+
+		time.Sleep(time.Millisecond)
+
+		lock.Lock()
+		running[cmd.ID] = false
+		seen[cmd.ID] = append(seen[cmd.ID], cmd.N)
+		lock.Unlock()
+
+		if cmd.N%2 == 1 {
+			return errOdd
+		}
+		return nil
+	})
+
+	sut := bus.NewAsyncCommandBus(cmdBus, 4, 2)
+	futures := []*bus.Future{}
+	for n := 0; n < 10; n++ {
+		for _, aID := range []string{"a", "b", "c"} {
+			f, err := sut.Dispatch(ctx, asyncCommand(aID, n))
+			assert.Nil(t, err)
+			futures = append(futures, f)
+		}
+	}
+
+	assert.Nil(t, futures[0].Wait(ctx))
+	assert.ErrorIs(t, futures[3].Wait(ctx), errOdd)
+
+	// Closing waits for every command dispatched.
+	assert.Nil(t, sut.Close(ctx))
+	for _, f := range futures {
+		select {
+		case <-f.Done():
+		default:
+			t.Fatal("command not handled before close returned")
+		}
+	}
+
+	// Commands for the same aggregate are handled in order, one at a time.
+	assert.False(t, overlapped)
+	for _, aID := range []string{"a", "b", "c"} {
+		assert.Equal(t, []int{0, 1, 2, 3, 4, 5, 6, 7, 8, 9}, seen[aID])
+	}
+
+	_, err := sut.Dispatch(ctx, asyncCommand("a", 10))
+	assert.Equal(t, bus.ErrBusClosed, err)
+}
+
+func TestAsyncCommandBusParallel(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// Both commands must be running at once to finish.
+	release := make(chan struct{})
+	started := make(chan struct{}, 2)
+
+	cmdBus := bus.NewCommandBus()
+	cmdBus.Register("do", func(ctx context.Context, msg messages.Message) error {
+		started <- struct{}{}
+		select {
+		case <-release:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	})
+
+	sut := bus.NewAsyncCommandBus(cmdBus, 2, 0)
+	defer sut.Close(ctx)
+
+	// Commands without an aggregate are spread over the workers.
+	first, _ := sut.Dispatch(ctx, messages.NewCommand("c1", "do", nil, map[string]interface{}{}, 0, time.Now()))
+	second, _ := sut.Dispatch(ctx, messages.NewCommand("c2", "do", nil, map[string]interface{}{}, 0, time.Now()))
+
+	for i := 0; i < 2; i++ {
+		select {
+		case <-started:
+		case <-ctx.Done():
+			t.Fatal("commands were not handled in parallel")
+		}
+	}
+	close(release)
+
+	assert.Nil(t, first.Wait(ctx))
+	assert.Nil(t, second.Wait(ctx))
+}
+
+func TestAsyncCommandBusCloseWhileDispatching(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	release := make(chan struct{})
+	started := make(chan struct{})
+
+	var sut *bus.AsyncCommandBus
+	cmdBus := bus.NewCommandBus()
+	cmdBus.Register("do", func(ctx context.Context, msg messages.Message) error {
+		if msg.Data().(*asyncCmd).N > 0 {
+			return nil
+		}
+
+		close(started)
+		<-release
+
+		// Handlers dispatching while the bus closes are not deadlocked.
+		_, err := sut.Dispatch(ctx, asyncCommand("a", 2))
+		return err
+	})
+	sut = bus.NewAsyncCommandBus(cmdBus, 1, 0)
+
+	first, err := sut.Dispatch(ctx, asyncCommand("a", 0))
+	assert.Nil(t, err)
+	<-started
+
+	// Blocked as the only worker is busy and there is no queue.
+	blocked := make(chan error)
+	go func() {
+		_, err := sut.Dispatch(ctx, asyncCommand("a", 1))
+		blocked <- err
+	}()
+
+	// Close gives up once its context is done.
+	closeCtx, closeCancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer closeCancel()
+	assert.Equal(t, context.DeadlineExceeded, sut.Close(closeCtx))
+	assert.Equal(t, bus.ErrBusClosed, <-blocked)
+
+	close(release)
+	assert.Nil(t, sut.Close(ctx))
+	assert.ErrorIs(t, first.Wait(ctx), bus.ErrBusClosed)
+}
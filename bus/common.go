@@ -9,8 +9,8 @@ import (
 )
 
 var (
-	// ErrNoHandlerFound is returned from a command or query bus where
-	// there is no handler found.
+	// ErrNoHandlerFound is returned from a command bus where there is
+	// no handler found.
 	ErrNoHandlerFound = errors.New("no command handler found")
 )
 
@@ -35,3 +35,8 @@ func (e *Error) Error() string {
 		e.original,
 	)
 }
+
+// Unwrap returns the error returned by the handler.
+func (e *Error) Unwrap() error {
+	return e.original
+}
@@ -0,0 +1,100 @@
+package bus_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/go-cqrses/cqrses/adapters/inmem"
+	"github.com/go-cqrses/cqrses/bus"
+	"github.com/go-cqrses/cqrses/eventstore"
+	"github.com/go-cqrses/cqrses/messages"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEventBusReportsErrors(t *testing.T) {
+	errFailed := errors.New("failed")
+	calls := 0
+
+	sut := bus.NewEventBus()
+	sut.Subscribe("flaky", bus.MatchAny(), func(context.Context, messages.Message) error {
+		calls++
+		if calls < 3 {
+			return errFailed
+		}
+		return nil
+	}, bus.WithRetries(2, func(int) time.Duration { return time.Millisecond }))
+	sut.Subscribe("broken", bus.MatchMessageNameRaw("broken"), func(context.Context, messages.Message) error {
+		return errFailed
+	})
+	sut.Register(bus.MatchAny(), func(context.Context, messages.Message) error {
+		return errors.New("registered handlers are fire and forget")
+	})
+
+	e := messages.NewEvent("1", "hello-world", map[string]interface{}{}, map[string]interface{}{}, 0, time.Now())
+	assert.Nil(t, sut.Handle(context.Background(), e))
+	assert.Equal(t, 3, calls)
+
+	e = messages.NewEvent("2", "broken", map[string]interface{}{}, map[string]interface{}{}, 0, time.Now())
+	assert.ErrorIs(t, sut.Handle(context.Background(), e), errFailed)
+
+	// Events persisted but not handled are reported by the event store.
+	es := sut.WrapStore(inmem.New())
+	es.Create(context.Background(), eventstore.EmptyStreamWithName("users"))
+	err := es.AppendTo(context.Background(), "users", []*messages.Event{e})
+	assert.ErrorIs(t, err, bus.ErrNotPublished)
+	assert.Contains(t, err.Error(), "subscriber broken: failed")
+	assert.NotContains(t, err.Error(), "fire and forget")
+}
+
+func TestEventBusDeadLetters(t *testing.T) {
+	ctx := context.Background()
+	sink := inmem.NewDeadLetterSink()
+	fixed := false
+	handled := []string{}
+
+	sut := bus.NewEventBus(bus.WithDeadLetters(sink))
+	sut.Subscribe("mailer", bus.MatchAny(), func(_ context.Context, m messages.Message) error {
+		if !fixed {
+			return errors.New("smtp down")
+		}
+		handled = append(handled, m.MessageID())
+		return nil
+	}, bus.WithRetries(1, nil))
+
+	for _, id := range []string{"1", "2"} {
+		e := messages.NewEvent(id, "user.registered", map[string]interface{}{}, map[string]interface{}{}, 0, time.Now())
+		assert.Nil(t, sut.Handle(ctx, e))
+	}
+
+	letters, err := sink.Letters(ctx, "mailer", 0)
+	assert.Nil(t, err)
+	if assert.Len(t, letters, 2) {
+		assert.Equal(t, "1", letters[0].Event.MessageID())
+		assert.Equal(t, "smtp down", letters[0].Error)
+		assert.Equal(t, 2, letters[0].Attempts)
+	}
+
+	// Replaying while still broken keeps the letters.
+	n, err := sut.Replay(ctx, "mailer")
+	assert.Nil(t, err)
+	assert.Equal(t, 0, n)
+	letters, _ = sink.Letters(ctx, "mailer", 1)
+	if assert.Len(t, letters, 1) {
+		assert.Equal(t, 4, letters[0].Attempts)
+	}
+
+	fixed = true
+	n, err = sut.Replay(ctx, "mailer")
+	assert.Nil(t, err)
+	assert.Equal(t, 2, n)
+	assert.Equal(t, []string{"1", "2"}, handled)
+
+	letters, _ = sink.Letters(ctx, "mailer", 0)
+	assert.Empty(t, letters)
+
+	_, err = sut.Replay(ctx, "sms")
+	assert.Equal(t, bus.ErrNoSubscriber, err)
+}
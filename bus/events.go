@@ -2,9 +2,25 @@ package bus
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"time"
 
+	"github.com/go-cqrses/cqrses/deadletter"
 	"github.com/go-cqrses/cqrses/eventstore"
 	"github.com/go-cqrses/cqrses/messages"
+
+	"github.com/gofrs/uuid"
+)
+
+var (
+	// ErrNoSubscriber is returned when replaying the letters of a subscriber
+	// that is not subscribed.
+	ErrNoSubscriber = errors.New("no subscriber with that name")
+
+	// ErrNoDeadLetterSink is returned when replaying letters on an event bus
+	// without a dead letter sink.
+	ErrNoDeadLetterSink = errors.New("event bus has no dead letter sink")
 )
 
 type (
@@ -13,37 +29,174 @@ type (
 	MessageMatcher func(messages.Message) bool
 
 	eventBusHandler struct {
+		name    string
 		matches MessageMatcher
 		handler Handler
+		retries int
+		backoff func(attempt int) time.Duration
 	}
 
 	// EventBus is used to dispatch messages to various handlers.
 	EventBus struct {
-		handlers []*eventBusHandler
+		handlers    []*eventBusHandler
+		deadLetters deadletter.Sink
 	}
+
+	// EventBusOpt applies configuration to the event bus.
+	EventBusOpt func(*EventBus)
+
+	// SubscriberOpt applies configuration to a subscriber.
+	SubscriberOpt func(*eventBusHandler)
 )
 
 // NewEventBus returns a new initialised event bus.
-func NewEventBus() *EventBus {
-	return &EventBus{
+func NewEventBus(opts ...EventBusOpt) *EventBus {
+	b := &EventBus{
 		handlers: []*eventBusHandler{},
 	}
+	for _, opt := range opts {
+		opt(b)
+	}
+	return b
+}
+
+// WithDeadLetters will record the events subscribers fail to handle in the
+// sink, rather than returning the errors from Handle.
+func WithDeadLetters(sink deadletter.Sink) EventBusOpt {
+	return func(b *EventBus) {
+		b.deadLetters = sink
+	}
+}
+
+// WithRetries will call the subscriber again up to the number of retries
+// given when it fails to handle an event, waiting for the backoff first,
+// see ConstantBackoff and ExponentialBackoff. Without a backoff the
+// subscriber is called again straight away.
+func WithRetries(retries int, backoff func(attempt int) time.Duration) SubscriberOpt {
+	if backoff == nil {
+		backoff = ConstantBackoff(0)
+	}
+
+	return func(h *eventBusHandler) {
+		h.retries = retries
+		h.backoff = backoff
+	}
 }
 
 // Register a handler that will be called if a dispatched event returns
-// a positive result from the message matcher.
+// a positive result from the message matcher. Errors from the handler are
+// ignored, use Subscribe for them to be reported.
 func (c *EventBus) Register(m MessageMatcher, h Handler) {
-	c.handlers = append(c.handlers, &eventBusHandler{m, h})
+	c.handlers = append(c.handlers, &eventBusHandler{matches: m, handler: h})
+}
+
+// Subscribe registers a named handler that will be called if a dispatched
+// event returns a positive result from the message matcher. Events the
+// handler fails to handle are recorded as dead letters for the name.
+func (c *EventBus) Subscribe(name string, m MessageMatcher, h Handler, opts ...SubscriberOpt) {
+	s := &eventBusHandler{name: name, matches: m, handler: h}
+	for _, opt := range opts {
+		opt(s)
+	}
+	c.handlers = append(c.handlers, s)
 }
 
-// Handle disptaches the event to matched handlers.
+// Handle disptaches the event to matched handlers, every handler is called
+// even if another fails. Events named subscribers fail to handle are
+// recorded as dead letters if the bus has a sink, otherwise their errors are
+// returned. Errors from handlers added with Register are ignored.
 func (c *EventBus) Handle(ctx context.Context, m messages.Message) error {
+	errs := []error{}
 	for _, h := range c.handlers {
-		if h.matches(m) {
-			_ = h.handler(ctx, m) // we ignore error as this is an event rather then a command
+		if !h.matches(m) {
+			continue
+		}
+
+		attempts, err := h.deliver(ctx, m)
+		if err == nil || h.name == "" {
+			continue
+		}
+
+		if c.deadLetters != nil {
+			err = c.deadLetters.Record(ctx, &deadletter.Letter{
+				ID:         uuid.Must(uuid.NewV4()).String(),
+				Subscriber: h.name,
+				Event:      m,
+				Error:      err.Error(),
+				Attempts:   attempts,
+				Failed:     time.Now(),
+			})
+			if err == nil {
+				continue
+			}
+		}
+
+		errs = append(errs, fmt.Errorf("subscriber %s: %w", h.name, err))
+	}
+
+	return errors.Join(errs...)
+}
+
+// Replay calls the subscriber with the events dead lettered for it, oldest
+// first, removing the letters of the events it handles. The number of
+// events handled is returned.
+func (c *EventBus) Replay(ctx context.Context, subscriber string) (int, error) {
+	if c.deadLetters == nil {
+		return 0, ErrNoDeadLetterSink
+	}
+
+	var h *eventBusHandler
+	for _, candidate := range c.handlers {
+		if candidate.name == subscriber {
+			h = candidate
+		}
+	}
+	if h == nil {
+		return 0, ErrNoSubscriber
+	}
+
+	letters, err := c.deadLetters.Letters(ctx, subscriber, 0)
+	if err != nil {
+		return 0, err
+	}
+
+	handled := 0
+	for _, l := range letters {
+		attempts, err := h.deliver(ctx, l.Event)
+		if err != nil {
+			l.Attempts += attempts
+			l.Error = err.Error()
+			l.Failed = time.Now()
+			if err := c.deadLetters.Record(ctx, l); err != nil {
+				return handled, err
+			}
+			continue
+		}
+
+		if err := c.deadLetters.Remove(ctx, l.ID); err != nil {
+			return handled, err
+		}
+		handled++
+	}
+
+	return handled, nil
+}
+
+// Call the handler until it handles the message or runs out of retries,
+// returning how many times it was called.
+func (h *eventBusHandler) deliver(ctx context.Context, m messages.Message) (int, error) {
+	for attempt := 1; ; attempt++ {
+		err := h.handler(ctx, m)
+		if err == nil || attempt > h.retries {
+			return attempt, err
+		}
+
+		select {
+		case <-ctx.Done():
+			return attempt, err
+		case <-time.After(h.backoff(attempt)):
 		}
 	}
-	return nil
 }
 
 // WrapStore will return an event store where persisted events will be dispatched
@@ -52,6 +205,28 @@ func (c *EventBus) WrapStore(store eventstore.EventStore) eventstore.EventStore
 	return EventStoreWithBus(c, store)
 }
 
+// ConstantBackoff waits the same duration before every attempt.
+func ConstantBackoff(d time.Duration) func(attempt int) time.Duration {
+	return func(int) time.Duration {
+		return d
+	}
+}
+
+// ExponentialBackoff doubles the duration waited after every attempt,
+// starting at initial and never waiting longer than max.
+func ExponentialBackoff(initial, max time.Duration) func(attempt int) time.Duration {
+	return func(attempt int) time.Duration {
+		d := initial
+		for i := 1; i < attempt && d < max; i++ {
+			d *= 2
+		}
+		if d > max {
+			return max
+		}
+		return d
+	}
+}
+
 // MatchAny will also return a positive match to process a message.
 func MatchAny() MessageMatcher {
 	return func(messages.Message) bool {
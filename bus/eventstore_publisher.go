@@ -2,11 +2,21 @@ package bus
 
 import (
 	"context"
+	"errors"
+	"fmt"
 
 	"github.com/go-cqrses/cqrses/eventstore"
 	"github.com/go-cqrses/cqrses/messages"
 )
 
+var (
+	// ErrNotPublished is returned when events were persisted but subscribers
+	// on the event bus failed to handle them, the events should not be
+	// persisted again. The errors of the subscribers are not wrapped, so
+	// they cannot be mistaken for errors persisting the events.
+	ErrNotPublished = errors.New("events persisted but not published")
+)
+
 type (
 	// publishingEventStore reads events going via appendTo
 	// and will publish them on a success result.
@@ -48,6 +58,11 @@ func (s *publishingEventStore) FetchStreamMetadata(ctx context.Context, streamNa
 	return s.store.FetchStreamMetadata(ctx, streamName)
 }
 
+// Subscribe proxies to underlying store.
+func (s *publishingEventStore) Subscribe(ctx context.Context, streamName string, from uint64, matcher eventstore.MetadataMatcher) (eventstore.Subscription, error) {
+	return s.store.Subscribe(ctx, streamName, from, matcher)
+}
+
 // Create proxies to underlying store.
 func (s *publishingEventStore) Create(ctx context.Context, stream *eventstore.Stream) error {
 	return s.store.Create(ctx, stream)
@@ -55,15 +70,52 @@ func (s *publishingEventStore) Create(ctx context.Context, stream *eventstore.St
 
 // AppendTo proxies to underlying store.
 func (s *publishingEventStore) AppendTo(ctx context.Context, streamName string, events []*messages.Event) error {
-	err := s.store.AppendTo(ctx, streamName, events)
+	return s.AppendToExpecting(ctx, streamName, eventstore.AnyVersion, events)
+}
+
+// AppendToExpecting proxies to underlying store.
+func (s *publishingEventStore) AppendToExpecting(ctx context.Context, streamName string, expected eventstore.ExpectedVersion, events []*messages.Event) error {
+	if err := s.store.AppendToExpecting(ctx, streamName, expected, events); err != nil {
+		return err
+	}
+
+	return s.publish(ctx, events)
+}
 
-	if err == nil {
-		for _, e := range events {
-			s.bus.Handle(ctx, e)
+// Commit proxies to underlying store.
+func (s *publishingEventStore) Commit(ctx context.Context, uow *eventstore.UnitOfWork) error {
+	if err := s.store.Commit(ctx, uow); err != nil {
+		return err
+	}
+
+	return s.publish(ctx, uow.Events())
+}
+
+// Publish the persisted events on the bus, every event is published even if
+// handling another fails. A conflict returned by a subscriber must not look
+// like the append conflicting, or the events would be recorded again.
+func (s *publishingEventStore) publish(ctx context.Context, events []*messages.Event) error {
+	errs := []error{}
+	for _, e := range events {
+		if err := s.bus.Handle(ctx, e); err != nil {
+			errs = append(errs, err)
 		}
 	}
 
-	return err
+	if len(errs) > 0 {
+		return fmt.Errorf("%w: %v", ErrNotPublished, errors.Join(errs...))
+	}
+	return nil
+}
+
+// Truncate proxies to underlying store.
+func (s *publishingEventStore) Truncate(ctx context.Context, streamName string, before uint64) error {
+	return s.store.Truncate(ctx, streamName, before)
+}
+
+// SoftDelete proxies to underlying store.
+func (s *publishingEventStore) SoftDelete(ctx context.Context, streamName string) error {
+	return s.store.SoftDelete(ctx, streamName)
 }
 
 // Delete proxies to underlying store.
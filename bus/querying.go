@@ -1,44 +1,158 @@
 package bus
 
-// import (
-// 	"context"
-// 	"errors"
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
 
-// 	"github.com/go-cqrses/cqrses/messages"
-// )
+	"github.com/go-cqrses/cqrses/messages"
+)
 
-// var (
-// 	ErrQueryAlreadyRegistered = errors.New("query already registered")
-// )
+var (
+	// ErrQueryAlreadyRegistered is returned when registering a second handler
+	// for a query name.
+	ErrQueryAlreadyRegistered = errors.New("query already registered")
 
-// type (
-// 	QueryHandler func(context.Context, messages.Message) (interface{}, error)
+	// ErrNoQueryHandlerFound is returned from a query bus where there is
+	// no handler for the query.
+	ErrNoQueryHandlerFound = errors.New("no query handler found")
 
-// 	QueryBus struct {
-// 		handlers map[string]QueryHandler
-// 	}
-// )
+	// ErrUnexpectedResult is returned by Query when the result is not the
+	// type asked for.
+	ErrUnexpectedResult = errors.New("unexpected query result")
+)
 
-// func (b *QueryBus) Register(n string, h QueryHandler) error {
-// 	if _, ok := b.handlers[n]; ok {
-// 		return ErrCommandAlreadyRegistered
-// 	}
+type (
+	// QueryHandler handles a query returning the result.
+	QueryHandler func(ctx context.Context, msg messages.Message) (interface{}, error)
 
-// 	b.handlers[n] = h
+	// QueryBus can handle the dispatching of queries.
+	QueryBus struct {
+		handlers   map[string]QueryHandler
+		middleware []QueryBusMiddleware
+		lock       *sync.Mutex
+	}
 
-// 	return nil
-// }
+	// QueryBusMiddleware can guard and alter the context or message that is about
+	// to be handled, and the result returned.
+	QueryBusMiddleware func(ctx context.Context, msg messages.Message, next func(context.Context, messages.Message) (interface{}, error)) (interface{}, error)
 
-// func (c *QueryBus) Handle(ctx context.Context, m messages.Message) (interface{}, error) {
-// 	h, ok := c.handlers[m.MessageName()]
-// 	if !ok {
-// 		return nil, ErrNoHandlerFound
-// 	}
+	// TypedQueryHandler handles queries with parameters of type Q returning a
+	// result of type R.
+	TypedQueryHandler[Q, R any] func(ctx context.Context, query Q, msg messages.Message) (R, error)
+)
 
-// 	res, err := h(ctx, m)
-// 	if err != nil {
-// 		return nil, &Error{original: err}
-// 	}
+// NewQueryBus returns a new initialised query bus.
+func NewQueryBus() *QueryBus {
+	return &QueryBus{
+		handlers:   map[string]QueryHandler{},
+		middleware: []QueryBusMiddleware{},
+		lock:       &sync.Mutex{},
+	}
+}
 
-// 	return res, nil
-// }
+// Register a handler for the message name provided.
+func (b *QueryBus) Register(n string, h QueryHandler) error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if _, ok := b.handlers[n]; ok {
+		return ErrQueryAlreadyRegistered
+	}
+
+	b.handlers[n] = h
+
+	return nil
+}
+
+// PushMiddleware to the middleware slice, middleware is called in the order
+// it was pushed.
+func (b *QueryBus) PushMiddleware(in QueryBusMiddleware) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.middleware = append(b.middleware, in)
+}
+
+// Handle a query returning the result or an error if there is any.
+func (b *QueryBus) Handle(ctx context.Context, msg messages.Message) (interface{}, error) {
+	b.lock.Lock()
+	m := b.middleware[:]
+	b.lock.Unlock()
+
+	var next func(int) func(context.Context, messages.Message) (interface{}, error)
+	next = func(i int) func(context.Context, messages.Message) (interface{}, error) {
+		if i < len(m) {
+			return func(mCtx context.Context, mMsg messages.Message) (interface{}, error) {
+				return m[i](mCtx, mMsg, next(i+1))
+			}
+		}
+
+		return func(finalCtx context.Context, finalMsg messages.Message) (interface{}, error) {
+			b.lock.Lock()
+			h, ok := b.handlers[finalMsg.MessageName()]
+			b.lock.Unlock()
+
+			if !ok {
+				return nil, ErrNoQueryHandlerFound
+			}
+			return h(finalCtx, finalMsg)
+		}
+	}
+
+	res, err := next(0)(ctx, msg)
+	if err != nil {
+		return nil, &Error{
+			messageID:   msg.MessageID(),
+			messageName: msg.MessageName(),
+			original:    err,
+		}
+	}
+
+	return res, nil
+}
+
+// TypedQuery returns a query handler passing the query parameters to the
+// typed handler, an error wrapping ErrUnexpectedPayload is returned if the
+// parameters are another type.
+func TypedQuery[Q, R any](h TypedQueryHandler[Q, R]) QueryHandler {
+	return func(ctx context.Context, msg messages.Message) (interface{}, error) {
+		query, ok := msg.Data().(Q)
+		if !ok {
+			return nil, fmt.Errorf("%w: %s has a %T payload, expected %T", ErrUnexpectedPayload, msg.MessageName(), msg.Data(), query)
+		}
+		return h(ctx, query, msg)
+	}
+}
+
+// RegisterTypedQuery registers a handler for the queries with the name
+// registered for the parameter type Q.
+func RegisterTypedQuery[Q, R any](b *QueryBus, r *messages.Registry, h TypedQueryHandler[Q, R]) error {
+	name, err := messages.NameFor[Q](r)
+	if err != nil {
+		return err
+	}
+	return b.Register(name, TypedQuery(h))
+}
+
+// Query handles the query returning the result as type R, an error wrapping
+// ErrUnexpectedResult is returned if the result is another type.
+func Query[R any](ctx context.Context, b *QueryBus, msg messages.Message) (R, error) {
+	var out R
+
+	res, err := b.Handle(ctx, msg)
+	if err != nil {
+		return out, err
+	}
+
+	if res == nil {
+		return out, nil
+	}
+
+	out, ok := res.(R)
+	if !ok {
+		return out, fmt.Errorf("%w: %s returned %T, expected %T", ErrUnexpectedResult, msg.MessageName(), res, out)
+	}
+	return out, nil
+}
@@ -0,0 +1,90 @@
+package bus_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/go-cqrses/cqrses/bus"
+	"github.com/go-cqrses/cqrses/messages"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type (
+	userByEmail struct {
+		Email string
+	}
+
+	userDTO struct {
+		ID string
+	}
+
+	ctxKey string
+)
+
+func query(name string, data interface{}) messages.Message {
+	return messages.NewQuery("q1", name, data, map[string]interface{}{}, time.Now())
+}
+
+func TestQueryBus(t *testing.T) {
+	ctx := context.Background()
+	sut := bus.NewQueryBus()
+	calls := []string{}
+
+	sut.PushMiddleware(func(ctx context.Context, msg messages.Message, next func(context.Context, messages.Message) (interface{}, error)) (interface{}, error) {
+		calls = append(calls, "first")
+		return next(context.WithValue(ctx, ctxKey("tenant"), "acme"), msg)
+	})
+	sut.PushMiddleware(func(ctx context.Context, msg messages.Message, next func(context.Context, messages.Message) (interface{}, error)) (interface{}, error) {
+		calls = append(calls, "second")
+		res, err := next(ctx, msg)
+		if err == nil {
+			res = res.(string) + "!"
+		}
+		return res, err
+	})
+
+	assert.Nil(t, sut.Register("hello", func(ctx context.Context, msg messages.Message) (interface{}, error) {
+		calls = append(calls, "handler")
+		return "hello " + ctx.Value(ctxKey("tenant")).(string), nil
+	}))
+	assert.Equal(t, bus.ErrQueryAlreadyRegistered, sut.Register("hello", nil))
+
+	res, err := sut.Handle(ctx, query("hello", nil))
+	assert.Nil(t, err)
+	assert.Equal(t, "hello acme!", res)
+	assert.Equal(t, []string{"first", "second", "handler"}, calls)
+
+	_, err = sut.Handle(ctx, query("goodbye", nil))
+	assert.ErrorIs(t, err, bus.ErrNoQueryHandlerFound)
+}
+
+func TestQueryBusTyped(t *testing.T) {
+	ctx := context.Background()
+	r := messages.NewRegistry()
+	assert.Nil(t, messages.Register[*userByEmail](r, "user.byEmail"))
+
+	sut := bus.NewQueryBus()
+	errMissing := errors.New("no such user")
+	assert.Nil(t, bus.RegisterTypedQuery(sut, r, func(_ context.Context, q *userByEmail, _ messages.Message) (*userDTO, error) {
+		if q.Email != "ann@example.com" {
+			return nil, errMissing
+		}
+		return &userDTO{ID: "u1"}, nil
+	}))
+
+	user, err := bus.Query[*userDTO](ctx, sut, query("user.byEmail", &userByEmail{"ann@example.com"}))
+	assert.Nil(t, err)
+	assert.Equal(t, &userDTO{ID: "u1"}, user)
+
+	_, err = bus.Query[*userDTO](ctx, sut, query("user.byEmail", &userByEmail{"bob@example.com"}))
+	assert.ErrorIs(t, err, errMissing)
+
+	_, err = bus.Query[*userDTO](ctx, sut, query("user.byEmail", "ann@example.com"))
+	assert.ErrorIs(t, err, bus.ErrUnexpectedPayload)
+
+	_, err = bus.Query[string](ctx, sut, query("user.byEmail", &userByEmail{"ann@example.com"}))
+	assert.ErrorIs(t, err, bus.ErrUnexpectedResult)
+}
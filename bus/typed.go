@@ -0,0 +1,53 @@
+package bus
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/go-cqrses/cqrses/messages"
+)
+
+var (
+	// ErrUnexpectedPayload is returned from typed handlers when the message
+	// payload is not the type the handler takes.
+	ErrUnexpectedPayload = errors.New("unexpected message payload")
+)
+
+type (
+	// TypedHandler handles messages with a payload of type T.
+	TypedHandler[T any] func(ctx context.Context, data T, msg messages.Message) error
+)
+
+// Typed returns a handler passing the payload to the typed handler, an error
+// wrapping ErrUnexpectedPayload is returned if the payload is another type.
+func Typed[T any](h TypedHandler[T]) Handler {
+	return func(ctx context.Context, msg messages.Message) error {
+		data, ok := msg.Data().(T)
+		if !ok {
+			return fmt.Errorf("%w: %s has a %T payload, expected %T", ErrUnexpectedPayload, msg.MessageName(), msg.Data(), data)
+		}
+		return h(ctx, data, msg)
+	}
+}
+
+// RegisterTyped registers a handler for the commands with the name registered
+// for the payload type T.
+func RegisterTyped[T any](c *CommandBus, r *messages.Registry, h TypedHandler[T]) error {
+	name, err := messages.NameFor[T](r)
+	if err != nil {
+		return err
+	}
+	return c.Register(name, Typed(h))
+}
+
+// RegisterTypedEvent registers a handler for the events with the name
+// registered for the payload type T.
+func RegisterTypedEvent[T any](c *EventBus, r *messages.Registry, h TypedHandler[T]) error {
+	name, err := messages.NameFor[T](r)
+	if err != nil {
+		return err
+	}
+	c.Register(MatchMessageNameRaw(name), Typed(h))
+	return nil
+}
@@ -0,0 +1,63 @@
+package bus_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/go-cqrses/cqrses/bus"
+	"github.com/go-cqrses/cqrses/messages"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type (
+	createUser struct {
+		Email string
+	}
+
+	userCreated struct {
+		Email string
+	}
+)
+
+func TestRegisterTyped(t *testing.T) {
+	r := messages.NewRegistry()
+	assert.Nil(t, messages.Register[*createUser](r, "user.create"))
+
+	sut := bus.NewCommandBus()
+	var got *createUser
+	assert.Nil(t, bus.RegisterTyped(sut, r, func(_ context.Context, cmd *createUser, _ messages.Message) error {
+		got = cmd
+		return nil
+	}))
+
+	name, err := r.NameOf(&createUser{})
+	assert.Nil(t, err)
+	assert.Nil(t, sut.Handle(context.Background(), messages.NewCommand("1", name, &createUser{"ann@example.com"}, map[string]interface{}{}, 0, time.Now())))
+	assert.Equal(t, &createUser{"ann@example.com"}, got)
+
+	// A payload of another type is an error rather than a panic.
+	err = sut.Handle(context.Background(), messages.NewCommand("2", name, map[string]interface{}{}, map[string]interface{}{}, 0, time.Now()))
+	assert.ErrorIs(t, err, bus.ErrUnexpectedPayload)
+
+	// Types without a name can not be registered.
+	err = bus.RegisterTyped(sut, r, func(context.Context, *userCreated, messages.Message) error { return nil })
+	assert.ErrorIs(t, err, messages.ErrTypeNotRegistered)
+}
+
+func TestRegisterTypedEvent(t *testing.T) {
+	r := messages.NewRegistry()
+	assert.Nil(t, messages.Register[*userCreated](r, "user.created"))
+
+	sut := bus.NewEventBus()
+	emails := []string{}
+	assert.Nil(t, bus.RegisterTypedEvent(sut, r, func(_ context.Context, e *userCreated, _ messages.Message) error {
+		emails = append(emails, e.Email)
+		return nil
+	}))
+
+	sut.Handle(context.Background(), messages.NewEvent("1", "user.created", &userCreated{"ann@example.com"}, map[string]interface{}{}, 1, time.Now()))
+	sut.Handle(context.Background(), messages.NewEvent("2", "user.removed", &userCreated{"bob@example.com"}, map[string]interface{}{}, 1, time.Now()))
+	assert.Equal(t, []string{"ann@example.com"}, emails)
+}
@@ -0,0 +1,40 @@
+package deadletter
+
+import (
+	"context"
+	"time"
+
+	"github.com/go-cqrses/cqrses/messages"
+)
+
+type (
+	// Letter is an event a subscriber failed to handle.
+	Letter struct {
+		// The ID of the letter.
+		ID string
+		// The name of the subscriber that failed to handle the event.
+		Subscriber string
+		// The event that could not be handled.
+		Event messages.Message
+		// The error returned by the subscriber the last time it was called.
+		Error string
+		// How many times the subscriber was called.
+		Attempts int
+		// When the subscriber last failed.
+		Failed time.Time
+	}
+
+	// Sink contains the methods to store and retrieve letters.
+	Sink interface {
+		// Record will store the letter, replacing a letter with the same ID.
+		Record(ctx context.Context, l *Letter) error
+
+		// Letters returns up to limit letters for the subscriber, oldest
+		// first. If limit is 0 every letter is returned.
+		Letters(ctx context.Context, subscriber string, limit uint64) ([]*Letter, error)
+
+		// Remove will delete the letter, usually because the event was
+		// handled when replayed.
+		Remove(ctx context.Context, id string) error
+	}
+)
@@ -3,10 +3,18 @@ package eventstore
 import (
 	"context"
 	"errors"
+	"fmt"
 
 	"github.com/go-cqrses/cqrses/messages"
 )
 
+const (
+	// AllStreamName can be used to read every event in every stream. Events
+	// are read in the order they were appended and the position of each event
+	// is its global position, which can be used to resume reading later.
+	AllStreamName = "$all"
+)
+
 var (
 	// ErrStreamDoesNotExist is returned when attempting to read from
 	// a stream that does not exist.
@@ -15,12 +23,45 @@ var (
 	// ErrStreamAlreadyExists is returned when attempting to create a
 	// stream that does already exists.
 	ErrStreamAlreadyExists = errors.New("stream already exists")
+
+	// ErrStreamNameReserved is returned when attempting to create or
+	// write to a stream with a name used by the event store itself.
+	ErrStreamNameReserved = errors.New("stream name is reserved")
 )
 
+// ErrConcurrencyConflict is returned when appending to a stream, or
+// an aggregate within a stream, that is not at the expected version.
+type ErrConcurrencyConflict struct {
+	StreamName  string
+	AggregateID string
+	Expected    ExpectedVersion
+	Actual      uint64
+}
+
+func (e *ErrConcurrencyConflict) Error() string {
+	if e.AggregateID != "" {
+		return fmt.Sprintf(
+			"concurrency conflict on %s (aggregate:%s): expected version %d but was %d",
+			e.StreamName,
+			e.AggregateID,
+			e.Expected,
+			e.Actual,
+		)
+	}
+
+	return fmt.Sprintf(
+		"concurrency conflict on %s: expected version %d but was %d",
+		e.StreamName,
+		e.Expected,
+		e.Actual,
+	)
+}
+
 type (
 	// ReadOnlyEventStore contains the methods to read from an event store.
 	ReadOnlyEventStore interface {
-		// Load events from the given stream name.
+		// Load events from the given stream name, use AllStreamName
+		// to load events from every stream.
 		Load(ctx context.Context, streamName string, from, count uint64, matcher MetadataMatcher) StreamIterator
 
 		// LoadReverse Loads events from the given stream name in reverse.
@@ -34,6 +75,11 @@ type (
 
 		// FetchStreamMetadata gets the metadata about a stream.
 		FetchStreamMetadata(ctx context.Context, streamName string) (StreamMetadata, error)
+
+		// Subscribe delivers the events in the stream after the position given
+		// followed by events as they are appended, until the context is done
+		// or the subscription is closed.
+		Subscribe(ctx context.Context, streamName string, from uint64, matcher MetadataMatcher) (Subscription, error)
 	}
 
 	// EventStore contains the methods to read and write to an event store.
@@ -46,7 +92,26 @@ type (
 		// AppendTo will append events to the stream.
 		AppendTo(ctx context.Context, streamName string, events []*messages.Event) error
 
-		// Delete will remove the stream.
+		// AppendToExpecting will append events to the stream if the stream,
+		// or aggregate the events belong to, is at the expected version. If
+		// it is not an *ErrConcurrencyConflict is returned.
+		AppendToExpecting(ctx context.Context, streamName string, expected ExpectedVersion, events []*messages.Event) error
+
+		// Commit will make every append in the unit of work or none of them,
+		// returning the error of the first append that could not be made.
+		Commit(ctx context.Context, uow *UnitOfWork) error
+
+		// Truncate will remove the events in the stream before the position
+		// given. The latest event of each aggregate is kept, but can not be
+		// read, so aggregate versions are still checked when appending.
+		Truncate(ctx context.Context, streamName string, before uint64) error
+
+		// SoftDelete will truncate every event in the stream and hide the
+		// stream until it is created again, versions carry on from where
+		// they were.
+		SoftDelete(ctx context.Context, streamName string) error
+
+		// Delete will remove the stream and every event in it for good.
 		Delete(ctx context.Context, streamName string) error
 
 		// UpdateStreamMetadata sets the metadata for the given stream name.
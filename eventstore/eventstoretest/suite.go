@@ -0,0 +1,778 @@
+// Package eventstoretest provides a suite of tests every event store
+// implementation should pass, so adapters behave the same.
+package eventstoretest
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/gofrs/uuid"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/go-cqrses/cqrses/eventstore"
+	"github.com/go-cqrses/cqrses/messages"
+)
+
+type (
+	// Factory should return an event store to run a test against, stream
+	// names are unique per test so the same store may be returned each time.
+	Factory func(t *testing.T) eventstore.EventStore
+)
+
+// RunSuite will run every test in the suite against event stores
+// returned by the factory.
+func RunSuite(t *testing.T, factory Factory) {
+	tests := []struct {
+		name string
+		test func(*testing.T, eventstore.EventStore)
+	}{
+		{"Create", testCreate},
+		{"CreateWithEvents", testCreateWithEvents},
+		{"AppendTo", testAppendTo},
+		{"AppendToExpecting", testAppendToExpecting},
+		{"Commit", testCommit},
+		{"Load", testLoad},
+		{"LoadReverse", testLoadReverse},
+		{"LoadLongStream", testLoadLongStream},
+		{"Rewind", testRewind},
+		{"LoadMatchers", testLoadMatchers},
+		{"LoadMetadataMatchers", testLoadMetadataMatchers},
+		{"LoadComparisonMatchers", testLoadComparisonMatchers},
+		{"LoadPropertyMatchers", testLoadPropertyMatchers},
+		{"StreamMetadata", testStreamMetadata},
+		{"FetchStreamNames", testFetchStreamNames},
+		{"FetchStreamNamesRegex", testFetchStreamNamesRegex},
+		{"Delete", testDelete},
+		{"Retention", testRetention},
+		{"Truncate", testTruncate},
+		{"SoftDelete", testSoftDelete},
+		{"Subscribe", testSubscribe},
+		{"AllStream", testAllStream},
+	}
+
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			tc.test(t, factory(t))
+		})
+	}
+}
+
+// A unique stream name, so tests do not interfere with each other.
+func streamName(prefix string) string {
+	return prefix + "-" + uuid.Must(uuid.NewV4()).String()[:8]
+}
+
+// An event recorded for an aggregate, every adapter must
+// be able to store these.
+func aggregateEvent(aggregateID string, version uint64, name string) *messages.Event {
+	return messages.NewEvent(
+		uuid.Must(uuid.NewV4()).String(),
+		name,
+		map[string]interface{}{"name": name},
+		map[string]interface{}{
+			string(messages.MetaAggregateID):      aggregateID,
+			string(messages.MetaAggregateVersion): version,
+		},
+		version,
+		time.Now(),
+	)
+}
+
+// A slice of events for the same aggregate named after their versions.
+func aggregateEvents(aggregateID string, from, to uint64) []*messages.Event {
+	events := []*messages.Event{}
+	for v := from; v <= to; v++ {
+		events = append(events, aggregateEvent(aggregateID, v, fmt.Sprintf("event%d", v)))
+	}
+	return events
+}
+
+func newAggregateID() string {
+	return uuid.Must(uuid.NewV4()).String()
+}
+
+// Read every event from the iterator returning the event names.
+func names(t *testing.T, it eventstore.StreamIterator) []string {
+	defer it.Close()
+
+	out := []string{}
+	for {
+		if err := it.Next(context.Background()); err != nil {
+			if err != eventstore.EOF {
+				t.Fatalf("unable to read from stream: %s", err)
+			}
+			return out
+		}
+		out = append(out, it.Current().MessageName())
+	}
+}
+
+func mustCreate(t *testing.T, es eventstore.EventStore, stream *eventstore.Stream) {
+	if err := es.Create(context.Background(), stream); err != nil {
+		t.Fatalf("unable to create stream %s: %s", stream.Name, err)
+	}
+}
+
+func mustAppend(t *testing.T, es eventstore.EventStore, name string, events []*messages.Event) {
+	if err := es.AppendTo(context.Background(), name, events); err != nil {
+		t.Fatalf("unable to append to stream %s: %s", name, err)
+	}
+}
+
+func testCreate(t *testing.T, es eventstore.EventStore) {
+	ctx := context.Background()
+	name := streamName("create")
+
+	assert.Nil(t, es.Create(ctx, eventstore.EmptyStreamWithName(name)))
+	assert.Equal(t, eventstore.ErrStreamAlreadyExists, es.Create(ctx, eventstore.EmptyStreamWithName(name)))
+	assert.Equal(t, eventstore.ErrStreamNameReserved, es.Create(ctx, eventstore.EmptyStreamWithName(eventstore.AllStreamName)))
+	assert.Equal(t, eventstore.ErrStreamNameReserved, es.AppendTo(ctx, eventstore.AllStreamName, aggregateEvents(newAggregateID(), 1, 1)))
+
+	uow := eventstore.NewUnitOfWork()
+	uow.AppendTo(name, aggregateEvents(newAggregateID(), 1, 1))
+	uow.AppendTo(eventstore.AllStreamName, aggregateEvents(newAggregateID(), 1, 1))
+	assert.Equal(t, eventstore.ErrStreamNameReserved, es.Commit(ctx, uow))
+	assert.Equal(t, []string{}, names(t, es.Load(ctx, name, 0, 0, eventstore.MetadataMatcher{})))
+}
+
+func testCreateWithEvents(t *testing.T, es eventstore.EventStore) {
+	ctx := context.Background()
+	name := streamName("create")
+
+	mustCreate(t, es, eventstore.NewStreamWithName(name, eventstore.StreamMetadata{}, aggregateEvents(newAggregateID(), 1, 3)))
+	assert.Equal(t, []string{"event1", "event2", "event3"}, names(t, es.Load(ctx, name, 0, 0, eventstore.MetadataMatcher{})))
+}
+
+func testAppendTo(t *testing.T, es eventstore.EventStore) {
+	ctx := context.Background()
+	name := streamName("append")
+	aID := newAggregateID()
+
+	assert.Equal(t, eventstore.ErrStreamDoesNotExist, es.AppendTo(ctx, name, aggregateEvents(aID, 1, 1)))
+
+	mustCreate(t, es, eventstore.EmptyStreamWithName(name))
+	assert.Nil(t, es.AppendTo(ctx, name, []*messages.Event{}))
+	mustAppend(t, es, name, aggregateEvents(aID, 1, 2))
+	mustAppend(t, es, name, aggregateEvents(aID, 3, 3))
+
+	it := es.Load(ctx, name, 0, 0, eventstore.MetadataMatcher{})
+	defer it.Close()
+
+	for i, expected := range aggregateEvents(aID, 1, 3) {
+		if err := it.Next(ctx); err != nil {
+			t.Fatalf("unable to read event %d: %s", i, err)
+		}
+
+		event := it.Current()
+		assert.Equal(t, expected.MessageName(), event.MessageName())
+		assert.Equal(t, expected.Version(), event.Version())
+		assert.Equal(t, uint64(i+1), event.Position())
+		assert.Equal(t, aID, event.Metadata()[string(messages.MetaAggregateID)])
+	}
+
+	assert.Equal(t, eventstore.EOF, it.Next(ctx))
+}
+
+func testAppendToExpecting(t *testing.T, es eventstore.EventStore) {
+	ctx := context.Background()
+	name := streamName("expecting")
+	aID, otherID := newAggregateID(), newAggregateID()
+	mustCreate(t, es, eventstore.EmptyStreamWithName(name))
+
+	assert.Nil(t, es.AppendToExpecting(ctx, name, eventstore.NoStream, aggregateEvents(aID, 1, 2)))
+	assert.Nil(t, es.AppendToExpecting(ctx, name, eventstore.NoStream, aggregateEvents(otherID, 1, 1)))
+	assert.Nil(t, es.AppendToExpecting(ctx, name, eventstore.ExactVersion(2), aggregateEvents(aID, 3, 3)))
+	assert.Nil(t, es.AppendToExpecting(ctx, name, eventstore.AnyVersion, aggregateEvents(otherID, 2, 2)))
+
+	err := es.AppendToExpecting(ctx, name, eventstore.ExactVersion(2), aggregateEvents(aID, 3, 3))
+	conflict, ok := err.(*eventstore.ErrConcurrencyConflict)
+	if !ok {
+		t.Fatalf("expected *eventstore.ErrConcurrencyConflict but got: %+v", err)
+	}
+	assert.Equal(t, name, conflict.StreamName)
+	assert.Equal(t, aID, conflict.AggregateID)
+	assert.Equal(t, eventstore.ExactVersion(2), conflict.Expected)
+	assert.Equal(t, uint64(3), conflict.Actual)
+
+	assert.IsType(t, &eventstore.ErrConcurrencyConflict{}, es.AppendToExpecting(ctx, name, eventstore.NoStream, aggregateEvents(otherID, 3, 3)))
+	assert.Equal(t, eventstore.ErrStreamDoesNotExist, es.AppendToExpecting(ctx, streamName("missing"), eventstore.NoStream, aggregateEvents(aID, 1, 1)))
+}
+
+func testCommit(t *testing.T, es eventstore.EventStore) {
+	ctx := context.Background()
+	from, to := streamName("commit-from"), streamName("commit-to")
+	fromID, toID := newAggregateID(), newAggregateID()
+	mustCreate(t, es, eventstore.NewStreamWithName(from, eventstore.StreamMetadata{}, aggregateEvents(fromID, 1, 2)))
+	mustCreate(t, es, eventstore.EmptyStreamWithName(to))
+
+	all := func(name string) []string {
+		return names(t, es.Load(ctx, name, 0, 0, eventstore.MetadataMatcher{}))
+	}
+
+	{ // Every append is made.
+		uow := eventstore.NewUnitOfWork()
+		uow.AppendToExpecting(from, eventstore.ExactVersion(2), aggregateEvents(fromID, 3, 3))
+		uow.AppendToExpecting(to, eventstore.NoStream, aggregateEvents(toID, 1, 1))
+		// Later appends see the earlier ones.
+		uow.AppendToExpecting(to, eventstore.ExactVersion(1), aggregateEvents(toID, 2, 2))
+
+		assert.Nil(t, es.Commit(ctx, uow))
+		assert.Equal(t, []string{"event1", "event2", "event3"}, all(from))
+		assert.Equal(t, []string{"event1", "event2"}, all(to))
+	}
+
+	{ // A conflict means no append is made.
+		uow := eventstore.NewUnitOfWork()
+		uow.AppendToExpecting(from, eventstore.ExactVersion(3), aggregateEvents(fromID, 4, 4))
+		uow.AppendToExpecting(to, eventstore.ExactVersion(1), aggregateEvents(toID, 2, 2))
+
+		err := es.Commit(ctx, uow)
+		if conflict, ok := err.(*eventstore.ErrConcurrencyConflict); assert.True(t, ok, "expected a conflict got %v", err) {
+			assert.Equal(t, to, conflict.StreamName)
+			assert.Equal(t, uint64(2), conflict.Actual)
+		}
+		assert.Equal(t, []string{"event1", "event2", "event3"}, all(from))
+		assert.Equal(t, []string{"event1", "event2"}, all(to))
+	}
+
+	{ // As does a stream that does not exist.
+		uow := eventstore.NewUnitOfWork()
+		uow.AppendTo(from, aggregateEvents(fromID, 4, 4))
+		uow.AppendTo(streamName("missing"), aggregateEvents(newAggregateID(), 1, 1))
+
+		assert.Equal(t, eventstore.ErrStreamDoesNotExist, es.Commit(ctx, uow))
+		assert.Equal(t, []string{"event1", "event2", "event3"}, all(from))
+	}
+
+	assert.Nil(t, es.Commit(ctx, eventstore.NewUnitOfWork()))
+}
+
+func testLoad(t *testing.T, es eventstore.EventStore) {
+	ctx := context.Background()
+	name := streamName("load")
+	mustCreate(t, es, eventstore.NewStreamWithName(name, eventstore.StreamMetadata{}, aggregateEvents(newAggregateID(), 1, 8)))
+
+	assert.Equal(t, []string{"event1", "event2", "event3", "event4", "event5", "event6", "event7", "event8"}, names(t, es.Load(ctx, name, 0, 0, eventstore.MetadataMatcher{})))
+	assert.Equal(t, []string{"event3", "event4", "event5", "event6", "event7"}, names(t, es.Load(ctx, name, 2, 5, eventstore.MetadataMatcher{})))
+	assert.Equal(t, []string{"event7", "event8"}, names(t, es.Load(ctx, name, 6, 0, eventstore.MetadataMatcher{})))
+	assert.Equal(t, []string{}, names(t, es.Load(ctx, name, 8, 0, eventstore.MetadataMatcher{})))
+
+	{ // Rewinding starts from the beginning again.
+		it := es.Load(ctx, name, 0, 2, eventstore.MetadataMatcher{})
+		assert.Nil(t, it.Next(ctx))
+		assert.Nil(t, it.Next(ctx))
+		assert.Equal(t, eventstore.EOF, it.Next(ctx))
+		it.Rewind()
+		assert.Equal(t, []string{"event1", "event2"}, names(t, it))
+	}
+
+	{ // Loading a stream that does not exist.
+		it := es.Load(ctx, streamName("missing"), 0, 0, eventstore.MetadataMatcher{})
+		assert.Equal(t, eventstore.ErrStreamDoesNotExist, it.Next(ctx))
+		it.Close()
+	}
+}
+
+func testLoadReverse(t *testing.T, es eventstore.EventStore) {
+	ctx := context.Background()
+	name := streamName("reverse")
+	mustCreate(t, es, eventstore.NewStreamWithName(name, eventstore.StreamMetadata{}, aggregateEvents(newAggregateID(), 1, 8)))
+
+	assert.Equal(t, []string{"event8", "event7", "event6", "event5", "event4", "event3", "event2", "event1"}, names(t, es.LoadReverse(ctx, name, 0, 0, eventstore.MetadataMatcher{})))
+	assert.Equal(t, []string{"event6", "event5", "event4", "event3", "event2"}, names(t, es.LoadReverse(ctx, name, 2, 5, eventstore.MetadataMatcher{})))
+	assert.Equal(t, []string{"event2", "event1"}, names(t, es.LoadReverse(ctx, name, 6, 0, eventstore.MetadataMatcher{})))
+	assert.Equal(t, []string{}, names(t, es.LoadReverse(ctx, name, 8, 0, eventstore.MetadataMatcher{})))
+
+	{ // Loading a stream that does not exist.
+		it := es.LoadReverse(ctx, streamName("missing"), 0, 0, eventstore.MetadataMatcher{})
+		assert.Equal(t, eventstore.ErrStreamDoesNotExist, it.Next(ctx))
+		it.Close()
+	}
+}
+
+// Streams longer than the batch size of the store are read in full.
+func testLoadLongStream(t *testing.T, es eventstore.EventStore) {
+	ctx := context.Background()
+	name := streamName("long")
+	first, second := newAggregateID(), newAggregateID()
+	mustCreate(t, es, eventstore.EmptyStreamWithName(name))
+
+	const length = 1500
+	for v := uint64(1); v <= length; v += 250 {
+		mustAppend(t, es, name, aggregateEvents(first, v, v+249))
+	}
+	mustAppend(t, es, name, aggregateEvents(second, 1, 3))
+
+	expected := func(from, to uint64) []string {
+		out := []string{}
+		for v := from; v != to; {
+			out = append(out, fmt.Sprintf("event%d", v))
+			if from < to {
+				v++
+			} else {
+				v--
+			}
+		}
+		return out
+	}
+	byFirst := eventstore.MetadataMatcher{
+		string(messages.MetaAggregateID): eventstore.MetadataMatcherCondition{Operation: eventstore.MatchOpEq, Values: []string{first}},
+	}
+
+	assert.Equal(t, expected(1, length+1), names(t, es.Load(ctx, name, 0, 0, byFirst)))
+	assert.Equal(t, expected(length, 0), names(t, es.LoadReverse(ctx, name, 0, 0, byFirst)))
+	assert.Equal(t, expected(1001, 1301), names(t, es.Load(ctx, name, 1000, 300, byFirst)))
+	assert.Equal(t, expected(1200, 1), names(t, es.LoadReverse(ctx, name, 300, 1199, byFirst)))
+	assert.Len(t, names(t, es.Load(ctx, name, 0, 0, eventstore.MetadataMatcher{})), length+3)
+}
+
+func testRewind(t *testing.T, es eventstore.EventStore) {
+	ctx := context.Background()
+	name := streamName("rewind")
+	mustCreate(t, es, eventstore.NewStreamWithName(name, eventstore.StreamMetadata{}, aggregateEvents(newAggregateID(), 1, 5)))
+
+	for _, it := range []eventstore.StreamIterator{
+		es.Load(ctx, name, 1, 0, eventstore.MetadataMatcher{}),
+		es.LoadReverse(ctx, name, 1, 0, eventstore.MetadataMatcher{}),
+	} {
+		assert.Nil(t, it.Next(ctx))
+		assert.Nil(t, it.Next(ctx))
+		second := it.Current().MessageName()
+
+		it.Rewind()
+
+		assert.Nil(t, it.Next(ctx))
+		assert.Nil(t, it.Next(ctx))
+		assert.Equal(t, second, it.Current().MessageName())
+		it.Close()
+	}
+}
+
+func testLoadMatchers(t *testing.T, es eventstore.EventStore) {
+	ctx := context.Background()
+	name := streamName("matchers")
+	first, second, third := "11111111-0000-0000-0000-000000000000", "22222222-0000-0000-0000-000000000000", "33333333-0000-0000-0000-000000000000"
+	mustCreate(t, es, eventstore.EmptyStreamWithName(name))
+	mustAppend(t, es, name, []*messages.Event{
+		aggregateEvent(first, 1, "first1"),
+		aggregateEvent(second, 1, "second1"),
+		aggregateEvent(first, 2, "first2"),
+		aggregateEvent(third, 1, "third1"),
+	})
+
+	match := func(condition eventstore.MetadataMatcherCondition) eventstore.MetadataMatcher {
+		return eventstore.MetadataMatcher{
+			string(messages.MetaAggregateID): condition,
+		}
+	}
+	eq := match(eventstore.MetadataMatcherCondition{Operation: eventstore.MatchOpEq, Values: []string{first}})
+
+	assert.Equal(t, []string{"first1", "first2"}, names(t, es.Load(ctx, name, 0, 0, eq)))
+	assert.Equal(t, []string{"first2", "first1"}, names(t, es.LoadReverse(ctx, name, 0, 0, eq)))
+	assert.Equal(t, []string{"first1"}, names(t, es.Load(ctx, name, 0, 1, eq)))
+	assert.Equal(t, []string{"first1", "second1", "first2"}, names(t, es.Load(ctx, name, 0, 0, match(eventstore.MetadataMatcherCondition{
+		Operation: eventstore.MatchOpIn,
+		Values:    []string{first, second},
+	}))))
+	assert.Equal(t, []string{"second1", "third1"}, names(t, es.Load(ctx, name, 0, 0, match(eventstore.MetadataMatcherCondition{
+		Operation: eventstore.MatchOpNotIn,
+		Values:    []string{first},
+	}))))
+	assert.Equal(t, []string{"second1", "third1"}, names(t, es.Load(ctx, name, 0, 0, match(eventstore.MetadataMatcherCondition{
+		Operation: eventstore.MatchOpRegex,
+		Values:    []string{"^(2|3)"},
+	}))))
+	assert.Equal(t, []string{}, names(t, es.Load(ctx, name, 0, 0, match(eventstore.MetadataMatcherCondition{
+		Operation: eventstore.MatchOpEq,
+		Values:    []string{newAggregateID()},
+	}))))
+}
+
+// Matching on metadata keys other than the aggregate ones.
+func testLoadMetadataMatchers(t *testing.T, es eventstore.EventStore) {
+	ctx := context.Background()
+	name := streamName("metadata-matchers")
+	aID := newAggregateID()
+	mustCreate(t, es, eventstore.EmptyStreamWithName(name))
+
+	events := aggregateEvents(aID, 1, 3)
+	for i, tenant := range []string{"acme", "globex", "acme"} {
+		md := events[i].Metadata()
+		md[string(messages.MetaCorrelationID)] = fmt.Sprintf("correlation-%d", i+1)
+		md["tenant"] = tenant
+		md[`odd "key"`] = tenant
+		events[i] = messages.EventWithMetadata(events[i], md)
+	}
+	mustAppend(t, es, name, events)
+
+	eq := func(key, value string) eventstore.MetadataMatcher {
+		return eventstore.MetadataMatcher{
+			key: eventstore.MetadataMatcherCondition{Operation: eventstore.MatchOpEq, Values: []string{value}},
+		}
+	}
+
+	assert.Equal(t, []string{"event2"}, names(t, es.Load(ctx, name, 0, 0, eq(string(messages.MetaCorrelationID), "correlation-2"))))
+	assert.Equal(t, []string{"event1", "event3"}, names(t, es.Load(ctx, name, 0, 0, eq("tenant", "acme"))))
+	assert.Equal(t, []string{"event2"}, names(t, es.Load(ctx, name, 0, 0, eq(`odd "key"`, "globex"))))
+	assert.Equal(t, []string{}, names(t, es.Load(ctx, name, 0, 0, eq("missing", "acme"))))
+	assert.Equal(t, []string{"event3"}, names(t, es.Load(ctx, name, 0, 0, eventstore.MetadataMatcher{
+		"tenant": eventstore.MetadataMatcherCondition{Operation: eventstore.MatchOpEq, Values: []string{"acme"}},
+		string(messages.MetaCorrelationID): eventstore.MetadataMatcherCondition{
+			Operation: eventstore.MatchOpRegex,
+			Values:    []string{"-3$"},
+		},
+	})))
+}
+
+func testLoadComparisonMatchers(t *testing.T, es eventstore.EventStore) {
+	ctx := context.Background()
+	name := streamName("comparison-matchers")
+	aID := newAggregateID()
+	mustCreate(t, es, eventstore.EmptyStreamWithName(name))
+
+	events := aggregateEvents(aID, 1, 12)
+	for i, e := range events {
+		md := e.Metadata()
+		md["score"] = float64(i) * 1.5
+		if i%2 == 0 {
+			md["flag"] = "even"
+		}
+		events[i] = messages.EventWithMetadata(e, md)
+	}
+	mustAppend(t, es, name, events)
+
+	load := func(key string, condition eventstore.MetadataMatcherCondition) []string {
+		return names(t, es.Load(ctx, name, 0, 0, eventstore.MetadataMatcher{key: condition}))
+	}
+	version := string(messages.MetaAggregateVersion)
+
+	// Numeric comparisons compare numbers, otherwise strings are compared.
+	assert.Equal(t, []string{"event11", "event12"}, load(version, eventstore.MetadataMatcherCondition{Operation: eventstore.MatchOpGt, Values: []string{"10"}, Numeric: true}))
+	assert.Equal(t, []string{"event2", "event3", "event4", "event5", "event6", "event7", "event8", "event9"}, load(version, eventstore.MetadataMatcherCondition{Operation: eventstore.MatchOpGt, Values: []string{"12"}}))
+	assert.Equal(t, []string{"event10", "event11", "event12"}, load(version, eventstore.MetadataMatcherCondition{Operation: eventstore.MatchOpGte, Values: []string{"10"}, Numeric: true}))
+	assert.Equal(t, []string{"event1", "event2"}, load(version, eventstore.MetadataMatcherCondition{Operation: eventstore.MatchOpLt, Values: []string{"3"}, Numeric: true}))
+	assert.Equal(t, []string{"event1", "event2", "event3"}, load(version, eventstore.MetadataMatcherCondition{Operation: eventstore.MatchOpLte, Values: []string{"3"}, Numeric: true}))
+	assert.Equal(t, []string{"event3"}, load(version, eventstore.MetadataMatcherCondition{Operation: eventstore.MatchOpEq, Values: []string{"3.0"}, Numeric: true}))
+	assert.Equal(t, []string{"event2", "event4"}, load(version, eventstore.MetadataMatcherCondition{Operation: eventstore.MatchOpIn, Values: []string{"2", "4e0", "x"}, Numeric: true}))
+
+	// Non integer numbers in the metadata.
+	assert.Equal(t, []string{"event1", "event2", "event3"}, load("score", eventstore.MetadataMatcherCondition{Operation: eventstore.MatchOpLte, Values: []string{"3"}, Numeric: true}))
+	assert.Equal(t, []string{"event4"}, load("score", eventstore.MetadataMatcherCondition{Operation: eventstore.MatchOpEq, Values: []string{"4.5"}}))
+	assert.Equal(t, []string{}, load("score", eventstore.MetadataMatcherCondition{Operation: eventstore.MatchOpGt, Values: []string{"x"}, Numeric: true}))
+
+	// Values that are not numbers never match numeric conditions.
+	assert.Equal(t, []string{}, load("flag", eventstore.MetadataMatcherCondition{Operation: eventstore.MatchOpNotIn, Values: []string{"1"}, Numeric: true}))
+
+	// Existence.
+	assert.Equal(t, []string{"event1", "event3", "event5", "event7", "event9", "event11"}, load("flag", eventstore.MetadataMatcherCondition{Operation: eventstore.MatchOpExists}))
+	assert.Equal(t, []string{"event2", "event4", "event6", "event8", "event10", "event12"}, load("flag", eventstore.MetadataMatcherCondition{Operation: eventstore.MatchOpNotExists}))
+	assert.Equal(t, []string{}, load("missing", eventstore.MetadataMatcherCondition{Operation: eventstore.MatchOpExists}))
+}
+
+func testLoadPropertyMatchers(t *testing.T, es eventstore.EventStore) {
+	ctx := context.Background()
+	name := streamName("property-matchers")
+	aID := newAggregateID()
+	mustCreate(t, es, eventstore.EmptyStreamWithName(name))
+
+	start := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	events := aggregateEvents(aID, 1, 3)
+	for i, e := range events {
+		events[i] = messages.NewEvent(e.MessageID(), e.MessageName(), e.Data(), e.Metadata(), e.Version(), start.Add(time.Duration(i)*time.Hour))
+	}
+	mustAppend(t, es, name, events)
+
+	load := func(key string, condition eventstore.MetadataMatcherCondition) []string {
+		return names(t, es.Load(ctx, name, 0, 0, eventstore.MetadataMatcher{key: condition}))
+	}
+
+	assert.Equal(t, []string{"event2"}, load(eventstore.PropertyMessageID, eventstore.MetadataMatcherCondition{Operation: eventstore.MatchOpEq, Values: []string{events[1].MessageID()}}))
+	assert.Equal(t, []string{"event1", "event3"}, load(eventstore.PropertyMessageName, eventstore.MetadataMatcherCondition{Operation: eventstore.MatchOpIn, Values: []string{"event1", "event3"}}))
+	assert.Equal(t, []string{"event2", "event3"}, load(eventstore.PropertyCreatedAt, eventstore.MetadataMatcherCondition{Operation: eventstore.MatchOpGte, Values: []string{"2020-01-02T04:04:05Z"}}))
+	assert.Equal(t, []string{"event1"}, load(eventstore.PropertyCreatedAt, eventstore.MetadataMatcherCondition{Operation: eventstore.MatchOpLt, Values: []string{"2020-01-02T05:04:05+01:00"}}))
+	assert.Equal(t, []string{"event3"}, load(eventstore.PropertyCreatedAt, eventstore.MetadataMatcherCondition{Operation: eventstore.MatchOpEq, Values: []string{"2020-01-02T05:04:05.000000Z"}}))
+	assert.Equal(t, []string{"event2"}, load(eventstore.PropertyCreatedAt, eventstore.MetadataMatcherCondition{Operation: eventstore.MatchOpRegex, Values: []string{"T04:"}}))
+	assert.Equal(t, []string{}, load(eventstore.PropertyCreatedAt, eventstore.MetadataMatcherCondition{Operation: eventstore.MatchOpEq, Values: []string{"yesterday"}}))
+}
+
+func testStreamMetadata(t *testing.T, es eventstore.EventStore) {
+	ctx := context.Background()
+	name := streamName("metadata")
+	mustCreate(t, es, eventstore.NewStreamWithName(name, eventstore.StreamMetadata{"owner": "team-a"}, []*messages.Event{}))
+
+	md, err := es.FetchStreamMetadata(ctx, name)
+	assert.Nil(t, err)
+	assert.Equal(t, eventstore.StreamMetadata{"owner": "team-a"}, md)
+
+	assert.Nil(t, es.UpdateStreamMetadata(ctx, name, eventstore.StreamMetadata{"owner": "team-b", "tier": "gold"}))
+
+	md, err = es.FetchStreamMetadata(ctx, name)
+	assert.Nil(t, err)
+	assert.Equal(t, eventstore.StreamMetadata{"owner": "team-b", "tier": "gold"}, md)
+
+	missing := streamName("missing")
+	_, err = es.FetchStreamMetadata(ctx, missing)
+	assert.Equal(t, eventstore.ErrStreamDoesNotExist, err)
+	assert.Equal(t, eventstore.ErrStreamDoesNotExist, es.UpdateStreamMetadata(ctx, missing, eventstore.StreamMetadata{}))
+}
+
+func testFetchStreamNames(t *testing.T, es eventstore.EventStore) {
+	ctx := context.Background()
+	prefix := streamName("names")
+	for _, n := range []string{"a", "b", "c", "d"} {
+		tier := "silver"
+		if n == "b" || n == "d" {
+			tier = "gold"
+		}
+		mustCreate(t, es, eventstore.NewStreamWithName(prefix+"-"+n, eventstore.StreamMetadata{"tier": tier}, []*messages.Event{}))
+	}
+
+	fetch := func(filter string, matcher eventstore.MetadataMatcher, limit, offset uint64) []string {
+		out, err := es.FetchStreamNames(ctx, filter, matcher, limit, offset)
+		assert.Nil(t, err)
+		return out
+	}
+	gold := eventstore.MetadataMatcher{"tier": eventstore.MetadataMatcherCondition{Operation: eventstore.MatchOpEq, Values: []string{"gold"}}}
+
+	assert.Equal(t, []string{prefix + "-a", prefix + "-b", prefix + "-c", prefix + "-d"}, fetch(prefix, eventstore.MetadataMatcher{}, 0, 0))
+	assert.Equal(t, []string{prefix + "-b", prefix + "-c"}, fetch(prefix, eventstore.MetadataMatcher{}, 2, 1))
+	assert.Equal(t, []string{prefix + "-d"}, fetch(prefix, eventstore.MetadataMatcher{}, 10, 3))
+	assert.Equal(t, []string{prefix + "-b", prefix + "-d"}, fetch(prefix, gold, 0, 0))
+	assert.Equal(t, []string{prefix + "-d"}, fetch(prefix, gold, 1, 1))
+	assert.Equal(t, []string{}, fetch(streamName("missing"), eventstore.MetadataMatcher{}, 0, 0))
+}
+
+func testFetchStreamNamesRegex(t *testing.T, es eventstore.EventStore) {
+	ctx := context.Background()
+	prefix := streamName("regex")
+	for _, n := range []string{"a1", "b2", "c3"} {
+		mustCreate(t, es, eventstore.EmptyStreamWithName(prefix+"-"+n))
+	}
+
+	out, err := es.FetchStreamNamesRegex(ctx, "^"+prefix+"-[ab]", eventstore.MetadataMatcher{}, 0, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{prefix + "-a1", prefix + "-b2"}, out)
+
+	out, err = es.FetchStreamNamesRegex(ctx, "^"+prefix+"-.[23]$", eventstore.MetadataMatcher{}, 1, 1)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{prefix + "-c3"}, out)
+
+	_, err = es.FetchStreamNamesRegex(ctx, "(", eventstore.MetadataMatcher{}, 0, 0)
+	assert.NotNil(t, err)
+}
+
+func testDelete(t *testing.T, es eventstore.EventStore) {
+	ctx := context.Background()
+	name := streamName("delete")
+	mustCreate(t, es, eventstore.NewStreamWithName(name, eventstore.StreamMetadata{}, aggregateEvents(newAggregateID(), 1, 2)))
+
+	assert.Nil(t, es.Delete(ctx, name))
+	assert.Equal(t, eventstore.ErrStreamDoesNotExist, es.Delete(ctx, name))
+
+	it := es.Load(ctx, name, 0, 0, eventstore.MetadataMatcher{})
+	assert.Equal(t, eventstore.ErrStreamDoesNotExist, it.Next(ctx))
+	it.Close()
+
+	_, err := es.FetchStreamMetadata(ctx, name)
+	assert.Equal(t, eventstore.ErrStreamDoesNotExist, err)
+
+	// A deleted stream can be created again.
+	mustCreate(t, es, eventstore.EmptyStreamWithName(name))
+	assert.Equal(t, []string{}, names(t, es.Load(ctx, name, 0, 0, eventstore.MetadataMatcher{})))
+}
+
+func testRetention(t *testing.T, es eventstore.EventStore) {
+	ctx := context.Background()
+	name := streamName("retention")
+	aID := newAggregateID()
+	load := func() []string {
+		return names(t, es.Load(ctx, name, 0, 0, eventstore.MetadataMatcher{}))
+	}
+
+	old := aggregateEvent(aID, 1, "event1")
+	old = messages.NewEvent(old.MessageID(), old.MessageName(), old.Data(), old.Metadata(), old.Version(), time.Now().Add(-2*time.Hour))
+	events := append([]*messages.Event{old}, aggregateEvents(aID, 2, 5)...)
+	mustCreate(t, es, eventstore.NewStreamWithName(name, eventstore.StreamMetadata{eventstore.StreamMetaMaxCount: "3"}, events))
+
+	assert.Equal(t, []string{"event3", "event4", "event5"}, load())
+	assert.Equal(t, []string{"event5", "event4", "event3"}, names(t, es.LoadReverse(ctx, name, 0, 0, eventstore.MetadataMatcher{})))
+
+	assert.Nil(t, es.UpdateStreamMetadata(ctx, name, eventstore.StreamMetadata{eventstore.StreamMetaMaxAge: "1h"}))
+	assert.Equal(t, []string{"event2", "event3", "event4", "event5"}, load())
+
+	assert.Nil(t, es.UpdateStreamMetadata(ctx, name, eventstore.StreamMetadata{eventstore.StreamMetaTruncateBefore: "4"}))
+	assert.Equal(t, []string{"event4", "event5"}, load())
+
+	// Truncating can not be undone.
+	assert.Nil(t, es.UpdateStreamMetadata(ctx, name, eventstore.StreamMetadata{"owner": "team-a"}))
+	assert.Equal(t, []string{"event4", "event5"}, load())
+
+	md, err := es.FetchStreamMetadata(ctx, name)
+	assert.Nil(t, err)
+	assert.Equal(t, eventstore.StreamMetadata{"owner": "team-a", eventstore.StreamMetaTruncateBefore: "4"}, md)
+
+	invalid := eventstore.StreamMetadata{eventstore.StreamMetaMaxCount: "lots"}
+	assert.Equal(t, eventstore.ErrInvalidRetention, es.UpdateStreamMetadata(ctx, name, invalid))
+	assert.Equal(t, eventstore.ErrInvalidRetention, es.Create(ctx, eventstore.NewStreamWithName(streamName("retention"), invalid, []*messages.Event{})))
+}
+
+func testTruncate(t *testing.T, es eventstore.EventStore) {
+	ctx := context.Background()
+	name := streamName("truncate")
+	aID, bID := newAggregateID(), newAggregateID()
+	mustCreate(t, es, eventstore.EmptyStreamWithName(name))
+
+	mustAppend(t, es, name, []*messages.Event{aggregateEvent(bID, 1, "b1")})
+	mustAppend(t, es, name, []*messages.Event{aggregateEvent(aID, 1, "a1"), aggregateEvent(aID, 2, "a2")})
+	mustAppend(t, es, name, []*messages.Event{aggregateEvent(aID, 3, "a3")})
+
+	assert.Nil(t, es.Truncate(ctx, name, 3))
+	assert.Equal(t, []string{"a2", "a3"}, names(t, es.Load(ctx, name, 0, 0, eventstore.MetadataMatcher{})))
+
+	// Truncating before an earlier position does nothing.
+	assert.Nil(t, es.Truncate(ctx, name, 1))
+	assert.Equal(t, []string{"a2", "a3"}, names(t, es.Load(ctx, name, 0, 0, eventstore.MetadataMatcher{})))
+
+	// Aggregate versions are kept, even with no events left to read.
+	err := es.AppendToExpecting(ctx, name, eventstore.NoStream, []*messages.Event{aggregateEvent(bID, 1, "b1")})
+	assert.IsType(t, &eventstore.ErrConcurrencyConflict{}, err)
+	assert.Nil(t, es.AppendToExpecting(ctx, name, eventstore.ExactVersion(1), []*messages.Event{aggregateEvent(bID, 2, "b2")}))
+	assert.Nil(t, es.AppendToExpecting(ctx, name, eventstore.ExactVersion(3), []*messages.Event{aggregateEvent(aID, 4, "a4")}))
+	assert.Equal(t, []string{"a2", "a3", "b2", "a4"}, names(t, es.Load(ctx, name, 0, 0, eventstore.MetadataMatcher{})))
+
+	// Truncated events are not in the all stream.
+	matcher := eventstore.MetadataMatcher{
+		string(messages.MetaAggregateID): eventstore.MetadataMatcherCondition{
+			Operation: eventstore.MatchOpIn,
+			Values:    []string{aID, bID},
+		},
+	}
+	assert.Equal(t, []string{"a2", "a3", "b2", "a4"}, names(t, es.Load(ctx, eventstore.AllStreamName, 0, 0, matcher)))
+
+	assert.Equal(t, eventstore.ErrStreamDoesNotExist, es.Truncate(ctx, streamName("missing"), 1))
+}
+
+func testSoftDelete(t *testing.T, es eventstore.EventStore) {
+	ctx := context.Background()
+	name := streamName("soft-delete")
+	aID := newAggregateID()
+	mustCreate(t, es, eventstore.NewStreamWithName(name, eventstore.StreamMetadata{"owner": "team-a"}, aggregateEvents(aID, 1, 2)))
+
+	assert.Nil(t, es.SoftDelete(ctx, name))
+	assert.Equal(t, eventstore.ErrStreamDoesNotExist, es.SoftDelete(ctx, name))
+
+	it := es.Load(ctx, name, 0, 0, eventstore.MetadataMatcher{})
+	assert.Equal(t, eventstore.ErrStreamDoesNotExist, it.Next(ctx))
+	it.Close()
+
+	_, err := es.FetchStreamMetadata(ctx, name)
+	assert.Equal(t, eventstore.ErrStreamDoesNotExist, err)
+	assert.Equal(t, eventstore.ErrStreamDoesNotExist, es.AppendTo(ctx, name, aggregateEvents(aID, 3, 3)))
+
+	streams, err := es.FetchStreamNames(ctx, name, eventstore.MetadataMatcher{}, 0, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{}, streams)
+
+	// A soft deleted stream can be created again, carrying on from where it was.
+	mustCreate(t, es, eventstore.NewStreamWithName(name, eventstore.StreamMetadata{"owner": "team-b"}, aggregateEvents(aID, 3, 3)))
+
+	it = es.Load(ctx, name, 0, 0, eventstore.MetadataMatcher{})
+	if assert.Nil(t, it.Next(ctx)) {
+		assert.Equal(t, "event3", it.Current().MessageName())
+		assert.Equal(t, uint64(3), it.Current().Position())
+	}
+	assert.Equal(t, eventstore.EOF, it.Next(ctx))
+	it.Close()
+
+	err = es.AppendToExpecting(ctx, name, eventstore.NoStream, aggregateEvents(aID, 1, 1))
+	assert.IsType(t, &eventstore.ErrConcurrencyConflict{}, err)
+
+	md, err := es.FetchStreamMetadata(ctx, name)
+	assert.Nil(t, err)
+	assert.Equal(t, eventstore.StreamMetadata{"owner": "team-b", eventstore.StreamMetaTruncateBefore: "3"}, md)
+
+	assert.Equal(t, eventstore.ErrStreamAlreadyExists, es.Create(ctx, eventstore.EmptyStreamWithName(name)))
+	assert.Nil(t, es.Delete(ctx, name))
+}
+
+func testSubscribe(t *testing.T, es eventstore.EventStore) {
+	ctx := context.Background()
+	name := streamName("subscribe")
+	aID := newAggregateID()
+	mustCreate(t, es, eventstore.NewStreamWithName(name, eventstore.StreamMetadata{}, aggregateEvents(aID, 1, 2)))
+
+	_, err := es.Subscribe(ctx, streamName("missing"), 0, eventstore.MetadataMatcher{})
+	assert.Equal(t, eventstore.ErrStreamDoesNotExist, err)
+
+	sub, err := es.Subscribe(ctx, name, 1, eventstore.MetadataMatcher{})
+	if err != nil {
+		t.Fatalf("unable to subscribe: %s", err)
+	}
+	defer sub.Close()
+
+	next := func() *messages.Event {
+		select {
+		case e, ok := <-sub.Events():
+			if !ok {
+				t.Fatalf("subscription ended: %v", sub.Err())
+			}
+			return e
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for an event from the subscription")
+			return nil
+		}
+	}
+
+	e := next()
+	assert.Equal(t, "event2", e.MessageName())
+	assert.Equal(t, uint64(2), e.Position())
+
+	mustAppend(t, es, name, aggregateEvents(aID, 3, 3))
+
+	e = next()
+	assert.Equal(t, "event3", e.MessageName())
+	assert.Equal(t, uint64(3), e.Position())
+
+	sub.Close()
+	for range sub.Events() {
+	}
+	assert.Nil(t, sub.Err())
+}
+
+func testAllStream(t *testing.T, es eventstore.EventStore) {
+	ctx := context.Background()
+	first, second := streamName("all"), streamName("all")
+	aID := newAggregateID()
+	mustCreate(t, es, eventstore.EmptyStreamWithName(first))
+	mustCreate(t, es, eventstore.EmptyStreamWithName(second))
+
+	// Other tests may be writing to the same store, so only
+	// look at events for the aggregate used here.
+	matcher := eventstore.MetadataMatcher{
+		string(messages.MetaAggregateID): eventstore.MetadataMatcherCondition{
+			Operation: eventstore.MatchOpEq,
+			Values:    []string{aID},
+		},
+	}
+
+	mustAppend(t, es, first, []*messages.Event{aggregateEvent(aID, 1, "one")})
+	mustAppend(t, es, second, []*messages.Event{aggregateEvent(aID, 2, "two")})
+	mustAppend(t, es, first, []*messages.Event{aggregateEvent(aID, 3, "three")})
+
+	assert.Equal(t, []string{"one", "two", "three"}, names(t, es.Load(ctx, eventstore.AllStreamName, 0, 0, matcher)))
+	assert.Equal(t, []string{"three", "two", "one"}, names(t, es.LoadReverse(ctx, eventstore.AllStreamName, 0, 0, matcher)))
+
+	// Resuming from the global position of an event.
+	it := es.Load(ctx, eventstore.AllStreamName, 0, 0, matcher)
+	assert.Nil(t, it.Next(ctx))
+	position := it.Current().Position()
+	it.Close()
+	assert.Equal(t, []string{"two", "three"}, names(t, es.Load(ctx, eventstore.AllStreamName, position, 0, matcher)))
+
+	// Deleted streams are not in the all stream.
+	assert.Nil(t, es.Delete(ctx, second))
+	assert.Equal(t, []string{"one", "three"}, names(t, es.Load(ctx, eventstore.AllStreamName, 0, 0, matcher)))
+}
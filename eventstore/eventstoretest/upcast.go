@@ -0,0 +1,207 @@
+package eventstoretest
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-cqrses/cqrses/eventstore"
+	"github.com/go-cqrses/cqrses/messages"
+
+	"github.com/gofrs/uuid"
+	"github.com/stretchr/testify/assert"
+)
+
+type (
+	// UpcastingFactory returns an event store that applies the upcasters
+	// to events it loads, building payloads into maps.
+	UpcastingFactory func(t *testing.T, upcasters *eventstore.Upcasters) eventstore.EventStore
+)
+
+var (
+	errBrokenUpcaster = errors.New("broken upcaster")
+)
+
+// RunUpcastingSuite will test the event stores returned by the
+// factory apply upcasters when loading events.
+func RunUpcastingSuite(t *testing.T, factory UpcastingFactory) {
+	ctx := context.Background()
+	es := factory(t, testUpcasters())
+	name := streamName("upcast")
+	mustCreate(t, es, eventstore.EmptyStreamWithName(name))
+
+	mustAppend(t, es, name, []*messages.Event{
+		rawEvent("user_registered", map[string]interface{}{"name": "Ann Lee"}, 0),
+		rawEvent("user_pinged", map[string]interface{}{}, 0),
+		rawEvent("user_renamed_twice", map[string]interface{}{"names": []string{"Ann Ray", "Ann Roe"}}, 0),
+		rawEvent("user_registered", map[string]interface{}{"first": "Bob", "last": "Day", "email": "bob@example.com"}, 3),
+	})
+
+	{ // Events are upcast, split and dropped.
+		events := load(t, es.Load(ctx, name, 0, 0, eventstore.MetadataMatcher{}))
+		if assert.Len(t, events, 4) {
+			assert.Equal(t, "user_registered", events[0].MessageName())
+			assert.Equal(t, map[string]interface{}{"first": "Ann", "last": "Lee", "email": ""}, events[0].Data())
+			assert.Equal(t, uint64(3), eventstore.SchemaVersion(events[0].Metadata()))
+			assert.Equal(t, uint64(1), events[0].Position())
+
+			assert.Equal(t, "user_renamed", events[1].MessageName())
+			assert.Equal(t, map[string]interface{}{"name": "Ann Ray"}, events[1].Data())
+			assert.Equal(t, "user_renamed", events[2].MessageName())
+			assert.Equal(t, map[string]interface{}{"name": "Ann Roe"}, events[2].Data())
+			assert.Equal(t, uint64(3), events[1].Position())
+			assert.Equal(t, uint64(3), events[2].Position())
+			assert.Equal(t, uint64(1), events[1].Version())
+			assert.Equal(t, uint64(1), events[2].Version())
+
+			assert.Equal(t, "user_registered", events[3].MessageName())
+			assert.Equal(t, map[string]interface{}{"first": "Bob", "last": "Day", "email": "bob@example.com"}, events[3].Data())
+		}
+	}
+
+	{ // In reverse.
+		events := load(t, es.LoadReverse(ctx, name, 0, 0, eventstore.MetadataMatcher{}))
+		got := []string{}
+		for _, e := range events {
+			got = append(got, e.MessageName())
+		}
+		assert.Equal(t, []string{"user_registered", "user_renamed", "user_renamed", "user_registered"}, got)
+	}
+
+	{ // Upcasters that fail, or never finish, stop the iterator.
+		for eventName, expected := range map[string]error{"broken": errBrokenUpcaster, "ping": eventstore.ErrUpcastLoop} {
+			failing := streamName("upcast-" + eventName)
+			mustCreate(t, es, eventstore.EmptyStreamWithName(failing))
+			mustAppend(t, es, failing, []*messages.Event{rawEvent(eventName, map[string]interface{}{}, 0)})
+
+			it := es.Load(ctx, failing, 0, 0, eventstore.MetadataMatcher{})
+			assert.Equal(t, expected, it.Next(ctx))
+			it.Close()
+		}
+	}
+
+	{ // Subscriptions move past batches where every event is dropped.
+		dropped := streamName("upcast-dropped")
+		mustCreate(t, es, eventstore.EmptyStreamWithName(dropped))
+
+		events := []*messages.Event{}
+		for i := 0; i < 1100; i++ {
+			events = append(events, rawEvent("user_pinged", map[string]interface{}{}, 0))
+		}
+		mustAppend(t, es, dropped, append(events, rawEvent("user_registered", map[string]interface{}{"name": "Cat Fox"}, 0)))
+
+		sub, err := es.Subscribe(ctx, dropped, 0, eventstore.MetadataMatcher{})
+		if err != nil {
+			t.Fatalf("unable to subscribe: %s", err)
+		}
+		defer sub.Close()
+
+		select {
+		case e := <-sub.Events():
+			if assert.NotNil(t, e, "subscription ended: %v", sub.Err()) {
+				assert.Equal(t, "user_registered", e.MessageName())
+				assert.Equal(t, uint64(1101), e.Position())
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for an event from the subscription")
+		}
+	}
+}
+
+func testUpcasters() *eventstore.Upcasters {
+	u := eventstore.NewUpcasters()
+
+	// Version 2 split the name.
+	u.Register("user_registered", 1, func(e eventstore.RawEvent) ([]eventstore.RawEvent, error) {
+		var p struct{ Name string }
+		if err := json.Unmarshal(e.Payload, &p); err != nil {
+			return nil, err
+		}
+
+		parts := strings.SplitN(p.Name, " ", 2)
+		e.Payload, _ = json.Marshal(map[string]string{"first": parts[0], "last": parts[1]})
+		return []eventstore.RawEvent{e}, nil
+	})
+
+	// Version 3 added an email.
+	u.Register("user_registered", 2, func(e eventstore.RawEvent) ([]eventstore.RawEvent, error) {
+		var p map[string]interface{}
+		if err := json.Unmarshal(e.Payload, &p); err != nil {
+			return nil, err
+		}
+
+		p["email"] = ""
+		e.Payload, _ = json.Marshal(p)
+		e.Metadata[string(messages.MetaSchemaVersion)] = 3
+		return []eventstore.RawEvent{e}, nil
+	})
+
+	// Renaming twice is now two renames.
+	u.Register("user_renamed_twice", 1, func(e eventstore.RawEvent) ([]eventstore.RawEvent, error) {
+		var p struct{ Names []string }
+		if err := json.Unmarshal(e.Payload, &p); err != nil {
+			return nil, err
+		}
+
+		out := []eventstore.RawEvent{}
+		for _, n := range p.Names {
+			renamed := e
+			renamed.MessageName = "user_renamed"
+			renamed.Payload, _ = json.Marshal(map[string]string{"name": n})
+			out = append(out, renamed)
+		}
+		return out, nil
+	})
+
+	// Pings are no longer recorded.
+	u.Register("user_pinged", 1, func(eventstore.RawEvent) ([]eventstore.RawEvent, error) {
+		return nil, nil
+	})
+
+	u.Register("broken", 1, func(eventstore.RawEvent) ([]eventstore.RawEvent, error) {
+		return nil, errBrokenUpcaster
+	})
+
+	// Ping and pong upcast to each other forever.
+	for from, to := range map[string]string{"ping": "pong", "pong": "ping"} {
+		to := to
+		u.Register(from, 1, func(e eventstore.RawEvent) ([]eventstore.RawEvent, error) {
+			e.MessageName = to
+			return []eventstore.RawEvent{e}, nil
+		})
+	}
+
+	return u
+}
+
+// An event for a new aggregate with the schema version, if not 0.
+func rawEvent(name string, data map[string]interface{}, schemaVersion uint64) *messages.Event {
+	md := map[string]interface{}{
+		string(messages.MetaAggregateID):      newAggregateID(),
+		string(messages.MetaAggregateVersion): uint64(1),
+	}
+	if schemaVersion > 0 {
+		md[string(messages.MetaSchemaVersion)] = schemaVersion
+	}
+
+	return messages.NewEvent(uuid.Must(uuid.NewV4()).String(), name, data, md, 1, time.Now())
+}
+
+// Read every event from the iterator.
+func load(t *testing.T, it eventstore.StreamIterator) []*messages.Event {
+	defer it.Close()
+
+	out := []*messages.Event{}
+	for {
+		if err := it.Next(context.Background()); err != nil {
+			if err != eventstore.EOF {
+				t.Fatalf("unable to read from stream: %s", err)
+			}
+			return out
+		}
+		out = append(out, it.Current())
+	}
+}
@@ -0,0 +1,122 @@
+package eventstore
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-cqrses/cqrses/messages"
+)
+
+const (
+	// PropertyMessageID matches the ID of an event.
+	PropertyMessageID = "$message_id"
+	// PropertyMessageName matches the name of an event.
+	PropertyMessageName = "$message_name"
+	// PropertyCreatedAt matches the time an event was created, in UTC using
+	// CreatedAtFormat. Values to compare with can be any RFC 3339 time.
+	PropertyCreatedAt = "$created_at"
+
+	// CreatedAtFormat is the format created times are matched in, it
+	// has a fixed width so times sort the same way as strings.
+	CreatedAtFormat = "2006-01-02T15:04:05.000000Z07:00"
+
+	// NumberPattern is the format of values treated as numbers by
+	// conditions that are Numeric.
+	NumberPattern = `^[-+]?([0-9]+\.?[0-9]*|\.[0-9]+)([eE][-+]?[0-9]+)?$`
+)
+
+var (
+	numberRx = regexp.MustCompile(NumberPattern)
+)
+
+// ParseNumber parses a value in the format of NumberPattern.
+func ParseNumber(v string) (float64, bool) {
+	if !numberRx.MatchString(v) {
+		return 0, false
+	}
+
+	n, err := strconv.ParseFloat(v, 64)
+	return n, err == nil
+}
+
+// ParseCreatedAt parses a time to compare created times with.
+func ParseCreatedAt(v string) (time.Time, bool) {
+	t, err := time.Parse(time.RFC3339Nano, v)
+	return t, err == nil
+}
+
+func compareStrings(a, b string) (int, bool) {
+	return strings.Compare(a, b), true
+}
+
+func compareNumbers(a, b string) (int, bool) {
+	x, ok := ParseNumber(a)
+	if !ok {
+		return 0, false
+	}
+
+	y, ok := ParseNumber(b)
+	if !ok {
+		return 0, false
+	}
+
+	switch {
+	case x < y:
+		return -1, true
+	case x > y:
+		return 1, true
+	}
+	return 0, true
+}
+
+// Convert a metadata value to the string it is matched as.
+func metadataValueString(v interface{}) (string, bool) {
+	switch v := v.(type) {
+	case string:
+		return v, true
+	case bool:
+		return strconv.FormatBool(v), true
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64), true
+	case float32:
+		return strconv.FormatFloat(float64(v), 'f', -1, 32), true
+	case int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64:
+		return fmt.Sprint(v), true
+	case json.Number:
+		return v.String(), true
+	}
+	return "", false
+}
+
+// Get the value of an event property or metadata key.
+func eventValue(e *messages.Event, key string) (interface{}, bool) {
+	switch key {
+	case PropertyMessageID:
+		return e.MessageID(), true
+	case PropertyMessageName:
+		return e.MessageName(), true
+	case PropertyCreatedAt:
+		return e.Created().UTC().Format(CreatedAtFormat), true
+	}
+
+	v, ok := e.Metadata()[key]
+	return v, ok
+}
+
+// Copy the condition with the values in CreatedAtFormat so they compare
+// with created times, values that are not times are removed.
+func (m MetadataMatcherCondition) withCreatedAtValues() MetadataMatcherCondition {
+	values := make([]string, 0, len(m.Values))
+	for _, v := range m.Values {
+		if t, ok := ParseCreatedAt(v); ok {
+			values = append(values, t.UTC().Format(CreatedAtFormat))
+		}
+	}
+
+	m.Values = values
+	return m
+}
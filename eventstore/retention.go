@@ -0,0 +1,147 @@
+package eventstore
+
+import (
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/go-cqrses/cqrses/messages"
+)
+
+const (
+	// StreamMetaMaxCount is the stream metadata key for how many of the
+	// latest events in a stream can be read, older events are hidden.
+	StreamMetaMaxCount = "$maxCount"
+
+	// StreamMetaMaxAge is the stream metadata key for how old events in a
+	// stream can be before they are hidden, as a duration such as "720h".
+	StreamMetaMaxAge = "$maxAge"
+
+	// StreamMetaTruncateBefore is the stream metadata key for the position
+	// events are hidden before, it is set by Truncate and can only be moved
+	// forward.
+	StreamMetaTruncateBefore = "$truncateBefore"
+
+	// StreamMetaDeleted is the stream metadata key set by SoftDelete.
+	StreamMetaDeleted = "$deleted"
+)
+
+var (
+	// ErrInvalidRetention is returned when the retention stream
+	// metadata can not be parsed.
+	ErrInvalidRetention = errors.New("invalid stream retention metadata")
+)
+
+type (
+	// Retention decides which events of a stream can be read, events that
+	// are hidden stay in the stream until it is truncated.
+	Retention struct {
+		MaxCount       uint64
+		MaxAge         time.Duration
+		TruncateBefore uint64
+	}
+)
+
+// RetentionFromMetadata reads the retention from stream metadata, an
+// empty retention is returned when the metadata has none.
+func RetentionFromMetadata(md StreamMetadata) (Retention, error) {
+	r := Retention{}
+
+	if v, ok := md[StreamMetaMaxCount]; ok {
+		n, err := strconv.ParseUint(v, 10, 64)
+		if err != nil || n == 0 {
+			return Retention{}, ErrInvalidRetention
+		}
+		r.MaxCount = n
+	}
+
+	if v, ok := md[StreamMetaMaxAge]; ok {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			return Retention{}, ErrInvalidRetention
+		}
+		r.MaxAge = d
+	}
+
+	if v, ok := md[StreamMetaTruncateBefore]; ok {
+		n, err := strconv.ParseUint(v, 10, 64)
+		if err != nil {
+			return Retention{}, ErrInvalidRetention
+		}
+		r.TruncateBefore = n
+	}
+
+	return r, nil
+}
+
+// IsZero reports whether every event can be read.
+func (r Retention) IsZero() bool {
+	return r == Retention{}
+}
+
+// Visible returns the events that can be read from the events of a stream,
+// in order, at the time given.
+func (r Retention) Visible(events []*messages.Event, now time.Time) []*messages.Event {
+	if r.IsZero() {
+		return events
+	}
+
+	out := make([]*messages.Event, 0, len(events))
+	for _, e := range events {
+		if e.Position() < r.TruncateBefore {
+			continue
+		}
+
+		if r.MaxAge > 0 && e.Created().Before(now.Add(-r.MaxAge)) {
+			continue
+		}
+
+		out = append(out, e)
+	}
+
+	// The count includes events hidden by age, as they are still the latest.
+	if r.MaxCount > 0 {
+		first := len(events) - int(r.MaxCount)
+		for first > 0 && len(out) > 0 && out[0].Position() <= events[first-1].Position() {
+			out = out[1:]
+		}
+	}
+
+	return out
+}
+
+// IsSoftDeleted reports whether the stream metadata marks the stream as
+// soft deleted, it can be created again.
+func IsSoftDeleted(md StreamMetadata) bool {
+	return md[StreamMetaDeleted] != ""
+}
+
+// ValidateStreamMetadata checks the retention in stream metadata can be
+// parsed, event stores return the error when creating or updating streams.
+func ValidateStreamMetadata(md StreamMetadata) error {
+	_, err := RetentionFromMetadata(md)
+	return err
+}
+
+// WithTruncation returns the updated stream metadata keeping the truncate
+// before position of the current metadata, so truncating can not be undone
+// by updating the metadata. The soft delete marker is removed.
+func WithTruncation(current, updated StreamMetadata) StreamMetadata {
+	out := make(StreamMetadata, len(updated)+1)
+	for k, v := range updated {
+		out[k] = v
+	}
+	delete(out, StreamMetaDeleted)
+
+	before, _ := strconv.ParseUint(current[StreamMetaTruncateBefore], 10, 64)
+	if after, err := strconv.ParseUint(out[StreamMetaTruncateBefore], 10, 64); err == nil && after > before {
+		before = after
+	}
+
+	delete(out, StreamMetaTruncateBefore)
+	if before > 0 {
+		out[StreamMetaTruncateBefore] = strconv.FormatUint(before, 10)
+	}
+
+	return out
+}
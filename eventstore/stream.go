@@ -17,6 +17,18 @@ const (
 	MatchOpNotIn matchOp = "not_in"
 	// MatchOpRegex will check the value against the regular expression condition.
 	MatchOpRegex matchOp = "regex"
+	// MatchOpGt will check the value is greater than the condition value.
+	MatchOpGt matchOp = "gt"
+	// MatchOpGte will check the value is greater than or equal to the condition value.
+	MatchOpGte matchOp = "gte"
+	// MatchOpLt will check the value is less than the condition value.
+	MatchOpLt matchOp = "lt"
+	// MatchOpLte will check the value is less than or equal to the condition value.
+	MatchOpLte matchOp = "lte"
+	// MatchOpExists will check the key exists, the values are not used.
+	MatchOpExists matchOp = "exists"
+	// MatchOpNotExists will check the key does not exist, the values are not used.
+	MatchOpNotExists matchOp = "not_exists"
 )
 
 var (
@@ -34,10 +46,16 @@ type (
 	MetadataMatcherCondition struct {
 		Operation matchOp
 		Values    []string
+		// Numeric compares the values as numbers rather than strings, a
+		// value that is not a number never matches.
+		Numeric bool
 	}
 
 	// MetadataMatcher will match a string ID
 	// with the value using the operation provided.
+	//
+	// When matching events the keys PropertyMessageID, PropertyMessageName
+	// and PropertyCreatedAt match the event rather than its metadata.
 	MetadataMatcher map[string]MetadataMatcherCondition
 
 	// Stream is a struct used to create an initial stream, also
@@ -90,7 +108,7 @@ func (m MetadataMatcher) MatchStreamMetadata(in StreamMetadata) bool {
 	for k, matcher := range m {
 		v, ok := in[k]
 
-		if !ok || !matcher.Match(v) {
+		if !matcher.matchValue(v, ok) {
 			return false
 		}
 	}
@@ -99,37 +117,100 @@ func (m MetadataMatcher) MatchStreamMetadata(in StreamMetadata) bool {
 
 // MatchEventMetadata will test all keys that require their
 // values testing exist inside the metadata and then check
-// the value is valid. At this moment in time it will only
-// test string values.
+// the value is valid. String, number and boolean values
+// can be tested.
 func (m MetadataMatcher) MatchEventMetadata(in map[string]interface{}) bool {
 	for k, matcher := range m {
-		v, ok := in[k].(string)
+		v, ok := in[k]
+
+		if !matcher.matchValue(v, ok) {
+			return false
+		}
+	}
+	return true
+}
+
+// MatchEvent will test the event like MatchEventMetadata, also
+// testing the event properties.
+func (m MetadataMatcher) MatchEvent(e *messages.Event) bool {
+	for k, matcher := range m {
+		if k == PropertyCreatedAt && !matcher.Numeric && matcher.Operation != MatchOpRegex {
+			matcher = matcher.withCreatedAtValues()
+		}
 
-		if !ok || !matcher.Match(v) {
+		v, ok := eventValue(e, k)
+
+		if !matcher.matchValue(v, ok) {
 			return false
 		}
 	}
 	return true
 }
 
+// Test the value of a key, ok is false if the key does not exist.
+func (m MetadataMatcherCondition) matchValue(v interface{}, ok bool) bool {
+	switch m.Operation {
+	case MatchOpExists:
+		return ok
+	case MatchOpNotExists:
+		return !ok
+	}
+
+	s, isScalar := metadataValueString(v)
+	return ok && isScalar && m.Match(s)
+}
+
 // Match will test the provided value again the conditions
 // given in the metadata matcher condition.
 func (m MetadataMatcherCondition) Match(v string) bool {
+	compare := compareStrings
+	if m.Numeric {
+		if _, ok := ParseNumber(v); !ok {
+			return false
+		}
+		compare = compareNumbers
+	}
+
 	switch m.Operation {
 	case MatchOpIn:
 		for _, mv := range m.Values {
-			if mv == v {
+			if c, ok := compare(v, mv); ok && c == 0 {
 				return true
 			}
 		}
 		return false
 	case MatchOpNotIn:
 		for _, mv := range m.Values {
-			if mv == v {
+			if c, ok := compare(v, mv); ok && c == 0 {
 				return false
 			}
 		}
 		return true
+	case MatchOpGt, MatchOpGte, MatchOpLt, MatchOpLte:
+		// We expect only 1 possible value to compare against.
+		if len(m.Values) != 1 {
+			return false
+		}
+
+		c, ok := compare(v, m.Values[0])
+		if !ok {
+			return false
+		}
+
+		switch m.Operation {
+		case MatchOpGt:
+			return c > 0
+		case MatchOpGte:
+			return c >= 0
+		case MatchOpLt:
+			return c < 0
+		default:
+			return c <= 0
+		}
+	case MatchOpExists:
+		return true
+	case MatchOpNotExists:
+		return false
 	case MatchOpRegex:
 		// We expect only 1 possible value to match against.
 		if len(m.Values) != 1 {
@@ -144,6 +225,7 @@ func (m MetadataMatcherCondition) Match(v string) bool {
 			return false
 		}
 
-		return m.Values[0] == v
+		c, ok := compare(v, m.Values[0])
+		return ok && c == 0
 	}
 }
@@ -0,0 +1,189 @@
+package eventstore
+
+import (
+	"context"
+	"sync"
+
+	"github.com/go-cqrses/cqrses/messages"
+)
+
+type (
+	// Subscription delivers the events already in a stream followed by
+	// events as they are appended to the stream.
+	Subscription interface {
+		// Events returns the channel events are delivered on, the channel
+		// is closed when the subscription ends.
+		Events() <-chan *messages.Event
+
+		// Err returns the reason the subscription ended, it is nil while
+		// the subscription is running or if it was closed.
+		Err() error
+
+		// Close will end the subscription.
+		Close()
+	}
+
+	// SubscriptionLoader should load the next events after the
+	// position given, an empty iterator means there are no more.
+	SubscriptionLoader func(ctx context.Context, from uint64) StreamIterator
+
+	// ReadPositioner is implemented by iterators that can report the
+	// position of the last stored event they read, which is past the last
+	// event returned when upcasters drop events.
+	ReadPositioner interface {
+		ReadPosition() uint64
+	}
+
+	// SubscriptionWaiter should return a channel that is closed when
+	// more events may have been appended.
+	SubscriptionWaiter func() <-chan struct{}
+
+	subscription struct {
+		events chan *messages.Event
+		cancel context.CancelFunc
+		err    error
+		closed bool
+		lock   *sync.Mutex
+	}
+
+	// Broadcaster can be used by event stores to wake up subscriptions
+	// waiting for events to be appended.
+	Broadcaster struct {
+		waiting chan struct{}
+		lock    *sync.Mutex
+	}
+)
+
+// NewSubscription will start a subscription that delivers events after the
+// position given. Events are loaded using the loader until there are none
+// left, then it waits using the waiter before loading again. Event stores
+// can use this to implement Subscribe.
+func NewSubscription(ctx context.Context, from uint64, load SubscriptionLoader, wait SubscriptionWaiter) Subscription {
+	ctx, cancel := context.WithCancel(ctx)
+	s := &subscription{
+		events: make(chan *messages.Event),
+		cancel: cancel,
+		lock:   &sync.Mutex{},
+	}
+
+	go s.run(ctx, from, load, wait)
+
+	return s
+}
+
+// Events returns the channel events are delivered on.
+func (s *subscription) Events() <-chan *messages.Event {
+	return s.events
+}
+
+// Err returns the reason the subscription ended.
+func (s *subscription) Err() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return s.err
+}
+
+// Close will end the subscription.
+func (s *subscription) Close() {
+	s.lock.Lock()
+	s.closed = true
+	s.lock.Unlock()
+
+	s.cancel()
+}
+
+func (s *subscription) run(ctx context.Context, position uint64, load SubscriptionLoader, wait SubscriptionWaiter) {
+	defer close(s.events)
+
+	for {
+		// Start waiting before loading so an append between
+		// loading and waiting is not missed.
+		more := wait()
+
+		moved, err := s.deliver(ctx, load(ctx, position), &position)
+		if err != nil {
+			s.fail(err)
+			return
+		}
+
+		if moved {
+			continue
+		}
+
+		select {
+		case <-ctx.Done():
+			s.fail(ctx.Err())
+			return
+		case <-more:
+		}
+	}
+}
+
+// Deliver the events of the iterator, returning whether the position moved.
+// The position moves past events dropped by upcasters so they are not loaded
+// again.
+func (s *subscription) deliver(ctx context.Context, it StreamIterator, position *uint64) (bool, error) {
+	defer it.Close()
+
+	moved := false
+	for {
+		if err := it.Next(ctx); err != nil {
+			if err != EOF {
+				return moved, err
+			}
+
+			if rp, ok := it.(ReadPositioner); ok && rp.ReadPosition() > *position {
+				*position = rp.ReadPosition()
+				moved = true
+			}
+			return moved, nil
+		}
+
+		event := it.Current()
+		select {
+		case <-ctx.Done():
+			return moved, ctx.Err()
+		case s.events <- event:
+		}
+
+		*position = event.Position()
+		moved = true
+	}
+}
+
+func (s *subscription) fail(err error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	// A subscription closed by the subscriber did not fail.
+	if s.closed {
+		return
+	}
+	s.err = err
+}
+
+// NewBroadcaster returns a new broadcaster.
+func NewBroadcaster() *Broadcaster {
+	return &Broadcaster{
+		waiting: make(chan struct{}),
+		lock:    &sync.Mutex{},
+	}
+}
+
+// Wait returns a channel that is closed on the next broadcast.
+func (b *Broadcaster) Wait() <-chan struct{} {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	return b.waiting
+}
+
+// Broadcast wakes up everyone waiting.
+func (b *Broadcaster) Broadcast() {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	close(b.waiting)
+	b.waiting = make(chan struct{})
+}
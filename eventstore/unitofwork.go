@@ -0,0 +1,70 @@
+package eventstore
+
+import (
+	"sync"
+
+	"github.com/go-cqrses/cqrses/messages"
+)
+
+type (
+	// PendingAppend is an append waiting in a unit of work.
+	PendingAppend struct {
+		StreamName string
+		Expected   ExpectedVersion
+		Events     []*messages.Event
+	}
+
+	// UnitOfWork collects appends to one or more streams so they can be
+	// committed together using EventStore.Commit, either every append is
+	// made or none are.
+	UnitOfWork struct {
+		appends []PendingAppend
+		lock    *sync.Mutex
+	}
+)
+
+// NewUnitOfWork returns an empty unit of work.
+func NewUnitOfWork() *UnitOfWork {
+	return &UnitOfWork{
+		appends: []PendingAppend{},
+		lock:    &sync.Mutex{},
+	}
+}
+
+// AppendTo will append events to the stream when the unit of work is committed.
+func (u *UnitOfWork) AppendTo(streamName string, events []*messages.Event) {
+	u.AppendToExpecting(streamName, AnyVersion, events)
+}
+
+// AppendToExpecting will append events to the stream when the unit of work is
+// committed, if the stream or aggregate is at the expected version. Appends are
+// made in order so the version includes earlier appends in the unit of work.
+func (u *UnitOfWork) AppendToExpecting(streamName string, expected ExpectedVersion, events []*messages.Event) {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+
+	u.appends = append(u.appends, PendingAppend{
+		StreamName: streamName,
+		Expected:   expected,
+		Events:     events,
+	})
+}
+
+// Appends returns the appends in the order they were added.
+func (u *UnitOfWork) Appends() []PendingAppend {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+
+	out := make([]PendingAppend, len(u.appends))
+	copy(out, u.appends)
+	return out
+}
+
+// Events returns the events of every append in the order they were added.
+func (u *UnitOfWork) Events() []*messages.Event {
+	events := []*messages.Event{}
+	for _, a := range u.Appends() {
+		events = append(events, a.Events...)
+	}
+	return events
+}
@@ -0,0 +1,226 @@
+package eventstore
+
+import (
+	"encoding/json"
+	"errors"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/go-cqrses/cqrses/messages"
+)
+
+const (
+	// How many times an event can be upcast, more means
+	// the upcasters are likely going round in circles.
+	maxUpcastDepth = 100
+)
+
+var (
+	// ErrUpcastLoop is returned when an event is upcast too many times.
+	ErrUpcastLoop = errors.New("event upcast too many times, check upcasters do not loop")
+)
+
+type (
+	// RawEvent is a stored event before its payload has been built.
+	RawEvent struct {
+		MessageID   string
+		MessageName string
+		Payload     []byte
+		Metadata    map[string]interface{}
+		Version     uint64
+		Created     time.Time
+		Position    uint64
+	}
+
+	// Upcaster transforms an event at an old schema version into the events
+	// that replace it, which can be none to drop the event or several to split
+	// it. The replacements are upcast again until no upcaster applies.
+	//
+	// Replacements keep the version of the event they replace, unless the
+	// upcaster changes it, so the events split from an event share its
+	// aggregate version and a dropped event leaves a gap in the versions.
+	// Aggregates loaded from upcast events apply them in stream order.
+	Upcaster func(RawEvent) ([]RawEvent, error)
+
+	// Upcasters is a chain of upcasters by event name and schema version, the
+	// schema version is read from the messages.MetaSchemaVersion metadata.
+	Upcasters struct {
+		upcasters map[string]map[uint64]Upcaster
+		lock      *sync.RWMutex
+	}
+)
+
+// NewUpcasters returns an empty upcaster chain.
+func NewUpcasters() *Upcasters {
+	return &Upcasters{
+		upcasters: map[string]map[uint64]Upcaster{},
+		lock:      &sync.RWMutex{},
+	}
+}
+
+// Register the upcaster for events with the name at the schema version.
+//
+// When a replacement event has the same name it is given the next schema
+// version, unless the upcaster set a later one.
+func (u *Upcasters) Register(eventName string, schemaVersion uint64, upcaster Upcaster) {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+
+	if _, ok := u.upcasters[eventName]; !ok {
+		u.upcasters[eventName] = map[uint64]Upcaster{}
+	}
+	u.upcasters[eventName][schemaVersion] = upcaster
+}
+
+func (u *Upcasters) get(eventName string, schemaVersion uint64) (Upcaster, bool) {
+	if u == nil {
+		return nil, false
+	}
+
+	u.lock.RLock()
+	defer u.lock.RUnlock()
+
+	up, ok := u.upcasters[eventName][schemaVersion]
+	return up, ok
+}
+
+// Upcast the raw event into the events at their current schema versions,
+// the replacement events have the position of the event, and its version
+// unless the upcaster set another.
+func (u *Upcasters) Upcast(e RawEvent) ([]RawEvent, error) {
+	type queued struct {
+		event RawEvent
+		depth int
+	}
+
+	out := []RawEvent{}
+	queue := []queued{{event: e}}
+
+	for len(queue) > 0 {
+		next := queue[0]
+		queue = queue[1:]
+
+		version := SchemaVersion(next.event.Metadata)
+		up, ok := u.get(next.event.MessageName, version)
+		if !ok {
+			out = append(out, next.event)
+			continue
+		}
+
+		if next.depth == maxUpcastDepth {
+			return nil, ErrUpcastLoop
+		}
+
+		in := next.event
+		in.Metadata = copyMetadata(in.Metadata)
+		replacements, err := up(in)
+		if err != nil {
+			return nil, err
+		}
+
+		upcast := make([]queued, len(replacements))
+		for i, r := range replacements {
+			if r.Metadata == nil {
+				r.Metadata = map[string]interface{}{}
+			}
+
+			if r.MessageName == next.event.MessageName && SchemaVersion(r.Metadata) <= version {
+				r.Metadata = copyMetadata(r.Metadata)
+				r.Metadata[string(messages.MetaSchemaVersion)] = version + 1
+			}
+
+			r.Position = next.event.Position
+			upcast[i] = queued{event: r, depth: next.depth + 1}
+		}
+		queue = append(upcast, queue...)
+	}
+
+	return out, nil
+}
+
+// Build the events for a raw event once it has been upcast, see RawEvent.Build.
+func (u *Upcasters) Build(e RawEvent, payloadBuilder messages.PayloadBuilder) ([]*messages.Event, error) {
+	raw, err := u.Upcast(e)
+	if err != nil {
+		return nil, err
+	}
+
+	events := make([]*messages.Event, len(raw))
+	for i, r := range raw {
+		if events[i], err = r.Build(payloadBuilder); err != nil {
+			return nil, err
+		}
+	}
+	return events, nil
+}
+
+// UpcastEvent upcasts an event that has already been built, the payload is
+// converted to JSON and the replacement events are built again. The event is
+// returned as it is when no upcaster applies to it.
+func (u *Upcasters) UpcastEvent(e *messages.Event, payloadBuilder messages.PayloadBuilder) ([]*messages.Event, error) {
+	if _, ok := u.get(e.MessageName(), SchemaVersion(e.Metadata())); !ok {
+		return []*messages.Event{e}, nil
+	}
+
+	payload, err := json.Marshal(e.Data())
+	if err != nil {
+		return nil, err
+	}
+
+	return u.Build(RawEvent{
+		MessageID:   e.MessageID(),
+		MessageName: e.MessageName(),
+		Payload:     payload,
+		Metadata:    e.Metadata(),
+		Version:     e.Version(),
+		Created:     e.Created(),
+		Position:    e.Position(),
+	}, payloadBuilder)
+}
+
+// Build the event, using the payload builder for the payload when it can
+// otherwise the payload is decoded into a map.
+func (e RawEvent) Build(payloadBuilder messages.PayloadBuilder) (*messages.Event, error) {
+	var data interface{}
+	var ok bool
+
+	if payloadBuilder != nil {
+		data, ok = payloadBuilder.Build(e.MessageName, e.Payload)
+	}
+
+	if !ok {
+		var m map[string]interface{}
+		if err := json.Unmarshal(e.Payload, &m); err != nil {
+			return nil, err
+		}
+		data = m
+	}
+
+	return messages.EventWithPosition(
+		messages.NewEvent(e.MessageID, e.MessageName, data, e.Metadata, e.Version, e.Created),
+		e.Position,
+	), nil
+}
+
+// SchemaVersion returns the schema version in the metadata, 1 if it has none.
+func SchemaVersion(metadata map[string]interface{}) uint64 {
+	s, ok := metadataValueString(metadata[string(messages.MetaSchemaVersion)])
+	if !ok {
+		return 1
+	}
+
+	v, err := strconv.ParseUint(s, 10, 64)
+	if err != nil || v == 0 {
+		return 1
+	}
+	return v
+}
+
+func copyMetadata(in map[string]interface{}) map[string]interface{} {
+	out := make(map[string]interface{}, len(in))
+	for k, v := range in {
+		out[k] = v
+	}
+	return out
+}
@@ -0,0 +1,49 @@
+package eventstore
+
+import (
+	"github.com/go-cqrses/cqrses/messages"
+)
+
+const (
+	// AnyVersion will append events without checking the current version.
+	AnyVersion ExpectedVersion = -1
+
+	// NoStream expects nothing to have been written yet, for an aggregate
+	// this means there are no events for the aggregate ID.
+	NoStream ExpectedVersion = 0
+)
+
+type (
+	// ExpectedVersion is the version a writer expects a stream, or an
+	// aggregate within a stream, to be at when appending events.
+	//
+	// When the events being appended carry the aggregate ID metadata the
+	// version is the aggregate version of the last event recorded for that
+	// aggregate, otherwise the version is the position of the last event in
+	// the stream.
+	ExpectedVersion int64
+)
+
+// ExactVersion expects the current version to be exactly v.
+func ExactVersion(v uint64) ExpectedVersion {
+	return ExpectedVersion(v)
+}
+
+// Matches will check the actual version satisfies the expectation.
+func (v ExpectedVersion) Matches(actual uint64) bool {
+	if v == AnyVersion {
+		return true
+	}
+	return uint64(v) == actual
+}
+
+// AggregateIDFromEvents returns the aggregate ID the events belong to, the
+// second return value is false if the events do not belong to an aggregate.
+func AggregateIDFromEvents(events []*messages.Event) (string, bool) {
+	if len(events) == 0 {
+		return "", false
+	}
+
+	aID, ok := events[0].Metadata()[string(messages.MetaAggregateID)].(string)
+	return aID, ok && aID != ""
+}
@@ -32,9 +32,7 @@ type (
 )
 
 func registerCommandBusHandlers(cmdBus *bus.CommandBus) {
-	cmdHandler := aggregate.Make(func() aggregate.State {
-		return &user{}
-	}, "users")
+	cmdHandler := aggregate.Make(newUser, "users")
 
 	cmdBus.Register(createUserCommand, cmdHandler)
 	cmdBus.Register(changeUserPasswordCommand, cmdHandler)
@@ -34,9 +34,16 @@ type (
 		password     string
 		created      time.Time
 		removed      bool
+		appliers     *aggregate.Appliers
 	}
 )
 
+func newUser() aggregate.State {
+	u := &user{}
+	u.appliers = aggregate.NewAppliers().Methods(u)
+	return u
+}
+
 func (u *user) Handle(ctx context.Context, msg messages.Message, er aggregate.EventRecorder) error {
 	switch cmd := msg.Data().(type) {
 	case *createUserPayload:
@@ -69,14 +76,17 @@ func (u *user) Handle(ctx context.Context, msg messages.Message, er aggregate.Ev
 }
 
 func (u *user) Apply(msg *messages.Event) error {
-	switch event := msg.Data().(type) {
-	case *userCreatedPayload:
-		u.id = event.UserID
-		u.emailAddress = event.EmailAddress
-		u.password = event.Password
-		u.created = msg.Created()
-		u.removed = false
-	}
+	return u.appliers.Apply(msg)
+}
 
-	return nil
+func (u *user) ApplyUserCreated(event *userCreatedPayload, msg *messages.Event) {
+	u.id = event.UserID
+	u.emailAddress = event.EmailAddress
+	u.password = event.Password
+	u.created = msg.Created()
+	u.removed = false
+}
+
+func (u *user) ApplyUserPasswordChanged(event *userPasswordChangedPayload) {
+	u.password = event.Password
 }
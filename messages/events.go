@@ -16,6 +16,7 @@ type (
 		metadata    map[string]interface{}
 		version     uint64
 		created     time.Time
+		position    uint64
 	}
 )
 
@@ -93,6 +94,13 @@ func (e *Event) Created() time.Time {
 	return e.created
 }
 
+// Position returns the position of the event in the stream it was loaded
+// from, positions start from 1 and 0 means the event was not loaded from
+// a stream.
+func (e *Event) Position() uint64 {
+	return e.position
+}
+
 // EventWithMetadata returns an event copied from the previous
 // event with the updated metadata.
 func EventWithMetadata(e *Event, m map[string]interface{}) *Event {
@@ -110,3 +118,12 @@ func EventWithVersion(e *Event, v uint64) *Event {
 	em.version = v
 	return em
 }
+
+// EventWithPosition returns an event copied from the previous
+// event with the updated position.
+func EventWithPosition(e *Event, p uint64) *Event {
+	em := &Event{}
+	*em = *e
+	em.position = p
+	return em
+}
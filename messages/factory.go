@@ -17,4 +17,10 @@ type (
 		Build(msgName string, pl []byte) (interface{}, bool)
 		Builds(msgName string, with dataTypeFactory)
 	}
+
+	// ContentTyper can be implemented by a MessageFactory to give the media
+	// type of the messages it serialises.
+	ContentTyper interface {
+		ContentType() string
+	}
 )
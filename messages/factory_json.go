@@ -59,6 +59,11 @@ func (f *JSONMessageFactory) Build(msgName string, pl []byte) (interface{}, bool
 	return out, json.Unmarshal(pl, &out) == nil
 }
 
+// ContentType of the serialised messages.
+func (f *JSONMessageFactory) ContentType() string {
+	return "application/json"
+}
+
 // Serialize ...
 func (f *JSONMessageFactory) Serialize(m Message) ([]byte, error) {
 	return json.Marshal(JSONMessage{
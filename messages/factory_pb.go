@@ -44,6 +44,11 @@ func (f *ProtoMessageFactory) Build(msgName string, pl []byte) (interface{}, boo
 	return out, proto.Unmarshal(pl, out) == nil
 }
 
+// ContentType of the serialised messages.
+func (f *ProtoMessageFactory) ContentType() string {
+	return "application/x-protobuf"
+}
+
 // Serialize ...
 func (f *ProtoMessageFactory) Serialize(m Message) ([]byte, error) {
 	d, _ := proto.Marshal(m.Data().(proto.Message))
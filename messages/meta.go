@@ -21,4 +21,12 @@ const (
 	// example if you've loaded an aggregate at version 6 the next version should be 7.
 	// Versions start from 1!
 	MetaAggregateVersion metaKey = "aggregate_version"
+
+	// MetaSchemaVersion is the version of the shape of an event's payload and metadata,
+	// events without one are at version 1. See eventstore.Upcasters.
+	MetaSchemaVersion metaKey = "schema_version"
+
+	// MetaEncryptedFields lists the payload fields of an event that are encrypted with
+	// the key of the event's aggregate. See the shredding package.
+	MetaEncryptedFields metaKey = "encrypted_fields"
 )
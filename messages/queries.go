@@ -0,0 +1,57 @@
+package messages
+
+import (
+	"time"
+)
+
+type (
+	// Query asks for information without changing anything.
+	Query struct {
+		messageID   string
+		messageName string
+		data        interface{}
+		metadata    map[string]interface{}
+		created     time.Time
+	}
+)
+
+// NewQuery will return an immutable query.
+func NewQuery(id, name string, data interface{}, metadata map[string]interface{}, created time.Time) *Query {
+	return &Query{
+		messageID:   id,
+		messageName: name,
+		data:        data,
+		metadata:    metadata,
+		created:     created,
+	}
+}
+
+// MessageID returns the id of the message.
+func (q *Query) MessageID() string {
+	return q.messageID
+}
+
+// MessageName returns the name of the message.
+func (q *Query) MessageName() string {
+	return q.messageName
+}
+
+// Data will return the parameters of the query.
+func (q *Query) Data() interface{} {
+	return q.data
+}
+
+// Metadata will return metadata about the query.
+func (q *Query) Metadata() map[string]interface{} {
+	return q.metadata
+}
+
+// Version is always 0, queries are not versioned.
+func (q *Query) Version() uint64 {
+	return 0
+}
+
+// Created returns the time the query was created.
+func (q *Query) Created() time.Time {
+	return q.created
+}
@@ -0,0 +1,96 @@
+package messages
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"sync"
+)
+
+var (
+	// ErrNameRegistered is returned when registering a message name or
+	// payload type that is already registered.
+	ErrNameRegistered = errors.New("message name already registered")
+
+	// ErrTypeNotRegistered is returned when no message name is registered
+	// for a payload type.
+	ErrTypeNotRegistered = errors.New("payload type not registered")
+)
+
+type (
+	// Registry maps message names to the payload types of the messages, so
+	// handlers can be registered and messages created using the type alone.
+	Registry struct {
+		names map[reflect.Type]string
+		types map[string]reflect.Type
+		lock  *sync.RWMutex
+	}
+)
+
+// NewRegistry returns an empty registry.
+func NewRegistry() *Registry {
+	return &Registry{
+		names: map[reflect.Type]string{},
+		types: map[string]reflect.Type{},
+		lock:  &sync.RWMutex{},
+	}
+}
+
+// Register the message name for the payload type T, each name and type can
+// only be registered once.
+func Register[T any](r *Registry, name string) error {
+	t := reflect.TypeOf((*T)(nil)).Elem()
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if _, ok := r.types[name]; ok {
+		return fmt.Errorf("%w: %s", ErrNameRegistered, name)
+	}
+	if existing, ok := r.names[t]; ok {
+		return fmt.Errorf("%w: %s is registered as %s", ErrNameRegistered, t, existing)
+	}
+
+	r.names[t] = name
+	r.types[name] = t
+	return nil
+}
+
+// NameFor returns the message name registered for the payload type T.
+func NameFor[T any](r *Registry) (string, error) {
+	return r.name(reflect.TypeOf((*T)(nil)).Elem())
+}
+
+// NameOf returns the message name registered for the type of the payload.
+func (r *Registry) NameOf(data interface{}) (string, error) {
+	return r.name(reflect.TypeOf(data))
+}
+
+func (r *Registry) name(t reflect.Type) (string, error) {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	name, ok := r.names[t]
+	if !ok {
+		return "", fmt.Errorf("%w: %s", ErrTypeNotRegistered, t)
+	}
+	return name, nil
+}
+
+// Builds registers every pointer payload type with the payload builder, so
+// payloads are built as the type registered for their name.
+func (r *Registry) Builds(pb PayloadBuilder) {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	for name, t := range r.types {
+		if t.Kind() != reflect.Ptr {
+			continue
+		}
+
+		elem := t.Elem()
+		pb.Builds(name, func() interface{} {
+			return reflect.New(elem).Interface()
+		})
+	}
+}
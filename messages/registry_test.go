@@ -0,0 +1,39 @@
+package messages_test
+
+import (
+	"testing"
+
+	"github.com/go-cqrses/cqrses/messages"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type userRegistered struct {
+	Email string `json:"email"`
+}
+
+func TestRegistry(t *testing.T) {
+	r := messages.NewRegistry()
+	assert.Nil(t, messages.Register[*userRegistered](r, "user.registered"))
+
+	// Names and types are only registered once.
+	assert.ErrorIs(t, messages.Register[map[string]interface{}](r, "user.registered"), messages.ErrNameRegistered)
+	assert.ErrorIs(t, messages.Register[*userRegistered](r, "user.created"), messages.ErrNameRegistered)
+
+	name, err := messages.NameFor[*userRegistered](r)
+	assert.Nil(t, err)
+	assert.Equal(t, "user.registered", name)
+
+	name, err = r.NameOf(&userRegistered{})
+	assert.Nil(t, err)
+	assert.Equal(t, "user.registered", name)
+
+	_, err = r.NameOf(userRegistered{})
+	assert.ErrorIs(t, err, messages.ErrTypeNotRegistered)
+
+	pb := messages.NewJSONMessageFactory()
+	r.Builds(pb)
+	data, ok := pb.Build("user.registered", []byte(`{"email":"ann@example.com"}`))
+	assert.True(t, ok)
+	assert.Equal(t, &userRegistered{Email: "ann@example.com"}, data)
+}
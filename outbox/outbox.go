@@ -0,0 +1,179 @@
+// Package outbox relays events written to an outbox, in the same transaction
+// as the events were appended, to a publisher. Entries are only marked
+// delivered once published so every event is published at least once, even
+// if the relay stops part way through.
+package outbox
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/go-cqrses/cqrses/bus"
+	"github.com/go-cqrses/cqrses/messages"
+)
+
+type (
+	// Entry is an event waiting in the outbox to be published.
+	Entry struct {
+		// The ID of the entry, entries are read in ID order.
+		ID uint64
+		// The name of the stream the event was appended to.
+		StreamName string
+		// The event to publish.
+		Event *messages.Event
+	}
+
+	// Store contains the methods a relay uses to read the outbox.
+	Store interface {
+		// Pending returns up to limit entries that have not been
+		// delivered, oldest first.
+		Pending(ctx context.Context, limit uint64) ([]*Entry, error)
+
+		// MarkDelivered will stop the entries being returned as pending.
+		MarkDelivered(ctx context.Context, ids ...uint64) error
+	}
+
+	// Publisher publishes the event of an entry, for example to an event bus
+	// or a message broker. Entries may be published more than once.
+	Publisher interface {
+		Publish(ctx context.Context, e *Entry) error
+	}
+
+	// PublisherFunc is a function used as a Publisher.
+	PublisherFunc func(ctx context.Context, e *Entry) error
+
+	// Relay reads pending entries from the outbox and publishes them in
+	// order. Run one relay per outbox, otherwise entries are published
+	// more often.
+	Relay struct {
+		store        Store
+		publisher    Publisher
+		batchSize    uint64
+		pollInterval time.Duration
+		onError      func(error)
+	}
+)
+
+// Publish calls the function.
+func (f PublisherFunc) Publish(ctx context.Context, e *Entry) error {
+	return f(ctx, e)
+}
+
+// BusPublisher publishes events on the event bus, an error is returned if a
+// handler fails to handle the event.
+func BusPublisher(b *bus.EventBus) Publisher {
+	return PublisherFunc(func(ctx context.Context, e *Entry) error {
+		return b.Handle(ctx, e.Event)
+	})
+}
+
+// WebhookPublisher posts events serialised by the message factory to the URL,
+// with the stream name in the X-Stream-Name header. Responses other than 2xx
+// are errors. The Content-Type is given by factories implementing
+// messages.ContentTyper, otherwise it is application/octet-stream.
+func WebhookPublisher(client *http.Client, url string, factory messages.MessageFactory) Publisher {
+	contentType := "application/octet-stream"
+	if ct, ok := factory.(messages.ContentTyper); ok {
+		contentType = ct.ContentType()
+	}
+
+	return PublisherFunc(func(ctx context.Context, e *Entry) error {
+		body, err := factory.Serialize(e.Event)
+		if err != nil {
+			return err
+		}
+
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", contentType)
+		req.Header.Set("X-Stream-Name", e.StreamName)
+
+		res, err := client.Do(req)
+		if err != nil {
+			return err
+		}
+		defer res.Body.Close()
+
+		if res.StatusCode < 200 || res.StatusCode > 299 {
+			return fmt.Errorf("webhook responded with %s", res.Status)
+		}
+		return nil
+	})
+}
+
+// NewRelay returns a relay publishing entries of the store in batches of
+// the size given, checking for new entries every poll interval.
+func NewRelay(store Store, publisher Publisher, batchSize uint64, pollInterval time.Duration) *Relay {
+	return &Relay{
+		store:        store,
+		publisher:    publisher,
+		batchSize:    batchSize,
+		pollInterval: pollInterval,
+		onError:      func(error) {},
+	}
+}
+
+// OnError sets a function called with the errors Run recovers from, such as
+// an entry failing to publish.
+func (r *Relay) OnError(fn func(error)) {
+	r.onError = fn
+}
+
+// RunOnce publishes a batch of pending entries, returning how many were
+// published. Publishing stops at the first entry that fails so entries are
+// published in order, the entries before it are marked delivered.
+func (r *Relay) RunOnce(ctx context.Context) (int, error) {
+	entries, err := r.store.Pending(ctx, r.batchSize)
+	if err != nil {
+		return 0, err
+	}
+
+	delivered := []uint64{}
+	var pubErr error
+	for _, e := range entries {
+		if pubErr = r.publisher.Publish(ctx, e); pubErr != nil {
+			pubErr = fmt.Errorf("unable to publish outbox entry %d: %w", e.ID, pubErr)
+			break
+		}
+		delivered = append(delivered, e.ID)
+	}
+
+	if len(delivered) > 0 {
+		if err := r.store.MarkDelivered(ctx, delivered...); err != nil {
+			return 0, err
+		}
+	}
+
+	return len(delivered), pubErr
+}
+
+// Run publishes pending entries until the context is done, waiting for the
+// poll interval once the outbox is empty or publishing fails.
+func (r *Relay) Run(ctx context.Context) error {
+	for {
+		n, err := r.RunOnce(ctx)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		if err != nil {
+			r.onError(err)
+		}
+
+		// A full batch means more entries are probably waiting.
+		if err == nil && n > 0 && uint64(n) == r.batchSize {
+			continue
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(r.pollInterval):
+		}
+	}
+}
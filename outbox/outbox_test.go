@@ -0,0 +1,170 @@
+package outbox_test
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-cqrses/cqrses/bus"
+	"github.com/go-cqrses/cqrses/messages"
+	"github.com/go-cqrses/cqrses/outbox"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type store struct {
+	entries   []*outbox.Entry
+	delivered map[uint64]bool
+	lock      sync.Mutex
+}
+
+func newStore(n int) *store {
+	s := &store{delivered: map[uint64]bool{}}
+	for i := 1; i <= n; i++ {
+		s.entries = append(s.entries, &outbox.Entry{
+			ID:         uint64(i),
+			StreamName: "users",
+			Event:      messages.NewEvent("e", "user.registered", map[string]interface{}{"n": i}, map[string]interface{}{}, 1, time.Now()),
+		})
+	}
+	return s
+}
+
+func (s *store) Pending(_ context.Context, limit uint64) ([]*outbox.Entry, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	out := []*outbox.Entry{}
+	for _, e := range s.entries {
+		if !s.delivered[e.ID] && (limit == 0 || uint64(len(out)) < limit) {
+			out = append(out, e)
+		}
+	}
+	return out, nil
+}
+
+func (s *store) MarkDelivered(_ context.Context, ids ...uint64) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for _, id := range ids {
+		s.delivered[id] = true
+	}
+	return nil
+}
+
+func TestRelay(t *testing.T) {
+	ctx := context.Background()
+	s := newStore(5)
+	published := []uint64{}
+	fail := true
+
+	relay := outbox.NewRelay(s, outbox.PublisherFunc(func(_ context.Context, e *outbox.Entry) error {
+		if e.ID == 3 && fail {
+			return errors.New("broker down")
+		}
+		published = append(published, e.ID)
+		return nil
+	}), 10, time.Millisecond)
+
+	// Publishing stops at the first failure, keeping the order.
+	n, err := relay.RunOnce(ctx)
+	assert.Equal(t, 2, n)
+	assert.NotNil(t, err)
+	assert.Equal(t, []uint64{1, 2}, published)
+
+	// The relay carries on where it stopped.
+	fail = false
+	n, err = relay.RunOnce(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, 3, n)
+	assert.Equal(t, []uint64{1, 2, 3, 4, 5}, published)
+
+	n, err = relay.RunOnce(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, n)
+}
+
+func TestRelayRun(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	s := newStore(5)
+	handled := make(chan struct{}, 5)
+
+	eventBus := bus.NewEventBus()
+	eventBus.Register(bus.MatchMessageNameRaw("user.registered"), func(context.Context, messages.Message) error {
+		handled <- struct{}{}
+		return nil
+	})
+
+	relay := outbox.NewRelay(s, outbox.BusPublisher(eventBus), 2, time.Millisecond)
+	done := make(chan error)
+	go func() {
+		done <- relay.Run(ctx)
+	}()
+
+	for i := 0; i < 5; i++ {
+		select {
+		case <-handled:
+		case <-ctx.Done():
+			t.Fatal("timed out waiting for entries to be published")
+		}
+	}
+
+	cancel()
+	assert.Equal(t, context.Canceled, <-done)
+
+	pending, _ := s.Pending(context.Background(), 0)
+	assert.Empty(t, pending)
+}
+
+func TestWebhookPublisher(t *testing.T) {
+	var body []byte
+	var streamName, contentType string
+	status := http.StatusInternalServerError
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ = io.ReadAll(r.Body)
+		streamName = r.Header.Get("X-Stream-Name")
+		contentType = r.Header.Get("Content-Type")
+		w.WriteHeader(status)
+	}))
+	defer srv.Close()
+
+	ctx := context.Background()
+	pub := outbox.WebhookPublisher(srv.Client(), srv.URL, messages.NewJSONMessageFactory())
+	e := newStore(1).entries[0]
+
+	assert.NotNil(t, pub.Publish(ctx, e))
+
+	status = http.StatusNoContent
+	assert.Nil(t, pub.Publish(ctx, e))
+	assert.Equal(t, "users", streamName)
+	assert.Equal(t, "application/json", contentType)
+	assert.Contains(t, string(body), `"message_name":"user.registered"`)
+
+	// The content type is given by the message factory.
+	pub = outbox.WebhookPublisher(srv.Client(), srv.URL, &plainFactory{messages.NewJSONMessageFactory()})
+	assert.Nil(t, pub.Publish(ctx, e))
+	assert.Equal(t, "application/octet-stream", contentType)
+	assert.Equal(t, "application/x-protobuf", messages.NewProtoMessageFactory().ContentType())
+}
+
+// plainFactory is a message factory that does not give a content type.
+type plainFactory struct {
+	factory *messages.JSONMessageFactory
+}
+
+func (f *plainFactory) Serialize(m messages.Message) ([]byte, error) {
+	return f.factory.Serialize(m)
+}
+
+func (f *plainFactory) Unserialize(b []byte) (messages.Message, error) {
+	return f.factory.Unserialize(b)
+}
@@ -0,0 +1,16 @@
+package projection
+
+import (
+	"github.com/go-cqrses/cqrses/bus"
+	"github.com/go-cqrses/cqrses/messages"
+)
+
+// WhenTyped calls the handler with events with the name registered for the
+// payload type T, see bus.Typed.
+func WhenTyped[T any](p Projector, r *messages.Registry, h bus.TypedHandler[T]) (Projector, error) {
+	name, err := messages.NameFor[T](r)
+	if err != nil {
+		return p, err
+	}
+	return p.When(name, Handler(bus.Typed(h))), nil
+}
@@ -0,0 +1,497 @@
+// Package saga coordinates workflows spanning several aggregates using
+// process managers. A process manager reacts to the events it is correlated
+// with by recording events of its own, sending commands and scheduling
+// timeouts. Its state is event sourced in the event store like an aggregate,
+// so workflows, their timeouts and the commands they send survive restarts.
+package saga
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/go-cqrses/cqrses/aggregate"
+	"github.com/go-cqrses/cqrses/bus"
+	"github.com/go-cqrses/cqrses/eventstore"
+	"github.com/go-cqrses/cqrses/messages"
+
+	"github.com/gofrs/uuid"
+)
+
+const (
+	// The names of the events recorded for timeouts and commands, they are
+	// not applied to the state.
+	timeoutScheduled = "saga.timeoutScheduled"
+	timeoutFired     = "saga.timeoutFired"
+	commandIssued    = "saga.commandIssued"
+	commandSent      = "saga.commandSent"
+)
+
+type (
+	// State is the user land implementation of a process manager.
+	State interface {
+		// Handle an event the process manager is correlated with, or a
+		// timeout it scheduled. Events may be delivered more than once, so
+		// events that no longer apply to the state should be ignored.
+		Handle(ctx context.Context, msg messages.Message, r *Recorder) error
+		// Apply an event recorded by the process manager.
+		Apply(*messages.Event) error
+	}
+
+	// StateFactory returns a new state for each process manager loaded.
+	StateFactory func() State
+
+	// Correlator returns the ID of the process manager an event is for, false
+	// is returned if the event is not for a process manager.
+	Correlator func(messages.Message) (string, bool)
+
+	// Timeout is the payload of the message given to State.Handle when a
+	// timeout is due, the message is named after the timeout.
+	Timeout struct {
+		SagaID string
+		Name   string
+		Due    time.Time
+	}
+
+	// Manager handles events for the process managers of one type, its
+	// Handle method is registered on an event bus. Process manager events
+	// are stored in the stream named after the type, which must exist.
+	Manager struct {
+		name           string
+		store          eventstore.EventStore
+		commands       *bus.CommandBus
+		factory        StateFactory
+		correlate      Correlator
+		opts           []aggregate.Opt
+		clock          func() time.Time
+		payloadBuilder messages.PayloadBuilder
+
+		// What FireTimeouts has read of the stream, only later events are
+		// read on each call.
+		lock      *sync.Mutex
+		read      uint64
+		timeouts  map[timeoutKey]*Timeout
+		scheduled []timeoutKey
+		unsent    map[string]int
+	}
+
+	timeoutKey struct {
+		sagaID, name, due string
+	}
+
+	// Recorder records what the process manager decided while handling a
+	// message.
+	Recorder struct {
+		sagaID   string
+		record   aggregate.EventRecorder
+		now      time.Time
+		commands []messages.Message
+	}
+
+	// state adapts a State to an aggregate.State, keeping the recorder of
+	// the last message handled and the commands not yet sent.
+	state struct {
+		state    State
+		sagaID   string
+		now      time.Time
+		fired    *Timeout
+		recorder *Recorder
+		unsent   []*messages.Event
+	}
+)
+
+// ByCorrelationID correlates events using their correlation_id metadata.
+func ByCorrelationID() Correlator {
+	return ByMetadata(string(messages.MetaCorrelationID))
+}
+
+// ByMetadata correlates events using the metadata key given, for example an
+// order ID shared by the events of an order, payment and shipment.
+func ByMetadata(key string) Correlator {
+	return func(msg messages.Message) (string, bool) {
+		v, ok := msg.Metadata()[key].(string)
+		return v, ok && v != ""
+	}
+}
+
+// NewManager returns a manager for the process managers of the type given,
+// commands are sent on the command bus. The aggregate options are used when
+// loading process managers, for example to take snapshots.
+func NewManager(name string, store eventstore.EventStore, commands *bus.CommandBus, factory StateFactory, correlate Correlator, opts ...aggregate.Opt) *Manager {
+	return &Manager{
+		name:      name,
+		store:     store,
+		commands:  commands,
+		factory:   factory,
+		correlate: correlate,
+		opts:      opts,
+		clock:     time.Now,
+		lock:      &sync.Mutex{},
+		timeouts:  map[timeoutKey]*Timeout{},
+		unsent:    map[string]int{},
+	}
+}
+
+// SetClock changes how the manager gets the current time, which decides
+// when timeouts are due.
+func (m *Manager) SetClock(clock func() time.Time) {
+	m.clock = clock
+}
+
+// SetPayloadBuilder sets the payload builder used to build the payloads of
+// commands sent again after a failure or restart, without one payloads are
+// built as they were decoded from JSON.
+func (m *Manager) SetPayloadBuilder(pb messages.PayloadBuilder) {
+	m.payloadBuilder = pb
+}
+
+// Handle the event with the process manager it is correlated with, events
+// that are not correlated are ignored.
+//
+// The commands are recorded with the events and sent once they are persisted,
+// commands that could not be sent are sent again the next time the process
+// manager handles a message, or by FireTimeouts. Commands can be sent more
+// than once, so their handlers should ignore message IDs already handled.
+func (m *Manager) Handle(ctx context.Context, msg messages.Message) error {
+	sagaID, ok := m.correlate(msg)
+	if !ok {
+		return nil
+	}
+
+	return m.handle(ctx, sagaID, msg, nil)
+}
+
+// FireTimeouts handles the timeouts that are due, returning how many were
+// handled, then sends the commands process managers could not send.
+func (m *Manager) FireTimeouts(ctx context.Context) (int, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if err := m.readStream(ctx); err != nil {
+		return 0, err
+	}
+
+	due := m.dueTimeouts()
+	loaded := map[string]bool{}
+	for i, t := range due {
+		msg := messages.NewEvent(
+			uuid.Must(uuid.NewV4()).String(),
+			t.Name,
+			t,
+			map[string]interface{}{string(messages.MetaAggregateID): t.SagaID},
+			0,
+			m.clock(),
+		)
+
+		if err := m.handle(ctx, t.SagaID, msg, t); err != nil {
+			return i, err
+		}
+		delete(m.timeouts, timeoutKey{t.SagaID, t.Name, formatDue(t.Due)})
+		loaded[t.SagaID] = true
+	}
+
+	for sagaID := range m.unsent {
+		if loaded[sagaID] {
+			continue
+		}
+
+		if err := m.resend(ctx, sagaID); err != nil {
+			return len(due), err
+		}
+	}
+
+	return len(due), nil
+}
+
+// RunTimeouts fires timeouts every interval until the context is done, the
+// errors firing timeouts are given to onError.
+func (m *Manager) RunTimeouts(ctx context.Context, interval time.Duration, onError func(error)) error {
+	for {
+		if _, err := m.FireTimeouts(ctx); err != nil && ctx.Err() == nil {
+			onError(err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(interval):
+		}
+	}
+}
+
+func (m *Manager) handle(ctx context.Context, sagaID string, msg messages.Message, fired *Timeout) error {
+	// The events recorded, and commands sent, are caused by the message.
+	ctx = context.WithValue(ctx, messages.MetaCausationID, msg.MessageID())
+	if v, ok := msg.Metadata()[string(messages.MetaCorrelationID)].(string); ok {
+		ctx = context.WithValue(ctx, messages.MetaCorrelationID, v)
+	}
+
+	s := m.newState(sagaID, fired)
+	history, err := aggregate.Load(ctx, sagaID, m.store, m.name, s, m.opts...)
+	if err != nil {
+		return err
+	}
+
+	if err := history.Handle(ctx, msg); err != nil {
+		return err
+	}
+
+	if err := history.Close(ctx); err != nil {
+		return err
+	}
+
+	return m.send(ctx, history, s)
+}
+
+// Load the process manager to send the commands it could not send.
+func (m *Manager) resend(ctx context.Context, sagaID string) error {
+	s := m.newState(sagaID, nil)
+	history, err := aggregate.Load(ctx, sagaID, m.store, m.name, s, m.opts...)
+	if err != nil {
+		return err
+	}
+
+	return m.send(ctx, history, s)
+}
+
+func (m *Manager) newState(sagaID string, fired *Timeout) *state {
+	return &state{
+		state:  m.factory(),
+		sagaID: sagaID,
+		now:    m.clock(),
+		fired:  fired,
+	}
+}
+
+// Send the commands not yet sent in the order they were issued, recording
+// them as sent. The commands sent before one fails are still recorded.
+func (m *Manager) send(ctx context.Context, history *aggregate.Aggregate, s *state) error {
+	if len(s.unsent) == 0 {
+		return nil
+	}
+
+	for _, e := range s.unsent {
+		cmd, err := m.command(e, s.recorder)
+		if err == nil {
+			err = m.commands.Handle(ctx, cmd)
+		}
+		if err != nil {
+			if closeErr := history.Close(ctx); closeErr != nil {
+				return errors.Join(err, closeErr)
+			}
+			return err
+		}
+
+		if err := history.RecordThat(ctx, commandSent, map[string]interface{}{"message_id": cmd.MessageID()}); err != nil {
+			return err
+		}
+	}
+
+	return history.Close(ctx)
+}
+
+// The command a commandIssued event is for, commands issued by the message
+// just handled are sent as they were given to the recorder.
+func (m *Manager) command(e *messages.Event, r *Recorder) (messages.Message, error) {
+	data, _ := e.Data().(map[string]interface{})
+	id, _ := data["message_id"].(string)
+
+	if r != nil {
+		for _, cmd := range r.commands {
+			if cmd.MessageID() == id {
+				return cmd, nil
+			}
+		}
+	}
+
+	name, _ := data["message_name"].(string)
+	payload, _ := data["payload"].(string)
+
+	var v interface{}
+	ok := false
+	if m.payloadBuilder != nil {
+		v, ok = m.payloadBuilder.Build(name, []byte(payload))
+	}
+	if !ok {
+		if err := json.Unmarshal([]byte(payload), &v); err != nil {
+			return nil, err
+		}
+	}
+
+	metadata, _ := data["metadata"].(map[string]interface{})
+	created, _ := data["created"].(string)
+	t, _ := time.Parse(time.RFC3339Nano, created)
+
+	return messages.NewCommand(id, name, v, metadata, 0, t), nil
+}
+
+// Read the timeouts and commands recorded since the last read.
+func (m *Manager) readStream(ctx context.Context) error {
+	events := m.store.Load(ctx, m.name, m.read, 0, eventstore.MetadataMatcher{
+		eventstore.PropertyMessageName: eventstore.MetadataMatcherCondition{
+			Operation: eventstore.MatchOpIn,
+			Values:    []string{timeoutScheduled, timeoutFired, commandIssued, commandSent},
+		},
+	})
+	defer events.Close()
+
+	for {
+		if err := events.Next(ctx); err == eventstore.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+
+		e := events.Current()
+		sagaID, _ := e.Metadata()[string(messages.MetaAggregateID)].(string)
+		data, _ := e.Data().(map[string]interface{})
+
+		switch e.MessageName() {
+		case timeoutScheduled, timeoutFired:
+			name, _ := data["name"].(string)
+			due, _ := data["due"].(string)
+			k := timeoutKey{sagaID, name, due}
+
+			if e.MessageName() == timeoutFired {
+				delete(m.timeouts, k)
+				break
+			}
+
+			t, err := time.Parse(time.RFC3339Nano, due)
+			if err != nil {
+				return err
+			}
+			m.timeouts[k] = &Timeout{SagaID: sagaID, Name: name, Due: t}
+			m.scheduled = append(m.scheduled, k)
+		case commandIssued:
+			m.unsent[sagaID]++
+		case commandSent:
+			if m.unsent[sagaID] <= 1 {
+				delete(m.unsent, sagaID)
+			} else {
+				m.unsent[sagaID]--
+			}
+		}
+
+		m.read = e.Position()
+	}
+
+	// Events dropped by upcasters are not read again either.
+	if rp, ok := events.(eventstore.ReadPositioner); ok && rp.ReadPosition() > m.read {
+		m.read = rp.ReadPosition()
+	}
+
+	return nil
+}
+
+// The timeouts read that are due, in the order they were scheduled.
+func (m *Manager) dueTimeouts() []*Timeout {
+	now := m.clock()
+	out := []*Timeout{}
+	scheduled := m.scheduled[:0]
+	for _, k := range m.scheduled {
+		t, ok := m.timeouts[k]
+		if !ok {
+			continue
+		}
+
+		scheduled = append(scheduled, k)
+		if !t.Due.After(now) {
+			out = append(out, t)
+		}
+	}
+	m.scheduled = scheduled
+
+	return out
+}
+
+// SagaID returns the ID of the process manager.
+func (r *Recorder) SagaID() string {
+	return r.sagaID
+}
+
+// RecordThat the process manager decided something, the event is applied to
+// the state and persisted.
+func (r *Recorder) RecordThat(eventName string, data interface{}) error {
+	return r.record(eventName, data)
+}
+
+// Send the command once the events recorded are persisted, the command is
+// recorded with them so it is sent even if sending first fails.
+func (r *Recorder) Send(cmd messages.Message) error {
+	payload, err := json.Marshal(cmd.Data())
+	if err != nil {
+		return err
+	}
+
+	r.commands = append(r.commands, cmd)
+	return r.record(commandIssued, map[string]interface{}{
+		"message_id":   cmd.MessageID(),
+		"message_name": cmd.MessageName(),
+		"payload":      string(payload),
+		"metadata":     cmd.Metadata(),
+		"created":      cmd.Created().UTC().Format(time.RFC3339Nano),
+	})
+}
+
+// Schedule a timeout, the message named timeoutName is handled by the
+// process manager once the duration has passed.
+func (r *Recorder) Schedule(timeoutName string, after time.Duration) error {
+	return r.record(timeoutScheduled, timeoutData(timeoutName, r.now.Add(after)))
+}
+
+// Handle the message with the state, recording the timeout as fired if the
+// message is for one.
+func (s *state) Handle(ctx context.Context, msg messages.Message, er aggregate.EventRecorder) error {
+	s.recorder = &Recorder{
+		sagaID:   s.sagaID,
+		record:   er,
+		now:      s.now,
+		commands: []messages.Message{},
+	}
+
+	if s.fired != nil {
+		if err := er(timeoutFired, timeoutData(s.fired.Name, s.fired.Due)); err != nil {
+			return err
+		}
+	}
+
+	return s.state.Handle(ctx, msg, s.recorder)
+}
+
+// Apply the events recorded by the state, keeping track of the commands
+// not yet sent.
+func (s *state) Apply(e *messages.Event) error {
+	switch e.MessageName() {
+	case timeoutScheduled, timeoutFired:
+		return nil
+	case commandIssued:
+		s.unsent = append(s.unsent, e)
+		return nil
+	case commandSent:
+		data, _ := e.Data().(map[string]interface{})
+		for i, issued := range s.unsent {
+			if issuedData, _ := issued.Data().(map[string]interface{}); issuedData["message_id"] == data["message_id"] {
+				s.unsent = append(s.unsent[:i:i], s.unsent[i+1:]...)
+				break
+			}
+		}
+		return nil
+	}
+	return s.state.Apply(e)
+}
+
+// Timeouts are stored as a map so they can be read back without a payload
+// builder.
+func timeoutData(name string, due time.Time) map[string]interface{} {
+	return map[string]interface{}{
+		"name": name,
+		"due":  formatDue(due),
+	}
+}
+
+func formatDue(due time.Time) string {
+	return due.UTC().Format(time.RFC3339Nano)
+}
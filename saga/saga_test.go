@@ -0,0 +1,218 @@
+package saga_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/go-cqrses/cqrses/adapters/inmem"
+	"github.com/go-cqrses/cqrses/bus"
+	"github.com/go-cqrses/cqrses/eventstore"
+	"github.com/go-cqrses/cqrses/messages"
+	"github.com/go-cqrses/cqrses/saga"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type checkout struct {
+	status string
+}
+
+func (s *checkout) Handle(_ context.Context, msg messages.Message, r *saga.Recorder) error {
+	switch msg.MessageName() {
+	case "order.placed":
+		if s.status != "" {
+			return nil
+		}
+		if err := r.Send(command("payment.request", r.SagaID())); err != nil {
+			return err
+		}
+		if err := r.Schedule("payment.timeout", time.Hour); err != nil {
+			return err
+		}
+		return r.RecordThat("checkout.started", map[string]interface{}{})
+	case "payment.received":
+		if s.status != "started" {
+			return nil
+		}
+		if err := r.Send(command("shipping.ship", r.SagaID())); err != nil {
+			return err
+		}
+		return r.RecordThat("checkout.paid", map[string]interface{}{})
+	case "payment.timeout":
+		if s.status != "started" {
+			return nil
+		}
+		if err := r.Send(command("order.cancel", r.SagaID())); err != nil {
+			return err
+		}
+		return r.RecordThat("checkout.cancelled", map[string]interface{}{})
+	}
+	return nil
+}
+
+func (s *checkout) Apply(e *messages.Event) error {
+	switch e.MessageName() {
+	case "checkout.started":
+		s.status = "started"
+	case "checkout.paid":
+		s.status = "paid"
+	case "checkout.cancelled":
+		s.status = "cancelled"
+	}
+	return nil
+}
+
+func command(name, orderID string) messages.Message {
+	return messages.NewCommand(name+"-"+orderID, name, orderID, map[string]interface{}{}, 0, time.Now())
+}
+
+func event(id, name, orderID string) messages.Message {
+	return messages.NewEvent(id, name, map[string]interface{}{}, map[string]interface{}{"order_id": orderID}, 0, time.Now())
+}
+
+// fixture returns an event store with the saga stream and a command bus
+// recording the commands sent.
+func fixture(t *testing.T) (eventstore.EventStore, *bus.CommandBus, *[]string) {
+	es := inmem.New()
+	assert.Nil(t, es.Create(context.Background(), eventstore.EmptyStreamWithName("checkouts")))
+
+	sent := []string{}
+	commands := bus.NewCommandBus()
+	for _, name := range []string{"payment.request", "shipping.ship", "order.cancel"} {
+		commands.Register(name, func(_ context.Context, msg messages.Message) error {
+			sent = append(sent, msg.MessageName()+" "+msg.Data().(string))
+			return nil
+		})
+	}
+
+	return es, commands, &sent
+}
+
+func newManager(es eventstore.EventStore, commands *bus.CommandBus) *saga.Manager {
+	return saga.NewManager("checkouts", es, commands, func() saga.State {
+		return &checkout{}
+	}, saga.ByMetadata("order_id"))
+}
+
+func TestManager(t *testing.T) {
+	ctx := context.Background()
+	es, commands, sent := fixture(t)
+
+	events := bus.NewEventBus()
+	events.Subscribe("checkouts", bus.MatchAny(), newManager(es, commands).Handle)
+
+	assert.Nil(t, events.Handle(ctx, event("e1", "order.placed", "o1")))
+	assert.Nil(t, events.Handle(ctx, event("e2", "order.placed", "o2")))
+	assert.Nil(t, events.Handle(ctx, event("e3", "payment.received", "o1")))
+	assert.Equal(t, []string{"payment.request o1", "payment.request o2", "shipping.ship o1"}, *sent)
+
+	// Events that are not correlated are ignored.
+	uncorrelated := messages.NewEvent("e4", "order.placed", map[string]interface{}{}, map[string]interface{}{}, 0, time.Now())
+	assert.Nil(t, events.Handle(ctx, uncorrelated))
+	assert.Len(t, *sent, 3)
+
+	// The state is persisted so a new manager ignores redelivered events.
+	sut := newManager(es, commands)
+	assert.Nil(t, sut.Handle(ctx, event("e3", "payment.received", "o1")))
+	assert.Nil(t, sut.Handle(ctx, event("e5", "payment.received", "o2")))
+	assert.Equal(t, []string{"payment.request o1", "payment.request o2", "shipping.ship o1", "shipping.ship o2"}, *sent)
+
+	// Saga events are caused by the event handled.
+	stream := es.Load(ctx, "checkouts", 0, 0, eventstore.MetadataMatcher{
+		eventstore.PropertyMessageName: eventstore.MetadataMatcherCondition{
+			Operation: eventstore.MatchOpEq,
+			Values:    []string{"checkout.paid"},
+		},
+	})
+	defer stream.Close()
+	assert.Nil(t, stream.Next(ctx))
+	assert.Equal(t, "e3", stream.Current().Metadata()[string(messages.MetaCausationID)])
+	assert.Equal(t, "o1", stream.Current().Metadata()[string(messages.MetaAggregateID)])
+}
+
+func TestManagerTimeouts(t *testing.T) {
+	ctx := context.Background()
+	es, commands, sent := fixture(t)
+	sut := newManager(es, commands)
+
+	assert.Nil(t, sut.Handle(ctx, event("e1", "order.placed", "o1")))
+	assert.Nil(t, sut.Handle(ctx, event("e2", "order.placed", "o2")))
+	assert.Nil(t, sut.Handle(ctx, event("e3", "payment.received", "o2")))
+
+	n, err := sut.FireTimeouts(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, n)
+
+	// Timeouts are read from the event store, so survive restarts.
+	later := time.Now().Add(2 * time.Hour)
+	sut = newManager(es, commands)
+	sut.SetClock(func() time.Time { return later })
+
+	n, err = sut.FireTimeouts(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, n)
+	assert.Equal(t, []string{"payment.request o1", "payment.request o2", "shipping.ship o2", "order.cancel o1"}, *sent)
+
+	n, err = sut.FireTimeouts(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, n)
+}
+
+// loadCounter records where each read of the saga stream started from.
+type loadCounter struct {
+	eventstore.EventStore
+	from []uint64
+}
+
+func (s *loadCounter) Load(ctx context.Context, streamName string, from, count uint64, matcher eventstore.MetadataMatcher) eventstore.StreamIterator {
+	if _, ok := matcher[eventstore.PropertyMessageName]; ok {
+		s.from = append(s.from, from)
+	}
+	return s.EventStore.Load(ctx, streamName, from, count, matcher)
+}
+
+func TestManagerResendsCommands(t *testing.T) {
+	ctx := context.Background()
+	es, _, _ := fixture(t)
+	store := &loadCounter{EventStore: es}
+
+	down := true
+	sent := []string{}
+	commands := bus.NewCommandBus()
+	commands.Register("payment.request", func(_ context.Context, msg messages.Message) error {
+		if down {
+			return errors.New("payments down")
+		}
+		sent = append(sent, msg.MessageID()+" "+msg.Data().(string))
+		return nil
+	})
+
+	// The command is recorded even though sending it fails.
+	sut := newManager(store, commands)
+	assert.NotNil(t, sut.Handle(ctx, event("e1", "order.placed", "o1")))
+	assert.Empty(t, sent)
+
+	n, err := sut.FireTimeouts(ctx)
+	assert.NotNil(t, err)
+	assert.Equal(t, 0, n)
+
+	// Sent again once the handler is back, even after a restart.
+	down = false
+	sut = newManager(store, commands)
+	store.from = nil
+	_, err = sut.FireTimeouts(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"payment.request-o1 o1"}, sent)
+
+	// Commands are only sent until they are recorded as sent, and each call
+	// only reads the events recorded since the last.
+	_, err = sut.FireTimeouts(ctx)
+	assert.Nil(t, err)
+	assert.Len(t, sent, 1)
+	if assert.Len(t, store.from, 2) {
+		assert.Equal(t, uint64(0), store.from[0])
+		assert.True(t, store.from[1] > 0)
+	}
+}
@@ -0,0 +1,74 @@
+package shredding
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"io"
+)
+
+const (
+	// KeySize is the size of the keys, in bytes, to use AES-256.
+	KeySize = 32
+)
+
+var (
+	// ErrInvalidCiphertext is returned when an encrypted field can not be
+	// decrypted with the subject's key.
+	ErrInvalidCiphertext = errors.New("invalid encrypted field")
+)
+
+// NewKey returns a new random key for a subject.
+func NewKey() ([]byte, error) {
+	key := make([]byte, KeySize)
+	if _, err := io.ReadFull(rand.Reader, key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// Encrypt the plaintext with AES-GCM, the subject is authenticated with the
+// ciphertext so it can not be moved to another subject's events.
+func encrypt(key []byte, subjectID string, plaintext []byte) (string, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return "", err
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return "", err
+	}
+
+	sealed := gcm.Seal(nonce, nonce, plaintext, []byte(subjectID))
+	return base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+func decrypt(key []byte, subjectID string, ciphertext string) ([]byte, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+
+	sealed, err := base64.StdEncoding.DecodeString(ciphertext)
+	if err != nil || len(sealed) < gcm.NonceSize() {
+		return nil, ErrInvalidCiphertext
+	}
+
+	nonce, sealed := sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():]
+	plaintext, err := gcm.Open(nil, nonce, sealed, []byte(subjectID))
+	if err != nil {
+		return nil, ErrInvalidCiphertext
+	}
+	return plaintext, nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
@@ -0,0 +1,308 @@
+package shredding
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/go-cqrses/cqrses/eventstore"
+	"github.com/go-cqrses/cqrses/messages"
+)
+
+type (
+	// shreddingEventStore encrypts fields of events going via appendTo
+	// and decrypts them as they are loaded.
+	shreddingEventStore struct {
+		store          eventstore.EventStore
+		keys           KeyStore
+		fields         Fields
+		payloadBuilder messages.PayloadBuilder
+	}
+)
+
+// EventStoreWithShredding returns an event store that encrypts the fields of
+// events with the key of the aggregate they belong to. Loaded events have
+// their payloads built again using the payload builder, which can be nil to
+// build maps. Once an aggregate's key is deleted its encrypted fields are
+// loaded as null.
+//
+// Events are given to the store encrypted, so wrap this event store with
+// bus.EventStoreWithBus to publish the events as they were recorded.
+func EventStoreWithShredding(store eventstore.EventStore, keys KeyStore, fields Fields, payloadBuilder messages.PayloadBuilder) eventstore.EventStore {
+	return &shreddingEventStore{
+		store:          store,
+		keys:           keys,
+		fields:         fields,
+		payloadBuilder: payloadBuilder,
+	}
+}
+
+// Load proxies to underlying store, decrypting events.
+func (s *shreddingEventStore) Load(ctx context.Context, streamName string, from, count uint64, matcher eventstore.MetadataMatcher) eventstore.StreamIterator {
+	return &iterator{it: s.store.Load(ctx, streamName, from, count, matcher), store: s}
+}
+
+// LoadReverse proxies to underlying store, decrypting events.
+func (s *shreddingEventStore) LoadReverse(ctx context.Context, streamName string, from, count uint64, matcher eventstore.MetadataMatcher) eventstore.StreamIterator {
+	return &iterator{it: s.store.LoadReverse(ctx, streamName, from, count, matcher), store: s}
+}
+
+// FetchStreamNames proxies to underlying store.
+func (s *shreddingEventStore) FetchStreamNames(ctx context.Context, filter string, matcher eventstore.MetadataMatcher, limit, offset uint64) ([]string, error) {
+	return s.store.FetchStreamNames(ctx, filter, matcher, limit, offset)
+}
+
+// FetchStreamNamesRegex proxies to underlying store.
+func (s *shreddingEventStore) FetchStreamNamesRegex(ctx context.Context, filter string, matcher eventstore.MetadataMatcher, limit, offset uint64) ([]string, error) {
+	return s.store.FetchStreamNamesRegex(ctx, filter, matcher, limit, offset)
+}
+
+// FetchStreamMetadata proxies to underlying store.
+func (s *shreddingEventStore) FetchStreamMetadata(ctx context.Context, streamName string) (eventstore.StreamMetadata, error) {
+	return s.store.FetchStreamMetadata(ctx, streamName)
+}
+
+// Subscribe proxies to underlying store, decrypting events.
+func (s *shreddingEventStore) Subscribe(ctx context.Context, streamName string, from uint64, matcher eventstore.MetadataMatcher) (eventstore.Subscription, error) {
+	sub, err := s.store.Subscribe(ctx, streamName, from, matcher)
+	if err != nil {
+		return nil, err
+	}
+
+	return newSubscription(ctx, sub, s), nil
+}
+
+// Create proxies to underlying store, encrypting events.
+func (s *shreddingEventStore) Create(ctx context.Context, stream *eventstore.Stream) error {
+	encrypted, err := s.encryptAll(ctx, stream.Events)
+	if err != nil {
+		return err
+	}
+
+	return s.store.Create(ctx, eventstore.NewStreamWithName(stream.Name, stream.Metadata, encrypted))
+}
+
+// AppendTo proxies to underlying store, encrypting events.
+func (s *shreddingEventStore) AppendTo(ctx context.Context, streamName string, events []*messages.Event) error {
+	return s.AppendToExpecting(ctx, streamName, eventstore.AnyVersion, events)
+}
+
+// AppendToExpecting proxies to underlying store, encrypting events.
+func (s *shreddingEventStore) AppendToExpecting(ctx context.Context, streamName string, expected eventstore.ExpectedVersion, events []*messages.Event) error {
+	encrypted, err := s.encryptAll(ctx, events)
+	if err != nil {
+		return err
+	}
+
+	return s.store.AppendToExpecting(ctx, streamName, expected, encrypted)
+}
+
+// Commit proxies to underlying store, encrypting events.
+func (s *shreddingEventStore) Commit(ctx context.Context, uow *eventstore.UnitOfWork) error {
+	encrypted := eventstore.NewUnitOfWork()
+	for _, a := range uow.Appends() {
+		events, err := s.encryptAll(ctx, a.Events)
+		if err != nil {
+			return err
+		}
+		encrypted.AppendToExpecting(a.StreamName, a.Expected, events)
+	}
+
+	return s.store.Commit(ctx, encrypted)
+}
+
+// Truncate proxies to underlying store.
+func (s *shreddingEventStore) Truncate(ctx context.Context, streamName string, before uint64) error {
+	return s.store.Truncate(ctx, streamName, before)
+}
+
+// SoftDelete proxies to underlying store.
+func (s *shreddingEventStore) SoftDelete(ctx context.Context, streamName string) error {
+	return s.store.SoftDelete(ctx, streamName)
+}
+
+// Delete proxies to underlying store.
+func (s *shreddingEventStore) Delete(ctx context.Context, streamName string) error {
+	return s.store.Delete(ctx, streamName)
+}
+
+// UpdateStreamMetadata proxies to underlying store.
+func (s *shreddingEventStore) UpdateStreamMetadata(ctx context.Context, streamName string, newMetadata eventstore.StreamMetadata) error {
+	return s.store.UpdateStreamMetadata(ctx, streamName, newMetadata)
+}
+
+func (s *shreddingEventStore) encryptAll(ctx context.Context, events []*messages.Event) ([]*messages.Event, error) {
+	out := make([]*messages.Event, len(events))
+	for i, e := range events {
+		var err error
+		if out[i], err = s.encrypt(ctx, e); err != nil {
+			return nil, err
+		}
+	}
+	return out, nil
+}
+
+// Encrypt the fields of the event that are set, the names of the encrypted
+// fields are added to the metadata.
+func (s *shreddingEventStore) encrypt(ctx context.Context, e *messages.Event) (*messages.Event, error) {
+	names, ok := s.fields[e.MessageName()]
+	if !ok || len(names) == 0 {
+		return e, nil
+	}
+
+	subjectID, ok := e.Metadata()[string(messages.MetaAggregateID)].(string)
+	if !ok || subjectID == "" {
+		return nil, ErrNoSubject
+	}
+
+	data, err := payloadMap(e.Data())
+	if err != nil {
+		return nil, err
+	}
+
+	var key []byte
+	encrypted := []string{}
+	for _, name := range names {
+		v, ok := data[name]
+		if !ok {
+			continue
+		}
+
+		if key == nil {
+			if key, err = s.keys.GetOrCreate(ctx, subjectID); err != nil {
+				return nil, err
+			}
+		}
+
+		plaintext, err := json.Marshal(v)
+		if err != nil {
+			return nil, err
+		}
+
+		if data[name], err = encrypt(key, subjectID, plaintext); err != nil {
+			return nil, err
+		}
+		encrypted = append(encrypted, name)
+	}
+
+	if len(encrypted) == 0 {
+		return e, nil
+	}
+
+	md := make(map[string]interface{}, len(e.Metadata())+1)
+	for k, v := range e.Metadata() {
+		md[k] = v
+	}
+	md[string(messages.MetaEncryptedFields)] = encrypted
+
+	return messages.EventWithPosition(
+		messages.NewEvent(e.MessageID(), e.MessageName(), data, md, e.Version(), e.Created()),
+		e.Position(),
+	), nil
+}
+
+// Decrypt the fields listed in the event's metadata, if the key has been
+// deleted the fields are set to null.
+func (s *shreddingEventStore) decrypt(ctx context.Context, e *messages.Event) (*messages.Event, error) {
+	names := encryptedFields(e.Metadata())
+	if len(names) == 0 {
+		return e, nil
+	}
+
+	subjectID, _ := e.Metadata()[string(messages.MetaAggregateID)].(string)
+	key, err := s.keys.Get(ctx, subjectID)
+	if err != nil && err != ErrKeyNotFound && err != ErrKeyDeleted {
+		return nil, err
+	}
+
+	data, err := payloadMap(e.Data())
+	if err != nil {
+		return nil, err
+	}
+
+	for _, name := range names {
+		if key == nil {
+			data[name] = nil
+			continue
+		}
+
+		ciphertext, ok := data[name].(string)
+		if !ok {
+			return nil, ErrInvalidCiphertext
+		}
+
+		plaintext, err := decrypt(key, subjectID, ciphertext)
+		if err != nil {
+			return nil, err
+		}
+
+		if data[name], err = unmarshal(plaintext); err != nil {
+			return nil, err
+		}
+	}
+
+	payload, err := json.Marshal(data)
+	if err != nil {
+		return nil, err
+	}
+
+	return eventstore.RawEvent{
+		MessageID:   e.MessageID(),
+		MessageName: e.MessageName(),
+		Payload:     payload,
+		Metadata:    e.Metadata(),
+		Version:     e.Version(),
+		Created:     e.Created(),
+		Position:    e.Position(),
+	}.Build(s.payloadBuilder)
+}
+
+// The payload as a map of its JSON fields.
+func payloadMap(data interface{}) (map[string]interface{}, error) {
+	b, err := json.Marshal(data)
+	if err != nil {
+		return nil, err
+	}
+
+	v, err := unmarshal(b)
+	if err != nil {
+		return nil, err
+	}
+
+	m, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("payload is not a JSON object: %s", b)
+	}
+	return m, nil
+}
+
+// Numbers are kept as they were written rather than converted to floats.
+func unmarshal(b []byte) (interface{}, error) {
+	d := json.NewDecoder(bytes.NewReader(b))
+	d.UseNumber()
+
+	var v interface{}
+	if err := d.Decode(&v); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+// The encrypted fields in the metadata, which is a slice of interfaces
+// once it has been stored as JSON.
+func encryptedFields(md map[string]interface{}) []string {
+	switch v := md[string(messages.MetaEncryptedFields)].(type) {
+	case []string:
+		return v
+	case []interface{}:
+		out := make([]string, 0, len(v))
+		for _, name := range v {
+			if s, ok := name.(string); ok {
+				out = append(out, s)
+			}
+		}
+		return out
+	}
+	return nil
+}
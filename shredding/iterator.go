@@ -0,0 +1,116 @@
+package shredding
+
+import (
+	"context"
+	"sync"
+
+	"github.com/go-cqrses/cqrses/eventstore"
+	"github.com/go-cqrses/cqrses/messages"
+)
+
+type (
+	// iterator decrypts the events of the underlying iterator.
+	iterator struct {
+		it          eventstore.StreamIterator
+		store       *shreddingEventStore
+		currentItem *messages.Event
+	}
+
+	// subscription decrypts the events of the underlying subscription.
+	subscription struct {
+		sub    eventstore.Subscription
+		events chan *messages.Event
+		done   chan struct{}
+		close  *sync.Once
+		err    error
+		lock   *sync.Mutex
+	}
+)
+
+// Current will return the decrypted event.
+func (it *iterator) Current() *messages.Event {
+	return it.currentItem
+}
+
+// Next will move to and decrypt the next event.
+func (it *iterator) Next(ctx context.Context) error {
+	if err := it.it.Next(ctx); err != nil {
+		return err
+	}
+
+	var err error
+	it.currentItem, err = it.store.decrypt(ctx, it.it.Current())
+	return err
+}
+
+// Rewind proxies to the underlying iterator.
+func (it *iterator) Rewind() {
+	it.currentItem = nil
+	it.it.Rewind()
+}
+
+// Close proxies to the underlying iterator.
+func (it *iterator) Close() {
+	it.currentItem = nil
+	it.it.Close()
+}
+
+func newSubscription(ctx context.Context, sub eventstore.Subscription, store *shreddingEventStore) *subscription {
+	s := &subscription{
+		sub:    sub,
+		events: make(chan *messages.Event),
+		done:   make(chan struct{}),
+		close:  &sync.Once{},
+		lock:   &sync.Mutex{},
+	}
+
+	go s.run(ctx, store)
+
+	return s
+}
+
+// Events returns the channel decrypted events are delivered on.
+func (s *subscription) Events() <-chan *messages.Event {
+	return s.events
+}
+
+// Err returns the reason the subscription ended.
+func (s *subscription) Err() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.err != nil {
+		return s.err
+	}
+	return s.sub.Err()
+}
+
+// Close will end the subscription.
+func (s *subscription) Close() {
+	s.close.Do(func() {
+		close(s.done)
+	})
+	s.sub.Close()
+}
+
+func (s *subscription) run(ctx context.Context, store *shreddingEventStore) {
+	defer close(s.events)
+
+	for e := range s.sub.Events() {
+		decrypted, err := store.decrypt(ctx, e)
+		if err != nil {
+			s.lock.Lock()
+			s.err = err
+			s.lock.Unlock()
+
+			s.sub.Close()
+			return
+		}
+
+		select {
+		case <-s.done:
+			return
+		case s.events <- decrypted:
+		}
+	}
+}
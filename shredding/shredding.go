@@ -0,0 +1,42 @@
+// Package shredding encrypts personal data in events with a key per subject,
+// deleting the key forgets the data without changing the events themselves.
+package shredding
+
+import (
+	"context"
+	"errors"
+)
+
+var (
+	// ErrKeyNotFound is returned when a subject has no key.
+	ErrKeyNotFound = errors.New("encryption key not found")
+
+	// ErrKeyDeleted is returned when the key for a subject has been deleted,
+	// the subject has been forgotten and no more data can be encrypted for it.
+	ErrKeyDeleted = errors.New("encryption key deleted")
+
+	// ErrNoSubject is returned when an event with fields to encrypt does
+	// not belong to an aggregate.
+	ErrNoSubject = errors.New("event has no aggregate id to encrypt for")
+)
+
+type (
+	// Fields are the payload fields to encrypt by event name.
+	Fields map[string][]string
+
+	// KeyStore contains the methods to manage the encryption key of each subject.
+	KeyStore interface {
+		// GetOrCreate will return the key for the subject, creating one if the
+		// subject does not have one. If the key was deleted ErrKeyDeleted is
+		// returned rather than creating another.
+		GetOrCreate(ctx context.Context, subjectID string) ([]byte, error)
+
+		// Get will return the key for the subject, ErrKeyNotFound is returned
+		// if there is none and ErrKeyDeleted if it has been deleted.
+		Get(ctx context.Context, subjectID string) ([]byte, error)
+
+		// Delete will remove the key for the subject, the subject is remembered
+		// so a new key is never created for it.
+		Delete(ctx context.Context, subjectID string) error
+	}
+)
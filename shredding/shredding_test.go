@@ -0,0 +1,169 @@
+package shredding_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/go-cqrses/cqrses/adapters/inmem"
+	"github.com/go-cqrses/cqrses/eventstore"
+	"github.com/go-cqrses/cqrses/messages"
+	"github.com/go-cqrses/cqrses/shredding"
+
+	"github.com/gofrs/uuid"
+	"github.com/stretchr/testify/assert"
+)
+
+type userRegistered struct {
+	Email string `json:"email"`
+	Age   int    `json:"age"`
+	Plan  string `json:"plan"`
+}
+
+func setup(t *testing.T) (eventstore.EventStore, eventstore.EventStore, *inmem.KeyStore) {
+	pb := messages.NewJSONMessageFactory()
+	pb.Builds("user_registered", func() interface{} { return &userRegistered{} })
+
+	store := inmem.New()
+	keys := inmem.NewKeyStore()
+	es := shredding.EventStoreWithShredding(store, keys, shredding.Fields{
+		"user_registered": {"email", "age"},
+	}, pb)
+
+	if err := es.Create(context.Background(), eventstore.EmptyStreamWithName("users")); err != nil {
+		t.Fatal(err)
+	}
+	return es, store, keys
+}
+
+func registered(aID string, data interface{}) *messages.Event {
+	return messages.NewAggregateEvent(context.Background(), aID, 1, "user_registered", data)
+}
+
+func loadOne(t *testing.T, es eventstore.EventStore, aID string) *messages.Event {
+	ctx := context.Background()
+	it := es.Load(ctx, "users", 0, 0, eventstore.MetadataMatcher{
+		string(messages.MetaAggregateID): eventstore.MetadataMatcherCondition{
+			Operation: eventstore.MatchOpEq,
+			Values:    []string{aID},
+		},
+	})
+	defer it.Close()
+
+	if err := it.Next(ctx); err != nil {
+		t.Fatalf("unable to load event: %s", err)
+	}
+	return it.Current()
+}
+
+func TestEventStoreWithShredding(t *testing.T) {
+	ctx := context.Background()
+	es, store, keys := setup(t)
+
+	ann := uuid.Must(uuid.NewV4()).String()
+	bob := uuid.Must(uuid.NewV4()).String()
+	assert.Nil(t, es.AppendTo(ctx, "users", []*messages.Event{
+		registered(ann, &userRegistered{Email: "ann@example.com", Age: 41, Plan: "pro"}),
+		registered(bob, map[string]interface{}{"email": "bob@example.com", "plan": "free"}),
+	}))
+
+	// Stored encrypted, apart from fields not listed.
+	stored := loadOne(t, store, ann)
+	data := stored.Data().(map[string]interface{})
+	assert.NotEqual(t, "ann@example.com", data["email"])
+	assert.NotEqual(t, 41, data["age"])
+	assert.Equal(t, "pro", data["plan"])
+	assert.Equal(t, []string{"email", "age"}, stored.Metadata()[string(messages.MetaEncryptedFields)])
+
+	// Fields that are not set are not encrypted.
+	stored = loadOne(t, store, bob)
+	assert.Equal(t, []string{"email"}, stored.Metadata()[string(messages.MetaEncryptedFields)])
+
+	// Loaded decrypted and built using the payload builder.
+	assert.Equal(t, &userRegistered{Email: "ann@example.com", Age: 41, Plan: "pro"}, loadOne(t, es, ann).Data())
+	assert.Equal(t, &userRegistered{Email: "bob@example.com", Plan: "free"}, loadOne(t, es, bob).Data())
+
+	// Forgetting Ann leaves Bob alone.
+	assert.Nil(t, keys.Delete(ctx, ann))
+	assert.Equal(t, &userRegistered{Plan: "pro"}, loadOne(t, es, ann).Data())
+	assert.Equal(t, &userRegistered{Email: "bob@example.com", Plan: "free"}, loadOne(t, es, bob).Data())
+
+	// No more personal data can be recorded for Ann.
+	err := es.AppendTo(ctx, "users", []*messages.Event{
+		messages.NewAggregateEvent(ctx, ann, 2, "user_registered", &userRegistered{Email: "ann@example.org"}),
+	})
+	assert.Equal(t, shredding.ErrKeyDeleted, err)
+
+	// But events without personal data can be.
+	err = es.AppendTo(ctx, "users", []*messages.Event{
+		messages.NewAggregateEvent(ctx, ann, 2, "user_upgraded", map[string]interface{}{"plan": "team"}),
+	})
+	assert.Nil(t, err)
+}
+
+func TestEventStoreWithShreddingNoSubject(t *testing.T) {
+	es, _, _ := setup(t)
+
+	e := messages.NewEvent(uuid.Must(uuid.NewV4()).String(), "user_registered", map[string]interface{}{"email": "ann@example.com"}, map[string]interface{}{}, 1, time.Now())
+	assert.Equal(t, shredding.ErrNoSubject, es.AppendTo(context.Background(), "users", []*messages.Event{e}))
+}
+
+func TestEventStoreWithShreddingCommit(t *testing.T) {
+	ctx := context.Background()
+	es, store, _ := setup(t)
+
+	ann := uuid.Must(uuid.NewV4()).String()
+	uow := eventstore.NewUnitOfWork()
+	uow.AppendToExpecting("users", eventstore.NoStream, []*messages.Event{
+		registered(ann, &userRegistered{Email: "ann@example.com", Plan: "pro"}),
+	})
+	assert.Nil(t, es.Commit(ctx, uow))
+
+	assert.NotEqual(t, "ann@example.com", loadOne(t, store, ann).Data().(map[string]interface{})["email"])
+	assert.Equal(t, &userRegistered{Email: "ann@example.com", Plan: "pro"}, loadOne(t, es, ann).Data())
+}
+
+func TestEventStoreWithShreddingCreate(t *testing.T) {
+	ctx := context.Background()
+	es, store, _ := setup(t)
+
+	ann := uuid.Must(uuid.NewV4()).String()
+	assert.Nil(t, es.Create(ctx, eventstore.NewStreamWithName("customers", eventstore.StreamMetadata{}, []*messages.Event{
+		registered(ann, &userRegistered{Email: "ann@example.com", Plan: "pro"}),
+	})))
+
+	it := store.Load(ctx, "customers", 0, 0, eventstore.MetadataMatcher{})
+	defer it.Close()
+	if assert.Nil(t, it.Next(ctx)) {
+		assert.NotEqual(t, "ann@example.com", it.Current().Data().(map[string]interface{})["email"])
+	}
+}
+
+func TestEventStoreWithShreddingSubscribe(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	es, _, _ := setup(t)
+
+	ann := uuid.Must(uuid.NewV4()).String()
+	assert.Nil(t, es.AppendTo(ctx, "users", []*messages.Event{
+		registered(ann, &userRegistered{Email: "ann@example.com"}),
+	}))
+
+	sub, err := es.Subscribe(ctx, "users", 0, eventstore.MetadataMatcher{})
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer sub.Close()
+
+	select {
+	case e := <-sub.Events():
+		assert.Equal(t, &userRegistered{Email: "ann@example.com"}, e.Data())
+	case <-ctx.Done():
+		t.Fatal("timed out waiting for event")
+	}
+
+	sub.Close()
+	for range sub.Events() {
+	}
+	assert.Nil(t, sub.Err())
+}
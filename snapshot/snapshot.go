@@ -0,0 +1,41 @@
+package snapshot
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+var (
+	// ErrSnapshotNotFound is returned when there is no snapshot
+	// for the aggregate requested.
+	ErrSnapshotNotFound = errors.New("snapshot not found")
+)
+
+type (
+	// Snapshot is the serialised state of an aggregate at a version,
+	// allowing the aggregate to be loaded without replaying every event.
+	Snapshot struct {
+		// The name of the stream the aggregate events are stored in.
+		StreamName string
+		// The ID of the aggregate the snapshot was taken of.
+		AggregateID string
+		// The aggregate version the snapshot was taken at.
+		Version uint64
+		// The serialised aggregate state.
+		Data []byte
+		// When the snapshot was taken.
+		Created time.Time
+	}
+
+	// SnapshotStore contains the methods to store and retrieve snapshots.
+	SnapshotStore interface {
+		// Save will store the snapshot, replacing an older snapshot
+		// for the same aggregate.
+		Save(ctx context.Context, s *Snapshot) error
+
+		// Get will return the latest snapshot for the aggregate, if there
+		// is none ErrSnapshotNotFound is returned.
+		Get(ctx context.Context, streamName, aggregateID string) (*Snapshot, error)
+	}
+)